@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Roles
+const (
+	RoleAdmin  = "admin"  // Everything, including cluster controls and ACLs
+	RoleWriter = "writer" // Read and write files
+	RoleReader = "reader" // Read files
+	RolePeer   = "peer"   // Other nodes, for Paxos messages
+)
+
+// Permissions
+const (
+	PermRead  = "r"
+	PermWrite = "w"
+)
+
+var ErrUnauthenticated = errors.New("authentication required: missing or invalid token")
+
+// Authenticated caller
+type Principal struct {
+	Name string
+	Role string
+}
+
+// Access rule for a path prefix, stored in the replicated state
+type Rule struct {
+	Prefix    string // Applies to this path and everything below it
+	Principal string // User name, "role:<role>" or "*"
+	Perms     string // Combination of r and w
+}
+
+// Look up the caller for a token. With authentication disabled everyone is admin.
+func Authenticate(token string) (Principal, error) {
+	if !utils.AuthEnabled {
+		return Principal{Name: "anonymous", Role: RoleAdmin}, nil
+	}
+	if token == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(utils.ClusterToken)) == 1 {
+		return Principal{Name: "cluster", Role: RolePeer}, nil
+	}
+	for known, user := range utils.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return Principal{Name: user.Name, Role: user.Role}, nil
+		}
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// Authenticate and require one of the given roles. Admin satisfies every
+// role except peer, writer satisfies reader.
+func Require(token string, roles ...string) (Principal, error) {
+	principal, err := Authenticate(token)
+	if err != nil {
+		return principal, err
+	}
+	if !utils.AuthEnabled {
+		return principal, nil
+	}
+	for _, role := range roles {
+		if principal.HasRole(role) {
+			return principal, nil
+		}
+	}
+	return principal, fmt.Errorf("permission denied: %s (%s) requires role %s", principal.Name, principal.Role, strings.Join(roles, " or "))
+}
+
+func (p Principal) HasRole(role string) bool {
+	switch role {
+	case RolePeer:
+		return p.Role == RolePeer
+	case RoleAdmin:
+		return p.Role == RoleAdmin
+	case RoleWriter:
+		return p.Role == RoleAdmin || p.Role == RoleWriter
+	case RoleReader:
+		return p.Role == RoleAdmin || p.Role == RoleWriter || p.Role == RoleReader
+	}
+	return false
+}
+
+// Check access to a path. The caller's role must allow the permission, and
+// if any rules cover the path, a rule at the most specific covering prefix
+// must grant it. Admins bypass rules.
+func CheckPath(p Principal, perm string, filePath string, rules []Rule) error {
+	if p.Role == RoleAdmin {
+		return nil
+	}
+	roleFor := map[string]string{PermRead: RoleReader, PermWrite: RoleWriter}
+	if !p.HasRole(roleFor[perm]) {
+		return fmt.Errorf("permission denied: %s (%s) cannot %s %s", p.Name, p.Role, permName(perm), filePath)
+	}
+
+	longest := -1
+	for _, rule := range rules {
+		if Covers(rule.Prefix, filePath) && len(path.Clean(rule.Prefix)) > longest {
+			longest = len(path.Clean(rule.Prefix))
+		}
+	}
+	if longest == -1 {
+		return nil
+	}
+	for _, rule := range rules {
+		if len(path.Clean(rule.Prefix)) == longest && Covers(rule.Prefix, filePath) && rule.matches(p) && strings.Contains(rule.Perms, perm) {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied: ACL does not allow %s (%s) to %s %s", p.Name, p.Role, permName(perm), filePath)
+}
+
+func (r Rule) matches(p Principal) bool {
+	return r.Principal == "*" || r.Principal == p.Name || r.Principal == "role:"+p.Role
+}
+
+// Whether prefix is filePath or one of its parent directories, after
+// cleaning both
+func Covers(prefix string, filePath string) bool {
+	prefix, filePath = path.Clean(prefix), path.Clean(filePath)
+	if prefix == "/" || prefix == filePath {
+		return true
+	}
+	return strings.HasPrefix(filePath, prefix+"/")
+}
+
+func permName(perm string) string {
+	if perm == PermWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// Validate a rule before it's proposed
+func ValidateRule(rule Rule) error {
+	if !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("ACL prefix must be an absolute path")
+	}
+	if rule.Principal == "" {
+		return fmt.Errorf("ACL principal cannot be empty")
+	}
+	for _, c := range rule.Perms {
+		if c != 'r' && c != 'w' {
+			return fmt.Errorf("ACL permissions must be a combination of r and w")
+		}
+	}
+	return nil
+}
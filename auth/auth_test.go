@@ -0,0 +1,109 @@
+package auth
+
+import "testing"
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		prefix, path string
+		want         bool
+	}{
+		{"/", "/a", true},
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/a/b/c", true},
+		{"/a/b", "/a/b/c", true},
+		{"/a/b", "/a", false},
+		// A prefix is a directory, not a string prefix
+		{"/a", "/ab", false},
+		{"/a", "/ab/c", false},
+		{"/dir/", "/dir", true},
+		{"/dir/", "/dir/f", true},
+		{"/dir/", "/dirt", false},
+		// Both are cleaned first
+		{"/a/./b/", "/a/b/c", true},
+		{"/a", "/a/../ab", false},
+		{"/a", "//a//b", true},
+		{"/a/..", "/b", true},
+	}
+	for _, test := range tests {
+		if got := Covers(test.prefix, test.path); got != test.want {
+			t.Errorf("Covers(%q, %q) = %t, want %t", test.prefix, test.path, got, test.want)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	alice := Principal{Name: "alice", Role: RoleWriter}
+	bob := Principal{Name: "bob", Role: RoleReader}
+	rules := []Rule{
+		{Prefix: "/team", Principal: "role:writer", Perms: "rw"},
+		{Prefix: "/team/secret", Principal: "alice", Perms: "r"},
+		{Prefix: "/public/", Principal: "*", Perms: "r"},
+		{Prefix: "/public/drop", Principal: "*", Perms: "rw"},
+	}
+	tests := []struct {
+		name      string
+		principal Principal
+		perm      string
+		path      string
+		allowed   bool
+	}{
+		{"no rule covers the path, the role decides", alice, PermWrite, "/other", true},
+		{"no rule, role without the permission", bob, PermWrite, "/other", false},
+		{"rule for the role", alice, PermWrite, "/team/doc", true},
+		{"covered by a rule not naming the principal", bob, PermRead, "/team/doc", false},
+		{"the most specific prefix decides", alice, PermWrite, "/team/secret/plan", false},
+		{"nested rule grants read", alice, PermRead, "/team/secret/plan", true},
+		{"nested rule for someone else", Principal{Name: "carol", Role: RoleWriter}, PermRead, "/team/secret/plan", false},
+		{"sibling sharing a string prefix", bob, PermRead, "/teammate", true},
+		{"rule for everyone", bob, PermRead, "/public/readme", true},
+		{"rule for everyone without the permission", alice, PermWrite, "/public/readme", false},
+		{"more specific rule for everyone", alice, PermWrite, "/public/drop/file", true},
+		{"rule prefix with a trailing slash", alice, PermWrite, "/public", false},
+		{"role allows it but a rule still has to", bob, PermWrite, "/public/drop/file", false},
+		{"admins bypass rules", Principal{Name: "root", Role: RoleAdmin}, PermWrite, "/team/secret/plan", true},
+		{"peers can't read files", Principal{Name: "cluster", Role: RolePeer}, PermRead, "/other", false},
+		{"unknown role", Principal{Name: "eve", Role: "guest"}, PermRead, "/other", false},
+	}
+	for _, test := range tests {
+		err := CheckPath(test.principal, test.perm, test.path, rules)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: %s %s %s: got %v, want allowed %t", test.name, test.principal.Name, test.perm, test.path, err, test.allowed)
+		}
+	}
+}
+
+// Rules with the same prefix written differently are equally specific
+func TestCheckPathUncleanedPrefix(t *testing.T) {
+	rules := []Rule{
+		{Prefix: "/team/", Principal: "bob", Perms: "r"},
+		{Prefix: "/team", Principal: "alice", Perms: "r"},
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := CheckPath(Principal{Name: name, Role: RoleReader}, PermRead, "/team/doc", rules); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		rule  Rule
+		valid bool
+	}{
+		{Rule{Prefix: "/a", Principal: "alice", Perms: "rw"}, true},
+		{Rule{Prefix: "/", Principal: "*", Perms: "r"}, true},
+		{Rule{Prefix: "/a/", Principal: "role:reader", Perms: "w"}, true},
+		// A rule granting nothing denies everyone below it
+		{Rule{Prefix: "/a", Principal: "*", Perms: ""}, true},
+		{Rule{Prefix: "a", Principal: "alice", Perms: "r"}, false},
+		{Rule{Prefix: "", Principal: "alice", Perms: "r"}, false},
+		{Rule{Prefix: "/a", Principal: "", Perms: "r"}, false},
+		{Rule{Prefix: "/a", Principal: "alice", Perms: "rx"}, false},
+	}
+	for _, test := range tests {
+		if err := ValidateRule(test.rule); (err == nil) != test.valid {
+			t.Errorf("ValidateRule(%+v) = %v, want valid %t", test.rule, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+// bench.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/client"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/transport"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Bench operations
+const (
+	benchRead  = "read"
+	benchWrite = "write"
+	benchCAS   = "cas"
+)
+
+type benchConfig struct {
+	addrs      []string // Client addresses of the target cluster, empty to start one in-process
+	clients    int
+	ops        int           // Total operations, unless duration is set
+	duration   time.Duration // Run for this long instead of a fixed number of operations
+	mix        map[string]int
+	size       int
+	keys       int
+	retries    int
+	fault      string // "", stop or timeout
+	faultNode  int    // Index into addrs
+	faultAfter time.Duration
+	faultFor   time.Duration
+	token      string
+}
+
+// Results of one run, written as JSON with -json
+type benchRun struct {
+	Name      string
+	Clients   int
+	Mix       map[string]int
+	Size      int
+	Fault     string `json:",omitempty"`
+	Seconds   float64
+	Total     benchStats
+	ByOp      map[string]*benchStats
+	OpsPerSec float64
+}
+
+// Outcome counts and latencies of successful operations in milliseconds
+type benchStats struct {
+	Ops          int
+	Errors       int // Failed after every retry
+	Conflicts    int // CAS whose version was outdated
+	Retries      int
+	ConflictRate float64
+	RetryRate    float64
+	MeanMs       float64
+	P50Ms        float64
+	P99Ms        float64
+	P999Ms       float64
+	latencies    []time.Duration
+}
+
+// Throughput and latency of a read/write/CAS mix from concurrent clients,
+// against a running cluster or one started in-process
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	addrs := flags.String("addrs", "", "comma separated client addresses of a running cluster, empty starts one in-process")
+	clients := flags.Int("clients", 8, "concurrent clients, spread over the nodes")
+	ops := flags.Int("ops", 1000, "operations per run")
+	duration := flags.Duration("duration", 0, "run for this long instead of -ops")
+	mix := flags.String("mix", "read=50,write=40,cas=10", "percentage of each operation")
+	size := flags.Int("size", 64, "bytes per written value")
+	keys := flags.Int("keys", 100, "distinct files the operations spread over")
+	retries := flags.Int("retries", 5, "retries of a failed operation before it counts as an error")
+	fault := flags.String("fault", "", "inject a fault into one node during the run: stop or timeout")
+	faultNode := flags.Int("fault-node", 0, "index of the node to inject the fault into")
+	faultAfter := flags.Duration("fault-after", time.Second, "when to inject the fault")
+	faultFor := flags.Duration("fault-for", 2*time.Second, "how long the fault lasts")
+	compare := flags.Bool("compare", false, "in-process only: run once with one Paxos round per write and once batched")
+	jsonOut := flags.Bool("json", false, "print results as JSON")
+	flags.Parse(args)
+
+	config := benchConfig{
+		clients:    *clients,
+		ops:        *ops,
+		duration:   *duration,
+		size:       *size,
+		keys:       *keys,
+		retries:    *retries,
+		fault:      *fault,
+		faultNode:  *faultNode,
+		faultAfter: *faultAfter,
+		faultFor:   *faultFor,
+		token:      os.Getenv("MINI_CLOUD_TOKEN"),
+	}
+	if *addrs != "" {
+		config.addrs = strings.Split(*addrs, ",")
+	}
+	var err error
+	if config.mix, err = parseMix(*mix); err != nil {
+		fmt.Printf("Invalid -mix: %v\n", err)
+		os.Exit(1)
+	}
+	if config.clients < 1 || config.keys < 1 || config.ops < 1 && config.duration <= 0 {
+		fmt.Println("Usage: go run main.go bench [-addrs a,b,c] [-clients N] [-ops N | -duration D] [-mix read=50,write=40,cas=10] [-size N] [-keys N] [-fault stop|timeout] [-compare] [-json]")
+		os.Exit(1)
+	}
+	if config.fault != "" && config.fault != "stop" && config.fault != "timeout" {
+		fmt.Printf("Invalid -fault %q, use stop or timeout\n", config.fault)
+		os.Exit(1)
+	}
+	if *compare && config.addrs != nil {
+		fmt.Println("-compare needs an in-process cluster, drop -addrs")
+		os.Exit(1)
+	}
+
+	inProcess := config.addrs == nil
+	if inProcess {
+		// Node logs and traces would dominate the run
+		utils.LogToStdout = false
+		utils.LogDir = ""
+		utils.TraceExporter = ""
+		utils.MessageTraceDir = ""
+		utils.MinimalStartUpLogging = true
+	}
+
+	type run struct {
+		name      string
+		batchSize int
+	}
+	runs := []run{{"cluster", utils.BatchSize}}
+	if inProcess {
+		runs[0].name = fmt.Sprintf("in-process, batch size %d", utils.BatchSize)
+		if utils.ConsensusEngine == "epaxos" {
+			runs[0].name = "in-process, epaxos"
+		}
+	}
+	if *compare {
+		runs = []run{
+			{"one round per write", 1},
+			{fmt.Sprintf("batched (size %d, linger %v, pipeline %d)", utils.BatchSize, utils.BatchLinger, utils.PipelineDepth), utils.BatchSize},
+		}
+	}
+
+	var results []benchRun
+	for _, r := range runs {
+		config := config
+		if inProcess {
+			// Each run gets a fresh cluster
+			utils.BatchSize = r.batchSize
+			cluster, err := startCluster()
+			if err != nil {
+				fmt.Printf("Error starting cluster: %v\n", err)
+				os.Exit(1)
+			}
+			for i, addrs := range cluster {
+				// Witnesses serve no clients
+				if utils.NodeRoles[i+1] != consensus.RoleWitness {
+					config.addrs = append(config.addrs, addrs.Client)
+				}
+			}
+			// Let heartbeats settle who the leader is
+			time.Sleep(2 * utils.HeartbeatInterval)
+		}
+		result, err := benchCluster(r.name, config)
+		if err != nil {
+			fmt.Printf("%s: %v\n", r.name, err)
+			os.Exit(1)
+		}
+		results = append(results, result)
+		if !*jsonOut {
+			printBenchRun(result)
+		}
+	}
+
+	if *jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(results)
+		return
+	}
+	if len(results) == 2 && results[0].OpsPerSec > 0 {
+		fmt.Printf("speedup: %.1fx\n", results[1].OpsPerSec/results[0].OpsPerSec)
+	}
+}
+
+// Parse "read=50,write=40,cas=10" into weights
+func parseMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		op, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not op=weight", part)
+		}
+		if op != benchRead && op != benchWrite && op != benchCAS {
+			return nil, fmt.Errorf("unknown operation %q, use read, write or cas", op)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("weight of %s must be a non-negative number", op)
+		}
+		mix[op] += w
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weights add up to 0")
+	}
+	return mix, nil
+}
+
+// Pick an operation according to the mix weights
+func pickOp(mix map[string]int, r *rand.Rand) string {
+	total := 0
+	for _, w := range mix {
+		total += w
+	}
+	n := r.Intn(total)
+	for _, op := range []string{benchRead, benchWrite, benchCAS} {
+		if n < mix[op] {
+			return op
+		}
+		n -= mix[op]
+	}
+	return benchRead
+}
+
+// Run the workload against a cluster and collect the results
+func benchCluster(name string, config benchConfig) (benchRun, error) {
+	conns := make([]benchClient, config.clients)
+	for i := range conns {
+		c, err := dialBench(config, i)
+		if err != nil {
+			return benchRun{}, err
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+
+	// Every file exists before the run so reads and CAS find it
+	data := strings.Repeat("x", config.size)
+	for key := 0; key < config.keys; key++ {
+		if _, err := conns[0].Write(benchPath(key), data); err != nil {
+			return benchRun{}, fmt.Errorf("preparing files: %v", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var faultErr error
+	var faultDone sync.WaitGroup
+	if config.fault != "" {
+		faultDone.Add(1)
+		go func() {
+			defer faultDone.Done()
+			faultErr = injectFault(config, stop)
+		}()
+	}
+
+	var wg sync.WaitGroup
+	perClient := make([]map[string]*benchStats, len(conns))
+	start := time.Now()
+	for i, c := range conns {
+		count := config.ops / config.clients
+		if i < config.ops%config.clients {
+			count++
+		}
+		perClient[i] = make(map[string]*benchStats)
+		wg.Add(1)
+		go func(i int, c benchClient, count int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+			for j := 0; config.duration > 0 || j < count; j++ {
+				if config.duration > 0 && time.Since(start) >= config.duration {
+					return
+				}
+				op := pickOp(config.mix, r)
+				stats, ok := perClient[i][op]
+				if !ok {
+					stats = &benchStats{}
+					perClient[i][op] = stats
+				}
+				benchOp(c, op, benchPath(r.Intn(config.keys)), data, config.retries, stats)
+			}
+		}(i, c, count)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+	faultDone.Wait()
+	if faultErr != nil {
+		return benchRun{}, fmt.Errorf("injecting fault: %v", faultErr)
+	}
+
+	result := benchRun{Name: name, Clients: config.clients, Mix: config.mix, Size: config.size, Fault: config.fault, Seconds: elapsed.Seconds(), ByOp: make(map[string]*benchStats)}
+	for _, ops := range perClient {
+		for op, stats := range ops {
+			if _, ok := result.ByOp[op]; !ok {
+				result.ByOp[op] = &benchStats{}
+			}
+			result.ByOp[op].merge(stats)
+			result.Total.merge(stats)
+		}
+	}
+	for _, stats := range result.ByOp {
+		stats.summarize()
+	}
+	result.Total.summarize()
+	result.OpsPerSec = float64(result.Total.Ops-result.Total.Errors) / elapsed.Seconds()
+	return result, nil
+}
+
+// Operations the workload runs, on a node or through a shard router
+type benchClient interface {
+	Read(path string) (string, int, error)
+	Write(path string, data string) (int, error)
+	CompareAndSwap(path string, version int, data string) (int, error)
+	Close() error
+}
+
+// Connection of the i-th client, spread over the nodes. With sharding each
+// client routes by the shard map, starting from a different node.
+func dialBench(config benchConfig, i int) (benchClient, error) {
+	first := i % len(config.addrs)
+	if len(utils.ShardGroups) == 0 {
+		return client.Dial(config.addrs[first], config.token)
+	}
+	addrs := append(slices.Clone(config.addrs[first:]), config.addrs[:first]...)
+	return client.DialRouter(addrs, config.token)
+}
+
+func benchPath(key int) string {
+	return fmt.Sprintf("/bench/%d", key)
+}
+
+// Run one operation, retrying failures, and record its outcome
+func benchOp(c benchClient, op string, path string, data string, retries int, stats *benchStats) {
+	stats.Ops++
+	start := time.Now()
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			stats.Retries++
+		}
+		switch op {
+		case benchRead:
+			_, _, err = c.Read(path)
+		case benchWrite:
+			_, err = c.Write(path, data)
+		case benchCAS:
+			var version int
+			if _, version, err = c.Read(path); err == nil {
+				_, err = c.CompareAndSwap(path, version, data)
+			}
+		}
+		var conflict *client.ConflictError
+		if errors.As(err, &conflict) {
+			stats.Conflicts++
+			err = nil
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		stats.Errors++
+		return
+	}
+	stats.latencies = append(stats.latencies, time.Since(start))
+}
+
+// Toggle stop or timeout on one node for faultFor, faultAfter into the run
+func injectFault(config benchConfig, done chan struct{}) error {
+	if config.faultNode < 0 || config.faultNode >= len(config.addrs) {
+		return fmt.Errorf("no node at index %d", config.faultNode)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(config.faultAfter):
+	}
+
+	admin, err := dialAdmin(config.addrs[config.faultNode], config.token)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+	toggle := func() error {
+		if config.fault == "stop" {
+			req := node.StopRequest{Token: config.token}
+			var res node.StopResponse
+			return admin.Call("Admin.ToggleStop", &req, &res)
+		}
+		req := node.TimeoutRequest{Token: config.token}
+		var res node.TimeoutResponse
+		return admin.Call("Admin.ToggleTimeout", &req, &res)
+	}
+	if err := toggle(); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+	case <-time.After(config.faultFor):
+	}
+	return toggle()
+}
+
+// Connection to a node's Admin service, found through ping
+func dialAdmin(addr string, token string) (*rpc.Client, error) {
+	conn, err := transport.DialClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	req := node.PingRequest{Token: token}
+	var res node.PingResponse
+	if err := conn.Call("Client.Ping", &req, &res); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.AdminAddr == "" || res.AdminAddr == addr {
+		return conn, nil
+	}
+	conn.Close()
+	return transport.DialClient(res.AdminAddr)
+}
+
+func (s *benchStats) merge(other *benchStats) {
+	s.Ops += other.Ops
+	s.Errors += other.Errors
+	s.Conflicts += other.Conflicts
+	s.Retries += other.Retries
+	s.latencies = append(s.latencies, other.latencies...)
+}
+
+// Compute rates and latency percentiles
+func (s *benchStats) summarize() {
+	if s.Ops > 0 {
+		s.ConflictRate = float64(s.Conflicts) / float64(s.Ops)
+		s.RetryRate = float64(s.Retries) / float64(s.Ops)
+	}
+	if len(s.latencies) == 0 {
+		return
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	var sum time.Duration
+	for _, l := range s.latencies {
+		sum += l
+	}
+	s.MeanMs = milliseconds(sum / time.Duration(len(s.latencies)))
+	s.P50Ms = milliseconds(percentile(s.latencies, 0.5))
+	s.P99Ms = milliseconds(percentile(s.latencies, 0.99))
+	s.P999Ms = milliseconds(percentile(s.latencies, 0.999))
+}
+
+// Nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func printBenchRun(r benchRun) {
+	fmt.Printf("%s: %d clients, %d ops in %.2fs, %.0f ops/s", r.Name, r.Clients, r.Total.Ops, r.Seconds, r.OpsPerSec)
+	if r.Fault != "" {
+		fmt.Printf(", fault %s", r.Fault)
+	}
+	fmt.Println()
+	fmt.Printf("  %-6s %7s %7s %9s %8s %8s %8s %8s %8s\n", "op", "ops", "errors", "conflicts", "retries", "mean", "p50", "p99", "p999")
+	row := func(name string, s *benchStats) {
+		fmt.Printf("  %-6s %7d %7d %8.1f%% %7.1f%% %6.1fms %6.1fms %6.1fms %6.1fms\n", name, s.Ops, s.Errors, 100*s.ConflictRate, 100*s.RetryRate, s.MeanMs, s.P50Ms, s.P99Ms, s.P999Ms)
+	}
+	for _, op := range []string{benchRead, benchWrite, benchCAS} {
+		if s, ok := r.ByOp[op]; ok {
+			row(op, s)
+		}
+	}
+	row("total", &r.Total)
+}
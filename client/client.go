@@ -0,0 +1,176 @@
+// client/client.go
+
+package client
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/transport"
+)
+
+// Go SDK for the Client service of a mini-cloud node
+type Client struct {
+	rpc   *rpc.Client
+	token string
+}
+
+// A precondition didn't hold, nothing was changed
+type ConflictError struct {
+	Path    string
+	Version int // Current version of Path, 0 if it doesn't exist
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict: %s is at version %d", e.Path, e.Version)
+}
+
+// Connect to a node's client address, over TLS when enabled
+func Dial(addr string, token string) (*Client, error) {
+	conn, err := transport.DialClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rpc: conn, token: token}, nil
+}
+
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// Read the current contents and version of a file
+func (c *Client) Read(path string) (string, int, error) {
+	return c.ReadVersion(path, 0)
+}
+
+// Read a retained version of a file, 0 for the current one
+func (c *Client) ReadVersion(path string, version int) (string, int, error) {
+	req := node.ReadFileRequest{Path: path, Version: version, Token: c.token}
+	var res node.ReadFileResponse
+	if err := c.rpc.Call("Client.ReadFile", &req, &res); err != nil {
+		return "", 0, err
+	}
+	return res.Data, res.Version, nil
+}
+
+// Write a file and return its new version
+func (c *Client) Write(path string, data string) (int, error) {
+	return c.write("Client.WriteFile", node.WriteFileRequest{Path: path, Body: data})
+}
+
+// Write a file that the cluster deletes once ttl has passed
+func (c *Client) WriteTTL(path string, data string, ttl time.Duration) (int, error) {
+	return c.write("Client.WriteFile", node.WriteFileRequest{Path: path, Body: data, TTL: ttl})
+}
+
+// Write a file only if it is at version
+func (c *Client) CompareAndSwap(path string, version int, data string) (int, error) {
+	return c.write("Client.WriteFile", node.WriteFileRequest{Path: path, Body: data, IfVersion: version})
+}
+
+// Write a file only if it doesn't exist
+func (c *Client) Create(path string, data string) (int, error) {
+	return c.write("Client.WriteFile", node.WriteFileRequest{Path: path, Body: data, IfAbsent: true})
+}
+
+// Append to a file, creating it if needed
+func (c *Client) Append(path string, data string) (int, error) {
+	return c.write("Client.Append", node.WriteFileRequest{Path: path, Body: data})
+}
+
+func (c *Client) write(method string, req node.WriteFileRequest) (int, error) {
+	req.Token, req.TraceID = c.token, telemetry.NewTraceID()
+	var res node.WriteFileResponse
+	if err := c.rpc.Call(method, &req, &res); err != nil {
+		return 0, fmt.Errorf("%v (trace ID %s)", err, req.TraceID)
+	}
+	if res.Conflict {
+		return 0, &ConflictError{Path: req.Path, Version: res.Version}
+	}
+	return res.Version, nil
+}
+
+// Delete a file, only if it is at version when version isn't 0
+func (c *Client) Delete(path string, version int) error {
+	req := node.DeleteFileRequest{Path: path, IfVersion: version, Token: c.token, TraceID: telemetry.NewTraceID()}
+	var res node.DeleteFileResponse
+	if err := c.rpc.Call("Client.DeleteFile", &req, &res); err != nil {
+		return fmt.Errorf("%v (trace ID %s)", err, req.TraceID)
+	}
+	if res.Conflict {
+		return &ConflictError{Path: req.Path, Version: res.Version}
+	}
+	return nil
+}
+
+// Retained revisions of a file, oldest first
+func (c *Client) History(path string) ([]store.Revision, error) {
+	req := node.HistoryRequest{Path: path, Token: c.token}
+	var res node.HistoryResponse
+	if err := c.rpc.Call("Client.History", &req, &res); err != nil {
+		return nil, err
+	}
+	return res.Revisions, nil
+}
+
+// Start a transaction, nothing is sent until Commit
+func (c *Client) Txn() *Txn {
+	return &Txn{client: c}
+}
+
+// Operations applied atomically on every node, or not at all if any
+// precondition fails
+type Txn struct {
+	client *Client
+	ops    []store.TxnOp
+}
+
+func (t *Txn) Write(path string, data string) *Txn {
+	return t.add(store.TxnOp{Op: store.OpWrite, Path: path, Data: data})
+}
+
+// Write only if the file is at version
+func (t *Txn) CompareAndSwap(path string, version int, data string) *Txn {
+	return t.add(store.TxnOp{Op: store.OpWrite, Path: path, Data: data, IfVersion: version})
+}
+
+// Write only if the file doesn't exist
+func (t *Txn) Create(path string, data string) *Txn {
+	return t.add(store.TxnOp{Op: store.OpWrite, Path: path, Data: data, IfAbsent: true})
+}
+
+func (t *Txn) Append(path string, data string) *Txn {
+	return t.add(store.TxnOp{Op: store.OpAppend, Path: path, Data: data})
+}
+
+// Delete, only if the file is at version when version isn't 0
+func (t *Txn) Delete(path string, version int) *Txn {
+	return t.add(store.TxnOp{Op: store.OpDelete, Path: path, IfVersion: version})
+}
+
+// Require the file to be at version, 0 for absent, without changing it
+func (t *Txn) Check(path string, version int) *Txn {
+	return t.add(store.TxnOp{Op: store.OpCheck, Path: path, IfVersion: version, IfAbsent: version == 0})
+}
+
+func (t *Txn) add(op store.TxnOp) *Txn {
+	t.ops = append(t.ops, op)
+	return t
+}
+
+// Propose the transaction and return the version of the files it wrote
+func (t *Txn) Commit() (int, error) {
+	req := node.TxnRequest{Ops: t.ops, Token: t.client.token, TraceID: telemetry.NewTraceID()}
+	var res node.TxnResponse
+	if err := t.client.rpc.Call("Client.Txn", &req, &res); err != nil {
+		return 0, fmt.Errorf("%v (trace ID %s)", err, req.TraceID)
+	}
+	if res.Conflict {
+		return 0, &ConflictError{Path: res.ConflictPath, Version: res.Version}
+	}
+	return res.Version, nil
+}
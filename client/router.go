@@ -0,0 +1,187 @@
+// client/router.go
+
+package client
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/shard"
+	"github.com/derekjtong/mini-cloud/store"
+)
+
+// How often a request is retried while its shard moves, and how long it
+// waits in between
+const (
+	routeAttempts = 50
+	routeBackoff  = 100 * time.Millisecond
+)
+
+// Client for a sharded cluster: sends each request to a node of the group
+// serving its path, refreshing the shard map when a group turns it away.
+// Works on unsharded clusters too, sending everything to the first node.
+type Router struct {
+	token   string
+	ids     []int           // Node IDs in the order given
+	clients map[int]*Client // By node ID
+
+	mu     sync.Mutex
+	shards shard.Map // Version 0 without sharding, guarded by mu
+}
+
+// Connect to the client addresses of the nodes and fetch the shard map
+func DialRouter(addrs []string, token string) (*Router, error) {
+	r := &Router{token: token, clients: make(map[int]*Client, len(addrs))}
+	for _, addr := range addrs {
+		c, err := Dial(addr, token)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("dialing %s: %v", addr, err)
+		}
+		req := node.PingRequest{Token: token}
+		var res node.PingResponse
+		if err := c.rpc.Call("Client.Ping", &req, &res); err != nil {
+			c.Close()
+			r.Close()
+			return nil, fmt.Errorf("pinging %s: %v", addr, err)
+		}
+		r.ids = append(r.ids, res.NodeID)
+		r.clients[res.NodeID] = c
+	}
+	if err := r.Refresh(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Router) Close() error {
+	for _, c := range r.clients {
+		c.Close()
+	}
+	return nil
+}
+
+// Fetch the shard map from the first node that answers
+func (r *Router) Refresh() error {
+	var err error
+	for _, id := range r.ids {
+		req := node.ShardMapRequest{Token: r.token}
+		var res node.ShardMapResponse
+		if err = r.clients[id].rpc.Call("Client.ShardMap", &req, &res); err == nil {
+			r.mu.Lock()
+			if res.Shards.Version >= r.shards.Version {
+				r.shards = res.Shards
+			}
+			r.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("fetching shard map: %v", err)
+}
+
+// Shard map last fetched
+func (r *Router) Shards() shard.Map {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.shards.Clone()
+}
+
+// Client of a node serving path as far as the shard map knows
+func (r *Router) Client(path string) (*Client, error) {
+	m := r.Shards()
+	if m.Version == 0 {
+		return r.clients[r.ids[0]], nil
+	}
+	path, err := store.CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	s := m.Lookup(path)
+	for _, id := range r.ids {
+		if slices.Contains(m.Groups[s.Group], id) {
+			return r.clients[id], nil
+		}
+	}
+	return nil, fmt.Errorf("no connection to a node of group %d serving %s", s.Group, path)
+}
+
+// Run op on a node serving path, retrying on a fresh shard map while the
+// path's shard moves. Transactions go through here, all their paths must
+// be in one shard group.
+func (r *Router) Do(path string, op func(c *Client) error) error {
+	var err error
+	for attempt := 0; attempt < routeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(routeBackoff)
+			if err := r.Refresh(); err != nil {
+				return err
+			}
+		}
+		c, cerr := r.Client(path)
+		if cerr != nil {
+			return cerr
+		}
+		if err = op(c); !shard.IsWrongShard(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *Router) Read(path string) (data string, version int, err error) {
+	err = r.Do(path, func(c *Client) error {
+		data, version, err = c.Read(path)
+		return err
+	})
+	return data, version, err
+}
+
+func (r *Router) Write(path string, data string) (version int, err error) {
+	err = r.Do(path, func(c *Client) error {
+		version, err = c.Write(path, data)
+		return err
+	})
+	return version, err
+}
+
+func (r *Router) CompareAndSwap(path string, version int, data string) (newVersion int, err error) {
+	err = r.Do(path, func(c *Client) error {
+		newVersion, err = c.CompareAndSwap(path, version, data)
+		return err
+	})
+	return newVersion, err
+}
+
+func (r *Router) Create(path string, data string) (version int, err error) {
+	err = r.Do(path, func(c *Client) error {
+		version, err = c.Create(path, data)
+		return err
+	})
+	return version, err
+}
+
+func (r *Router) Append(path string, data string) (version int, err error) {
+	err = r.Do(path, func(c *Client) error {
+		version, err = c.Append(path, data)
+		return err
+	})
+	return version, err
+}
+
+func (r *Router) Delete(path string, version int) error {
+	return r.Do(path, func(c *Client) error {
+		return c.Delete(path, version)
+	})
+}
+
+func (r *Router) History(path string) (revisions []store.Revision, err error) {
+	err = r.Do(path, func(c *Client) error {
+		revisions, err = c.History(path)
+		return err
+	})
+	return revisions, err
+}
@@ -0,0 +1,144 @@
+// client/session.go
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/store"
+)
+
+// Lease on the cluster that locks are tied to, renewed in the background
+// until closed. If renewal fails the session may have expired and its locks
+// been released, Done is closed.
+type Session struct {
+	client *Client
+	ID     string
+	TTL    time.Duration
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+// Another session holds the lock
+type LockHeldError struct {
+	Name   string
+	Holder string
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("lock %s is held by %s", e.Name, e.Holder)
+}
+
+// Open a session, 0 uses the cluster's default TTL
+func (c *Client) OpenSession(ttl time.Duration) (*Session, error) {
+	req := node.OpenSessionRequest{TTL: ttl, Token: c.token}
+	var res node.OpenSessionResponse
+	if err := c.rpc.Call("Client.OpenSession", &req, &res); err != nil {
+		return nil, err
+	}
+	s := &Session{client: c, ID: res.SessionID, TTL: res.TTL, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.keepAlive()
+	return s, nil
+}
+
+// Renew the lease three times per TTL
+func (s *Session) keepAlive() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			req := node.SessionRequest{SessionID: s.ID, Token: s.client.token}
+			var res node.KeepAliveResponse
+			if err := s.client.rpc.Call("Client.KeepAlive", &req, &res); err != nil {
+				s.err = err
+				return
+			}
+		}
+	}
+}
+
+// Closed when the session is closed or can no longer be renewed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Why renewal stopped, nil if the session was closed
+func (s *Session) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Take a lock without waiting and return its fencing token
+func (s *Session) Acquire(name string) (int, error) {
+	req := node.LockRequest{SessionID: s.ID, Name: name, Token: s.client.token}
+	var res node.AcquireResponse
+	if err := s.client.rpc.Call("Client.Acquire", &req, &res); err != nil {
+		return 0, err
+	}
+	if !res.Acquired {
+		return 0, &LockHeldError{Name: name, Holder: res.Holder}
+	}
+	return res.FencingToken, nil
+}
+
+// Take a lock, retrying until it's free or the session ends
+func (s *Session) AcquireWait(name string, retry time.Duration) (int, error) {
+	for {
+		token, err := s.Acquire(name)
+		if _, held := err.(*LockHeldError); !held {
+			return token, err
+		}
+		select {
+		case <-s.done:
+			return 0, fmt.Errorf("session ended: %v", s.err)
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (s *Session) Release(name string) error {
+	req := node.LockRequest{SessionID: s.ID, Name: name, Token: s.client.token}
+	var res node.ReleaseResponse
+	return s.client.rpc.Call("Client.Release", &req, &res)
+}
+
+// Stop renewing and end the session, releasing its locks
+func (s *Session) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	req := node.SessionRequest{SessionID: s.ID, Token: s.client.token}
+	var res node.CloseSessionResponse
+	return s.client.rpc.Call("Client.CloseSession", &req, &res)
+}
+
+// Write a file that is deleted when the session ends. An existing file
+// keeps its current owner, so overwriting a persistent file leaves it
+// persistent; use Create to be sure the file is the session's.
+func (s *Session) Write(path string, data string) (int, error) {
+	return s.client.write("Client.WriteFile", node.WriteFileRequest{Path: path, Body: data, SessionID: s.ID})
+}
+
+// Create an ephemeral file only if it doesn't exist
+func (s *Session) Create(path string, data string) (int, error) {
+	return s.client.write("Client.WriteFile", node.WriteFileRequest{Path: path, Body: data, IfAbsent: true, SessionID: s.ID})
+}
+
+// Held locks with their fencing tokens
+func (c *Client) Locks() ([]store.Lock, error) {
+	req := node.LocksRequest{Token: c.token}
+	var res node.LocksResponse
+	if err := c.rpc.Call("Client.Locks", &req, &res); err != nil {
+		return nil, err
+	}
+	return res.Locks, nil
+}
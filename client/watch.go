@@ -0,0 +1,52 @@
+// client/watch.go
+
+package client
+
+import (
+	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/store"
+)
+
+// Ordered stream of changes to a file or directory. One command can change
+// several files at once, so the stream is up to Version plus Offset changes
+// of the next command; a new Watcher from both resumes without gaps or
+// repeats. Version is an event's Seq, the same as its version unless the
+// cluster runs epaxos; then it only means something to the node watched, see
+// node.WatchRequest.
+type Watcher struct {
+	client  *Client
+	path    string
+	Version int // Every change up to this Seq was delivered
+	Offset  int // Changes of the next Seq already delivered
+	pending []store.Event
+}
+
+// Watch changes after Seq fromVersion, 0 for all retained changes
+func (c *Client) Watch(path string, fromVersion int) *Watcher {
+	return &Watcher{client: c, path: path, Version: fromVersion}
+}
+
+// Wait for the next change. Returns store.ErrCompacted's message if the
+// changes after Version are no longer retained.
+func (w *Watcher) Next() (store.Event, error) {
+	for len(w.pending) == 0 {
+		req := node.WatchRequest{Path: w.path, FromVersion: w.Version, Token: w.client.token}
+		var res node.WatchResponse
+		if err := w.client.rpc.Call("Client.Watch", &req, &res); err != nil {
+			return store.Event{}, err
+		}
+		// A response holds every change of each Seq in it
+		w.pending = res.Events[min(w.Offset, len(res.Events)):]
+		if len(w.pending) == 0 {
+			w.Version, w.Offset = res.Version, 0
+		}
+	}
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+	if len(w.pending) > 0 && w.pending[0].Seq == event.Seq {
+		w.Offset++
+	} else {
+		w.Version, w.Offset = event.Seq, 0
+	}
+	return event, nil
+}
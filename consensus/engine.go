@@ -0,0 +1,98 @@
+package consensus
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/derekjtong/mini-cloud/telemetry"
+)
+
+// Engines selectable with utils.ConsensusEngine
+const (
+	EnginePaxos  = "paxos"
+	EngineEPaxos = "epaxos"
+	EngineRaft   = "raft"
+)
+
+// Node roles, see utils.NodeRoles
+const (
+	RoleVoter   = "voter"
+	RoleWitness = "witness"
+	RoleLearner = "learner"
+)
+
+// Returned to requests a stopped node refuses outright
+var ErrStopped = errors.New("node is stopped")
+
+// Orders the commands of a node's file system layer. Every node applies the
+// commands an engine commits in the order it delivers them, so commands
+// that could observe each other must come out in the same order everywhere.
+type Engine interface {
+	// Get a command committed and return once it is. It's delivered on
+	// Committed like every other command, possibly later.
+	Propose(p Proposal) error
+	// Committed commands in the order this node applies them
+	Committed() <-chan Entry
+	// The cluster's nodes by peer address, this node included
+	SetMembers(members map[string]Member)
+	Status() Status
+	// RPC service other nodes' engines call, and the name to register it as
+	Service() (string, any)
+}
+
+// Command to commit
+type Proposal struct {
+	Command string   // Encoded store.Command
+	Keys    []string // What the command touches, engines may order commands without a key in common freely
+	Parent  telemetry.SpanContext
+}
+
+// Committed command
+type Entry struct {
+	Index   int // Position in this node's apply order, from 0
+	Command string
+}
+
+// What Node.Info shows about an engine
+type Status struct {
+	Engine string
+	State  []string // One line per part, e.g. Acceptor={...}
+}
+
+type Connection interface {
+	Call(serviceMethod string, args any, reply any) error
+}
+
+// Node of the cluster as an engine sees it
+type Member struct {
+	Connection
+	Role string
+}
+
+// Fault injection, toggled on the node and honored by its engine
+type Faults struct {
+	Stop    atomic.Bool // Neither answer nor send consensus traffic
+	Timeout atomic.Bool // Stall proposals between phases
+}
+
+// What a node gives its engine
+type Config struct {
+	ID        int
+	NodeCount int
+	Group     int    // Consensus group, 0 for the one every node is in, see utils.ShardGroups
+	Role      string // This node's role
+	Voters    []int  // IDs of the nodes that vote, witnesses included
+	Addr      string // This node's peer address
+	Token     string // Cluster credentials, required on every RPC
+	Faults    *Faults
+	// Peer address of the node chosen by heartbeats to lead, empty if it's
+	// this one. Engines electing their own leader ignore it.
+	Leader func() string
+	// Combine several commands into one that applies them in order, for
+	// engines that batch. Combining none gives a command that changes
+	// nothing, to fill a slot with.
+	Batch  func(commands []string) (string, error)
+	Logger *slog.Logger
+	Tracer *telemetry.Tracer
+}
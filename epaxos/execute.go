@@ -0,0 +1,229 @@
+package epaxos
+
+import (
+	"slices"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+)
+
+// Execute committed instances as their dependencies allow, whenever something
+// commits and periodically to recover instances holding execution up
+func (r *Replica) executor() {
+	ticker := time.NewTicker(recoveryTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.kick:
+		case <-ticker.C:
+		}
+		r.executeCommitted()
+	}
+}
+
+// Execute every committed instance whose dependencies are all committed.
+// Dependencies form a graph that may have cycles, so its strongly connected
+// components are executed in dependency order and the instances within one by
+// Seq, which gives every replica the same order for interfering commands.
+func (r *Replica) executeCommitted() {
+	r.mu.Lock()
+	var ids []InstanceID
+	for id, inst := range r.instances {
+		if inst.status == StatusCommitted {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, compareIDs)
+
+	g := &graph{replica: r, index: make(map[InstanceID]int), low: make(map[InstanceID]int), onStack: make(map[InstanceID]bool), blocked: make(map[InstanceID]bool)}
+	for _, id := range ids {
+		if _, visited := g.index[id]; !visited {
+			g.visit(id)
+		}
+	}
+
+	r.compact()
+
+	var stuck []InstanceID
+	now := time.Now()
+	for _, id := range g.waiting {
+		inst := r.instance(id)
+		if inst.blocked.IsZero() {
+			inst.blocked = now
+		} else if now.Sub(inst.blocked) > recoveryTimeout && !r.recovering[id] {
+			stuck = append(stuck, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, command := range g.commands {
+		r.committed <- consensus.Entry{Index: r.executed, Command: command}
+		r.executed++
+	}
+	for _, id := range stuck {
+		go r.recover(id)
+	}
+}
+
+// Tarjan's strongly connected components over committed instances
+type graph struct {
+	replica  *Replica
+	counter  int
+	index    map[InstanceID]int
+	low      map[InstanceID]int
+	stack    []InstanceID
+	onStack  map[InstanceID]bool
+	blocked  map[InstanceID]bool // Reaches an uncommitted instance
+	waiting  []InstanceID        // Uncommitted instances reached
+	commands []string            // Executed in this order
+}
+
+// Returns whether id or anything it depends on isn't committed yet
+func (g *graph) visit(id InstanceID) bool {
+	g.index[id], g.low[id] = g.counter, g.counter
+	g.counter++
+	g.stack = append(g.stack, id)
+	g.onStack[id] = true
+
+	blocked := false
+	for _, dep := range g.replica.instances[id].entry.Deps {
+		inst, ok := g.replica.instances[dep]
+		switch {
+		case ok && inst.status == StatusExecuted || g.replica.dropped(dep):
+			continue
+		case !ok || inst.status < StatusCommitted:
+			if !slices.Contains(g.waiting, dep) {
+				g.waiting = append(g.waiting, dep)
+			}
+			blocked = true
+		default:
+			if _, visited := g.index[dep]; !visited {
+				blocked = g.visit(dep) || blocked
+				g.low[id] = min(g.low[id], g.low[dep])
+			} else if g.onStack[dep] {
+				g.low[id] = min(g.low[id], g.index[dep])
+			} else {
+				blocked = blocked || g.blocked[dep]
+			}
+		}
+	}
+	g.blocked[id] = blocked
+
+	if g.low[id] != g.index[id] {
+		return blocked
+	}
+	// Root of a component, pop it
+	i := slices.Index(g.stack, id)
+	component := slices.Clone(g.stack[i:])
+	g.stack = g.stack[:i]
+	for _, member := range component {
+		g.onStack[member] = false
+		g.blocked[member] = blocked
+	}
+	if blocked {
+		return true
+	}
+	slices.SortFunc(component, func(a, b InstanceID) int {
+		if seqA, seqB := g.replica.instances[a].entry.Seq, g.replica.instances[b].entry.Seq; seqA != seqB {
+			return seqA - seqB
+		}
+		return compareIDs(a, b)
+	})
+	for _, member := range component {
+		inst := g.replica.instances[member]
+		inst.status = StatusExecuted
+		if inst.entry.Command != "" {
+			g.commands = append(g.commands, inst.entry.Command)
+		}
+	}
+	return false
+}
+
+// Explicit prepare: take over an instance whose leader may have failed and
+// finish it with what may already have been chosen, or a no-op if no
+// replica of a majority has heard of it
+func (r *Replica) recover(id InstanceID) {
+	r.mu.Lock()
+	if r.dropped(id) {
+		r.mu.Unlock()
+		return
+	}
+	inst := r.instance(id)
+	if r.recovering[id] || inst.status >= StatusCommitted {
+		r.mu.Unlock()
+		return
+	}
+	r.recovering[id] = true
+	ballot := (inst.ballot/r.N+1)*r.N + r.Id
+	inst.ballot = ballot
+	own := PrepareResponse{Id: r.Id, OK: true, Ballot: ballot, Status: inst.status, VBallot: inst.vballot, Entry: inst.entry}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.recovering, id)
+		inst.blocked = time.Now()
+		r.mu.Unlock()
+	}()
+
+	r.logger.Info("recovering epaxos instance", "instance", id, "ballot", ballot)
+	req := PrepareRequest{Id: r.Id, Instance: id, Ballot: ballot, Token: r.cfg.Token}
+	need := r.slowQuorum()
+	replies := r.broadcast("EPaxos.Prepare", req, func() any { return new(PrepareResponse) }, need)
+	if len(replies) < need {
+		r.logger.Warn("error recovering epaxos instance", "instance", id, "prepared", len(replies), "needed", need)
+		return
+	}
+	states := []PrepareResponse{own}
+	for _, reply := range replies {
+		states = append(states, *reply.(*PrepareResponse))
+	}
+	if err := r.finish(id, ballot, states); err != nil {
+		r.logger.Warn("error recovering epaxos instance", "instance", id, "error", err)
+	}
+}
+
+// Commit what the prepared replicas report, most advanced state first
+func (r *Replica) finish(id InstanceID, ballot int, states []PrepareResponse) error {
+	var accepted *PrepareResponse
+	var preAccepted []PrepareResponse
+	for i, state := range states {
+		switch state.Status {
+		case StatusCommitted:
+			r.commit(id, state.Entry)
+			return nil
+		case StatusAccepted:
+			if accepted == nil || state.VBallot > accepted.VBallot {
+				accepted = &states[i]
+			}
+		case StatusPreAccepted:
+			preAccepted = append(preAccepted, state)
+		}
+	}
+	if accepted != nil {
+		return r.accept(id, ballot, accepted.Entry)
+	}
+
+	// The leader may have committed on the fast path, which leaves its
+	// attributes unchanged on enough replicas besides it to show up here
+	for _, state := range preAccepted {
+		same := 0
+		for _, other := range preAccepted {
+			if other.Id != id.Replica && other.VBallot == 0 && other.Entry.Seq == state.Entry.Seq && slices.Equal(other.Entry.Deps, state.Entry.Deps) {
+				same++
+			}
+		}
+		if state.Id != id.Replica && same >= r.N/2 {
+			return r.accept(id, ballot, state.Entry)
+		}
+	}
+
+	if len(preAccepted) > 0 {
+		// Not committed anywhere, order the command again on the slow path
+		r.mu.Lock()
+		entry := r.attributes(id, preAccepted[0].Entry)
+		r.update(id, entry, StatusPreAccepted, ballot)
+		r.mu.Unlock()
+		return r.lead(id, ballot, entry, false)
+	}
+	return r.accept(id, ballot, Entry{})
+}
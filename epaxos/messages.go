@@ -0,0 +1,93 @@
+package epaxos
+
+// Instance in a replica's instance space, each replica leads its own
+type InstanceID struct {
+	Replica int
+	Slot    int
+}
+
+// Instance states, in the order an instance moves through them
+const (
+	StatusNone = iota
+	StatusPreAccepted
+	StatusAccepted
+	StatusCommitted
+	StatusExecuted
+)
+
+// Command of an instance with the attributes ordering it
+type Entry struct {
+	Command string       // Encoded command, empty for a no-op
+	Keys    []string     // Commands sharing a key interfere
+	Seq     int          // Orders instances depending on each other
+	Deps    []InstanceID // Latest interfering instance per replica and key
+}
+
+// Phase 1: the leader's attributes, answered with the ones the replica adds
+type PreAcceptRequest struct {
+	Id       int
+	Instance InstanceID
+	Ballot   int
+	Entry    Entry
+	Token    string // Cluster credentials
+}
+
+// Replica the request comes from, which must match its node certificate
+func (req PreAcceptRequest) SenderID() int { return req.Id }
+
+type PreAcceptResponse struct {
+	Id        int
+	OK        bool
+	Ballot    int   // Rejected: ballot the replica has promised
+	Entry     Entry // Attributes merged with the replica's interfering instances
+	Changed   bool  // Entry differs from the request's
+	Committed bool  // The instance was already committed with Entry
+}
+
+// Paxos accept of an instance's final attributes, on the slow path
+type AcceptRequest struct {
+	Id       int
+	Instance InstanceID
+	Ballot   int
+	Entry    Entry
+	Token    string
+}
+
+func (req AcceptRequest) SenderID() int { return req.Id }
+
+type AcceptResponse struct {
+	Id     int
+	OK     bool
+	Ballot int // Rejected: ballot the replica has promised
+}
+
+// Committed attributes, sent to every replica
+type CommitRequest struct {
+	Id       int
+	Instance InstanceID
+	Entry    Entry
+	Token    string
+}
+
+func (req CommitRequest) SenderID() int { return req.Id }
+
+type CommitResponse struct{}
+
+// Recovery of an instance whose leader may have failed
+type PrepareRequest struct {
+	Id       int
+	Instance InstanceID
+	Ballot   int
+	Token    string
+}
+
+func (req PrepareRequest) SenderID() int { return req.Id }
+
+type PrepareResponse struct {
+	Id      int
+	OK      bool
+	Ballot  int // Promised ballot, or the one the replica promised instead
+	Status  int // Executed instances report StatusCommitted
+	VBallot int // Ballot Entry was pre-accepted or accepted at
+	Entry   Entry
+}
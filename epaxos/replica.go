@@ -0,0 +1,473 @@
+package epaxos
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+)
+
+// Key interfering with every other key
+const AllKeys = "*"
+
+// How long a phase waits for other replicas to answer
+const rpcTimeout = 2 * time.Second
+
+// How long execution waits on an uncommitted instance before recovering it
+const recoveryTimeout = time.Second
+
+// Executed instances kept per replica below its first one that isn't, for
+// replicas still committing or recovering them
+const retainedInstances = 1024
+
+// A higher ballot took over the instance, e.g. another replica recovering it
+var ErrPreempted = errors.New("instance taken over by a higher ballot")
+
+// Instance as this replica knows it
+type instance struct {
+	entry   Entry
+	status  int
+	ballot  int       // Highest ballot promised
+	vballot int       // Ballot entry was pre-accepted or accepted at
+	blocked time.Time // When execution started waiting for it, zero if it isn't
+}
+
+// Egalitarian Paxos replica. Every replica leads the commands proposed to it
+// in its own instances, and only commands that interfere are ordered relative
+// to each other: each instance depends on the interfering instances its
+// replicas knew of. When the replicas of a fast quorum add no dependencies the
+// command commits in one round trip, otherwise a Paxos accept on a majority
+// settles its dependencies. Committed instances are executed once everything
+// they depend on is, strongly connected instances by Seq, and dropped once
+// retainedInstances later ones of their replica were executed too.
+//
+// Safe for concurrent use.
+type Replica struct {
+	Id  int
+	N   int // Replicas in the cluster
+	cfg consensus.Config
+
+	mu         sync.Mutex
+	peers      map[string]consensus.Connection // Other replicas by address
+	instances  map[InstanceID]*instance
+	nextSlot   int
+	conflicts  map[string]map[int]int // Latest slot by replica of the instances with each key
+	seqs       map[string]int         // Highest Seq of the instances with each key
+	executedTo map[int]int            // By replica, its instances below this slot are all executed
+	droppedTo  map[int]int            // By replica, its instances below this slot were executed and dropped
+	recovering map[InstanceID]bool
+	kick       chan struct{} // Wakes the executor after a commit
+	committed  chan consensus.Entry
+	executed   int // Commands handed out, only used by the executor
+	logger     *slog.Logger
+}
+
+// Replica delivering committed commands in dependency order. Other replicas
+// are set with SetMembers.
+func NewReplica(cfg consensus.Config) *Replica {
+	r := &Replica{
+		Id:         cfg.ID,
+		N:          cfg.NodeCount,
+		cfg:        cfg,
+		peers:      make(map[string]consensus.Connection),
+		instances:  make(map[InstanceID]*instance),
+		conflicts:  make(map[string]map[int]int),
+		seqs:       make(map[string]int),
+		executedTo: make(map[int]int),
+		droppedTo:  make(map[int]int),
+		recovering: make(map[InstanceID]bool),
+		kick:       make(chan struct{}, 1),
+		committed:  make(chan consensus.Entry, 64),
+		logger:     cfg.Logger,
+	}
+	go r.executor()
+	return r
+}
+
+func (r *Replica) SetMembers(members map[string]consensus.Member) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = make(map[string]consensus.Connection, len(members))
+	for addr, member := range members {
+		if addr != r.cfg.Addr {
+			r.peers[addr] = member.Connection
+		}
+	}
+}
+
+func (r *Replica) Committed() <-chan consensus.Entry {
+	return r.committed
+}
+
+func (r *Replica) Service() (string, any) {
+	return "EPaxos", &Service{replica: r}
+}
+
+// Other replicas that must add nothing for the fast path: all but one
+// besides the leader, and never less than a majority. Recovery then finds a
+// fast commit from N/2 identical answers of a majority without the leader,
+// see finish.
+func (r *Replica) fastQuorum() int {
+	return max(r.N-2, r.slowQuorum())
+}
+
+// Other replicas completing a majority with this one
+func (r *Replica) slowQuorum() int {
+	return r.N / 2
+}
+
+// Lead a command in this replica's next instance and return once it's
+// committed. It executes after the instances it depends on.
+func (r *Replica) Propose(p consensus.Proposal) error {
+	r.mu.Lock()
+	id := InstanceID{Replica: r.Id, Slot: r.nextSlot}
+	entry := r.attributes(id, Entry{Command: p.Command, Keys: p.Keys})
+	r.update(id, entry, StatusPreAccepted, 0)
+	r.mu.Unlock()
+	return r.lead(id, 0, entry, true)
+}
+
+// Phase 1 of an instance this replica leads. Commits right away if the fast
+// path is allowed and a fast quorum added no dependencies, otherwise accepts
+// the union of everyone's attributes first.
+func (r *Replica) lead(id InstanceID, ballot int, entry Entry, fast bool) error {
+	need := r.slowQuorum()
+	if fast {
+		need = r.fastQuorum()
+	}
+	req := PreAcceptRequest{Id: r.Id, Instance: id, Ballot: ballot, Entry: entry, Token: r.cfg.Token}
+	replies := r.broadcast("EPaxos.PreAccept", req, func() any { return new(PreAcceptResponse) }, need)
+	if len(replies) < need {
+		if len(replies) < r.slowQuorum() {
+			return fmt.Errorf("instance %v: %d of %d replicas pre-accepted", id, len(replies), need)
+		}
+		// A majority is enough for the slow path
+		fast = false
+	}
+
+	merged, changed := entry, false
+	for _, reply := range replies {
+		res := reply.(*PreAcceptResponse)
+		if res.Committed {
+			r.commit(id, res.Entry)
+			return nil
+		}
+		changed = changed || res.Changed
+		merged.Seq = max(merged.Seq, res.Entry.Seq)
+		merged.Deps = append(merged.Deps, res.Entry.Deps...)
+	}
+	merged.Deps = normalize(merged.Deps)
+	if fast && !changed {
+		r.logger.Debug("epaxos fast path", "instance", id, "seq", entry.Seq, "deps", len(entry.Deps))
+		r.commit(id, entry)
+		return nil
+	}
+	r.logger.Debug("epaxos slow path", "instance", id, "seq", merged.Seq, "deps", len(merged.Deps))
+	return r.accept(id, ballot, merged)
+}
+
+// Phase 2: get the attributes accepted by a majority, then commit them
+func (r *Replica) accept(id InstanceID, ballot int, entry Entry) error {
+	r.mu.Lock()
+	if inst := r.instance(id); inst.ballot > ballot {
+		r.mu.Unlock()
+		return fmt.Errorf("instance %v: %w", id, ErrPreempted)
+	}
+	r.update(id, entry, StatusAccepted, ballot)
+	r.mu.Unlock()
+
+	if r.cfg.Faults.Timeout.Load() {
+		time.Sleep(10 * time.Second)
+	}
+	req := AcceptRequest{Id: r.Id, Instance: id, Ballot: ballot, Entry: entry, Token: r.cfg.Token}
+	need := r.slowQuorum()
+	replies := r.broadcast("EPaxos.Accept", req, func() any { return new(AcceptResponse) }, need)
+	if len(replies) < need {
+		return fmt.Errorf("instance %v: %d of %d replicas accepted", id, len(replies), need)
+	}
+	r.commit(id, entry)
+	return nil
+}
+
+// Commit locally and tell every other replica
+func (r *Replica) commit(id InstanceID, entry Entry) {
+	r.mu.Lock()
+	r.commitLocked(id, entry)
+	peers := maps.Clone(r.peers)
+	r.mu.Unlock()
+
+	req := CommitRequest{Id: r.Id, Instance: id, Entry: entry, Token: r.cfg.Token}
+	for addr, peer := range peers {
+		go func(addr string, peer consensus.Connection) {
+			if err := peer.Call("EPaxos.Commit", req, new(CommitResponse)); err != nil {
+				r.logger.Warn("error sending epaxos commit", "replica", addr, "instance", id, "error", err)
+			}
+		}(addr, peer)
+	}
+}
+
+// mu must be held
+func (r *Replica) commitLocked(id InstanceID, entry Entry) {
+	if r.dropped(id) {
+		return
+	}
+	inst := r.instance(id)
+	if inst.status >= StatusCommitted {
+		return
+	}
+	r.update(id, entry, StatusCommitted, inst.vballot)
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Send a request to every other replica at once and return the answers that
+// were OK, as soon as need of them arrived, everyone answered or rpcTimeout
+// passed
+func (r *Replica) broadcast(method string, args any, newReply func() any, need int) []any {
+	r.mu.Lock()
+	peers := maps.Clone(r.peers)
+	r.mu.Unlock()
+
+	answers := make(chan any, len(peers))
+	for addr, peer := range peers {
+		go func(addr string, peer consensus.Connection) {
+			reply := newReply()
+			if err := peer.Call(method, args, reply); err != nil {
+				r.logger.Debug("epaxos request failed", "method", method, "replica", addr, "error", err)
+				answers <- nil
+				return
+			}
+			answers <- reply
+		}(addr, peer)
+	}
+
+	var replies []any
+	timeout := time.After(rpcTimeout)
+	for answered := 0; answered < len(peers) && len(replies) < need; answered++ {
+		select {
+		case reply := <-answers:
+			if reply != nil && ok(reply) {
+				replies = append(replies, reply)
+			}
+		case <-timeout:
+			return replies
+		}
+	}
+	return replies
+}
+
+func ok(reply any) bool {
+	switch res := reply.(type) {
+	case *PreAcceptResponse:
+		return res.OK
+	case *AcceptResponse:
+		return res.OK
+	case *PrepareResponse:
+		return res.OK
+	}
+	return false
+}
+
+// Handle phase 1: add the interfering instances this replica knows of to the
+// leader's attributes
+func (r *Replica) PreAccept(req PreAcceptRequest) PreAcceptResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped(req.Instance) {
+		return PreAcceptResponse{Id: r.Id}
+	}
+	inst := r.instance(req.Instance)
+	res := PreAcceptResponse{Id: r.Id, Ballot: inst.ballot}
+	if inst.status >= StatusCommitted {
+		res.OK, res.Committed, res.Entry = true, true, inst.entry
+		return res
+	}
+	if req.Ballot < inst.ballot || (inst.status == StatusAccepted && req.Ballot <= inst.vballot) {
+		return res
+	}
+	entry := r.attributes(req.Instance, req.Entry)
+	r.update(req.Instance, entry, StatusPreAccepted, req.Ballot)
+	res.OK, res.Ballot, res.Entry = true, req.Ballot, entry
+	res.Changed = entry.Seq != req.Entry.Seq || !slices.Equal(entry.Deps, normalize(req.Entry.Deps))
+	return res
+}
+
+func (r *Replica) Accept(req AcceptRequest) AcceptResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped(req.Instance) {
+		return AcceptResponse{Id: r.Id}
+	}
+	inst := r.instance(req.Instance)
+	if inst.status >= StatusCommitted {
+		return AcceptResponse{Id: r.Id, OK: true, Ballot: inst.ballot}
+	}
+	if req.Ballot < inst.ballot {
+		return AcceptResponse{Id: r.Id, Ballot: inst.ballot}
+	}
+	r.update(req.Instance, req.Entry, StatusAccepted, req.Ballot)
+	return AcceptResponse{Id: r.Id, OK: true, Ballot: req.Ballot}
+}
+
+func (r *Replica) Commit(req CommitRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commitLocked(req.Instance, req.Entry)
+}
+
+// Handle a recovery: promise the ballot and report what this replica has
+func (r *Replica) Prepare(req PrepareRequest) PrepareResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped(req.Instance) {
+		return PrepareResponse{Id: r.Id}
+	}
+	inst := r.instance(req.Instance)
+	res := PrepareResponse{Id: r.Id, Ballot: inst.ballot, Status: min(inst.status, StatusCommitted), VBallot: inst.vballot, Entry: inst.entry}
+	if inst.status < StatusCommitted {
+		if req.Ballot <= inst.ballot {
+			return res
+		}
+		inst.ballot = req.Ballot
+		res.Ballot = req.Ballot
+	}
+	res.OK = true
+	return res
+}
+
+func (r *Replica) Status() consensus.Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var pending, committed, executed int
+	for _, inst := range r.instances {
+		switch inst.status {
+		case StatusExecuted:
+			executed++
+		case StatusCommitted:
+			committed++
+		default:
+			pending++
+		}
+	}
+	for _, slot := range r.droppedTo {
+		executed += slot
+	}
+	return consensus.Status{
+		Engine: consensus.EngineEPaxos,
+		State:  []string{fmt.Sprintf("EPaxos={NextInstance:%d, Pending:%d, Committed:%d, Executed:%d}", r.nextSlot, pending, committed, executed)},
+	}
+}
+
+// Whether an instance was executed and dropped, requests for it are refused
+// from then on. mu must be held.
+func (r *Replica) dropped(id InstanceID) bool {
+	return id.Slot < r.droppedTo[id.Replica]
+}
+
+// Drop executed instances more than retainedInstances below each replica's
+// first instance that isn't executed, mu must be held
+func (r *Replica) compact() {
+	for replica := 1; replica <= r.N; replica++ {
+		for {
+			inst, ok := r.instances[InstanceID{Replica: replica, Slot: r.executedTo[replica]}]
+			if !ok || inst.status != StatusExecuted {
+				break
+			}
+			r.executedTo[replica]++
+		}
+		for ; r.droppedTo[replica] < r.executedTo[replica]-retainedInstances; r.droppedTo[replica]++ {
+			slot := r.droppedTo[replica]
+			id := InstanceID{Replica: replica, Slot: slot}
+			// Later instances no longer depend on it, it counts as executed
+			for _, key := range r.instances[id].entry.Keys {
+				if r.conflicts[key][replica] == slot {
+					delete(r.conflicts[key], replica)
+				}
+				if len(r.conflicts[key]) == 0 {
+					delete(r.conflicts, key)
+					delete(r.seqs, key)
+				}
+			}
+			delete(r.instances, id)
+		}
+	}
+}
+
+// Instance by ID, created empty if this replica hasn't heard of it, mu must
+// be held
+func (r *Replica) instance(id InstanceID) *instance {
+	inst, ok := r.instances[id]
+	if !ok {
+		inst = &instance{}
+		r.instances[id] = inst
+	}
+	return inst
+}
+
+// entry with Seq above and Deps including every instance with one of its
+// keys this replica knows of, mu must be held
+func (r *Replica) attributes(id InstanceID, entry Entry) Entry {
+	deps := slices.Clone(entry.Deps)
+	add := func(key string) {
+		for replica, slot := range r.conflicts[key] {
+			if dep := (InstanceID{Replica: replica, Slot: slot}); dep != id {
+				deps = append(deps, dep)
+			}
+		}
+		entry.Seq = max(entry.Seq, r.seqs[key]+1)
+	}
+	if slices.Contains(entry.Keys, AllKeys) {
+		for key := range r.conflicts {
+			add(key)
+		}
+	} else {
+		for _, key := range entry.Keys {
+			add(key)
+		}
+		add(AllKeys)
+	}
+	entry.Deps = normalize(deps)
+	return entry
+}
+
+// Record an instance's entry and make later instances with its keys depend
+// on it, mu must be held
+func (r *Replica) update(id InstanceID, entry Entry, status int, ballot int) {
+	inst := r.instance(id)
+	inst.entry, inst.status, inst.vballot = entry, status, ballot
+	inst.ballot = max(inst.ballot, ballot)
+	for _, key := range entry.Keys {
+		conflicts, ok := r.conflicts[key]
+		if !ok {
+			conflicts = make(map[int]int)
+			r.conflicts[key] = conflicts
+		}
+		if slot, ok := conflicts[id.Replica]; !ok || slot < id.Slot {
+			conflicts[id.Replica] = id.Slot
+		}
+		r.seqs[key] = max(r.seqs[key], entry.Seq)
+	}
+	if id.Replica == r.Id {
+		r.nextSlot = max(r.nextSlot, id.Slot+1)
+	}
+}
+
+// Sorted without duplicates, so equal dependencies compare equal
+func normalize(deps []InstanceID) []InstanceID {
+	slices.SortFunc(deps, compareIDs)
+	return slices.Compact(deps)
+}
+
+func compareIDs(a, b InstanceID) int {
+	if a.Replica != b.Replica {
+		return a.Replica - b.Replica
+	}
+	return a.Slot - b.Slot
+}
@@ -0,0 +1,271 @@
+package epaxos
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/logging"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Replicas in this process calling each other's services directly, counting
+// the calls
+type localCluster struct {
+	replicas []*Replica
+	mu       sync.Mutex
+	calls    map[string]int // By method
+}
+
+type replicaConnection struct {
+	cluster *localCluster
+	to      *Replica
+}
+
+func (c *replicaConnection) Call(serviceMethod string, args any, reply any) error {
+	c.cluster.mu.Lock()
+	c.cluster.calls[serviceMethod]++
+	c.cluster.mu.Unlock()
+	service := &Service{replica: c.to}
+	switch req := args.(type) {
+	case PreAcceptRequest:
+		return service.PreAccept(&req, reply.(*PreAcceptResponse))
+	case AcceptRequest:
+		return service.Accept(&req, reply.(*AcceptResponse))
+	case CommitRequest:
+		return service.Commit(&req, reply.(*CommitResponse))
+	case PrepareRequest:
+		return service.Prepare(&req, reply.(*PrepareResponse))
+	}
+	return errors.New("unexpected call " + serviceMethod)
+}
+
+func startLocalCluster(t *testing.T, n int) *localCluster {
+	t.Helper()
+	c := &localCluster{calls: make(map[string]int)}
+	for id := 1; id <= n; id++ {
+		c.replicas = append(c.replicas, NewReplica(consensus.Config{
+			ID:        id,
+			NodeCount: n,
+			Addr:      replicaAddr(id),
+			Token:     utils.ClusterToken,
+			Faults:    &consensus.Faults{},
+			Logger:    logging.Discard(),
+		}))
+	}
+	for _, r := range c.replicas {
+		members := make(map[string]consensus.Member, n)
+		for _, other := range c.replicas {
+			members[replicaAddr(other.Id)] = consensus.Member{Connection: &replicaConnection{cluster: c, to: other}, Role: consensus.RoleVoter}
+		}
+		r.SetMembers(members)
+	}
+	return c
+}
+
+func replicaAddr(id int) string {
+	return fmt.Sprintf("127.0.0.1:%d", 9100+id)
+}
+
+func (c *localCluster) called(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[method]
+}
+
+// Next commands a replica executes
+func executed(t *testing.T, r *Replica, n int) []string {
+	t.Helper()
+	var commands []string
+	timeout := time.After(5 * recoveryTimeout)
+	for len(commands) < n {
+		select {
+		case entry := <-r.Committed():
+			commands = append(commands, entry.Command)
+		case <-timeout:
+			t.Fatalf("replica %d executed %d of %d commands: %v", r.Id, len(commands), n, commands)
+		}
+	}
+	return commands
+}
+
+// Attributes of an instance as a replica knows it
+func entryOf(r *Replica, id InstanceID) (Entry, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inst, ok := r.instances[id]
+	if !ok {
+		return Entry{}, StatusNone
+	}
+	return inst.entry, inst.status
+}
+
+// A command commits in one round trip when all replicas but one add nothing
+// to its attributes, and takes the slow path when only a majority answers
+func TestFastPath(t *testing.T) {
+	c := startLocalCluster(t, 5)
+	leader := c.replicas[0]
+	if got := leader.fastQuorum(); got != 3 {
+		t.Fatalf("fast quorum of 5 replicas is %d others, want 3", got)
+	}
+
+	if err := leader.Propose(consensus.Proposal{Command: "a", Keys: []string{"/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.called("EPaxos.Accept"); n != 0 {
+		t.Errorf("fast path sent %d accepts", n)
+	}
+
+	c.replicas[3].cfg.Faults.Stop.Store(true)
+	c.replicas[4].cfg.Faults.Stop.Store(true)
+	if err := leader.Propose(consensus.Proposal{Command: "b", Keys: []string{"/b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.called("EPaxos.Accept"); n == 0 {
+		t.Errorf("committed without a fast quorum or an accept phase")
+	}
+	if got := executed(t, leader, 2); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("executed %v", got)
+	}
+}
+
+// A replica that knows of an interfering instance the leader doesn't adds
+// it, the leader accepts the union on the slow path. The other instance is
+// recovered once execution waits on it, and runs first everywhere.
+func TestSlowPathRecovery(t *testing.T) {
+	c := startLocalCluster(t, 3)
+	other := InstanceID{Replica: 3, Slot: 0}
+	// Replica 3 pre-accepted its command at replica 2 only, then failed
+	c.replicas[1].PreAccept(PreAcceptRequest{Id: 3, Instance: other, Entry: Entry{Command: "b", Keys: []string{"k"}, Seq: 1}})
+	c.replicas[2].cfg.Faults.Stop.Store(true)
+
+	if err := c.replicas[0].Propose(consensus.Proposal{Command: "a", Keys: []string{"k"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.called("EPaxos.Accept"); n == 0 {
+		t.Errorf("added dependency committed without an accept phase")
+	}
+	entry, status := entryOf(c.replicas[0], InstanceID{Replica: 1, Slot: 0})
+	if status < StatusCommitted || !slices.Equal(entry.Deps, []InstanceID{other}) || entry.Seq != 2 {
+		t.Fatalf("committed %+v with status %d, want a dependency on %v at seq 2", entry, status, other)
+	}
+
+	for _, r := range c.replicas[:2] {
+		if got := executed(t, r, 2); !slices.Equal(got, []string{"b", "a"}) {
+			t.Errorf("replica %d executed %v, want the recovered command first", r.Id, got)
+		}
+	}
+	if n := c.called("EPaxos.Prepare"); n == 0 {
+		t.Errorf("executed without recovering %v", other)
+	}
+}
+
+// A command pre-accepted unchanged by the fast quorum may have been
+// committed by a leader that failed right after. Recovery must commit it
+// with those attributes, even though a replica it asks learned of an
+// interfering command since.
+func TestRecoverFastCommit(t *testing.T) {
+	c := startLocalCluster(t, 5)
+	leader := c.replicas[4]
+	leader.cfg.Faults.Stop.Store(true)
+	id := InstanceID{Replica: 5, Slot: 0}
+	fast := Entry{Command: "fast", Keys: []string{"k"}, Seq: 1}
+	for _, r := range c.replicas[1:4] {
+		if res := r.PreAccept(PreAcceptRequest{Id: 5, Instance: id, Entry: fast}); !res.OK || res.Changed {
+			t.Fatalf("replica %d answered %+v", r.Id, res)
+		}
+	}
+	later := InstanceID{Replica: 2, Slot: 0}
+	c.replicas[0].PreAccept(PreAcceptRequest{Id: 2, Instance: later, Entry: Entry{Command: "later", Keys: []string{"k"}}})
+
+	c.replicas[0].recover(id)
+	entry, status := entryOf(c.replicas[0], id)
+	if status < StatusCommitted {
+		t.Fatalf("instance has status %d after recovery", status)
+	}
+	if entry.Command != "fast" || entry.Seq != 1 || len(entry.Deps) != 0 {
+		t.Errorf("recovered %+v, want the fast path's attributes %+v", entry, fast)
+	}
+}
+
+// Committed instances wait for everything they depend on, instances
+// depending on each other run by Seq, and every replica runs them in the
+// same order whatever order they were committed in
+func TestExecutionOrder(t *testing.T) {
+	a, b, c := InstanceID{Replica: 1, Slot: 0}, InstanceID{Replica: 2, Slot: 0}, InstanceID{Replica: 3, Slot: 0}
+	free := InstanceID{Replica: 3, Slot: 1}
+	commits := map[InstanceID]Entry{
+		a:    {Command: "a", Keys: []string{"k"}, Seq: 2, Deps: []InstanceID{b}},
+		b:    {Command: "b", Keys: []string{"k"}, Seq: 1, Deps: []InstanceID{a}},
+		c:    {Command: "c", Keys: []string{"k"}, Seq: 3, Deps: []InstanceID{a, b}},
+		free: {Command: "free", Keys: []string{"other"}, Seq: 1},
+	}
+	for _, order := range [][]InstanceID{{a, b, c, free}, {free, c, a, b}, {c, b, free, a}} {
+		r := NewReplica(consensus.Config{ID: 1, NodeCount: 3, Token: utils.ClusterToken, Faults: &consensus.Faults{}, Logger: logging.Discard()})
+		for _, id := range order {
+			r.Commit(CommitRequest{Instance: id, Entry: commits[id]})
+		}
+		got := executed(t, r, 4)
+		// The free command doesn't interfere, it may run anywhere
+		got = slices.DeleteFunc(got, func(command string) bool { return command == "free" })
+		if !slices.Equal(got, []string{"b", "a", "c"}) {
+			t.Errorf("committing %v executed %v, want b a c", order, got)
+		}
+	}
+}
+
+// Executed instances are dropped, later commands still commit and execute,
+// and a late commit of a dropped instance doesn't run it again
+func TestDropExecutedInstances(t *testing.T) {
+	c := startLocalCluster(t, 3)
+	n := retainedInstances + 50
+	counts := make([]chan []string, len(c.replicas))
+	for i, r := range c.replicas {
+		counts[i] = make(chan []string, 1)
+		go func(r *Replica, out chan []string) {
+			var commands []string
+			for entry := range r.Committed() {
+				if commands = append(commands, entry.Command); len(commands) == n+1 {
+					out <- commands
+				}
+			}
+		}(r, counts[i])
+	}
+	for i := 0; i < n; i++ {
+		if err := c.replicas[0].Propose(consensus.Proposal{Command: fmt.Sprintf("%d", i), Keys: []string{"k"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.replicas[1].Propose(consensus.Proposal{Command: "last", Keys: []string{"k"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range c.replicas {
+		select {
+		case commands := <-counts[i]:
+			if commands[n] != "last" || commands[0] != "0" {
+				t.Errorf("replica %d executed %s ... %s", r.Id, commands[0], strings.Join(commands[n-1:], " "))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("replica %d didn't execute every command", r.Id)
+		}
+	}
+
+	for _, r := range c.replicas {
+		r.mu.Lock()
+		kept := len(r.instances)
+		r.mu.Unlock()
+		if kept > retainedInstances+1 {
+			t.Errorf("replica %d keeps %d instances", r.Id, kept)
+		}
+	}
+	r := c.replicas[2]
+	r.Commit(CommitRequest{Instance: InstanceID{Replica: 1, Slot: 0}, Entry: Entry{Command: "0", Keys: []string{"k"}}})
+	if _, status := entryOf(r, InstanceID{Replica: 1, Slot: 0}); status != StatusNone {
+		t.Errorf("dropped instance came back with status %d", status)
+	}
+}
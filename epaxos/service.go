@@ -0,0 +1,57 @@
+package epaxos
+
+import (
+	"github.com/derekjtong/mini-cloud/auth"
+)
+
+// EPaxos traffic between nodes
+type Service struct {
+	replica *Replica
+}
+
+// Whether to answer a request, an error if its sender isn't a node
+func (s *Service) answer(token string) (bool, error) {
+	if _, err := auth.Require(token, auth.RolePeer); err != nil {
+		return false, err
+	}
+	return !s.replica.cfg.Faults.Stop.Load(), nil
+}
+
+// RPC: PreAccept
+func (s *Service) PreAccept(req *PreAcceptRequest, res *PreAcceptResponse) error {
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	s.replica.logger.Debug("received", "message", "preaccept", "from", req.Id, "instance", req.Instance, "ballot", req.Ballot)
+	*res = s.replica.PreAccept(*req)
+	return nil
+}
+
+// RPC: Accept
+func (s *Service) Accept(req *AcceptRequest, res *AcceptResponse) error {
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	s.replica.logger.Debug("received", "message", "epaxos accept", "from", req.Id, "instance", req.Instance, "ballot", req.Ballot)
+	*res = s.replica.Accept(*req)
+	return nil
+}
+
+// RPC: Commit
+func (s *Service) Commit(req *CommitRequest, res *CommitResponse) error {
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	s.replica.Commit(*req)
+	return nil
+}
+
+// RPC: Prepare - recovery of an instance
+func (s *Service) Prepare(req *PrepareRequest, res *PrepareResponse) error {
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	s.replica.logger.Debug("received", "message", "epaxos prepare", "from", req.Id, "instance", req.Instance, "ballot", req.Ballot)
+	*res = s.replica.Prepare(*req)
+	return nil
+}
@@ -0,0 +1,127 @@
+// locks.go
+
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/node"
+)
+
+// CLI session, renewed in the background while the CLI runs
+type cliSession struct {
+	id   string
+	stop chan struct{}
+}
+
+// session open [ttl] | session close
+func runSessionCommand(client *rpc.Client, token string, argument string, session **cliSession) {
+	fields := strings.Fields(argument)
+	switch {
+	case len(fields) >= 1 && len(fields) <= 2 && fields[0] == "open":
+		if *session != nil {
+			fmt.Printf("Session %s already open\n", (*session).id)
+			return
+		}
+		req := node.OpenSessionRequest{Token: token}
+		if len(fields) == 2 {
+			ttl, err := time.ParseDuration(fields[1])
+			if err != nil {
+				fmt.Printf("Invalid TTL: %v\n", err)
+				return
+			}
+			req.TTL = ttl
+		}
+		var res node.OpenSessionResponse
+		if err := client.Call("Client.OpenSession", &req, &res); err != nil {
+			fmt.Printf("Error opening session: %v\n", err)
+			return
+		}
+		*session = &cliSession{id: res.SessionID, stop: make(chan struct{})}
+		go keepSessionAlive(client, token, *session, res.TTL)
+		fmt.Printf("Session %s open (TTL %v)\n", res.SessionID, res.TTL)
+	case len(fields) == 1 && fields[0] == "close":
+		if *session == nil {
+			fmt.Println("No open session")
+			return
+		}
+		close((*session).stop)
+		req := node.SessionRequest{SessionID: (*session).id, Token: token}
+		var res node.CloseSessionResponse
+		if err := client.Call("Client.CloseSession", &req, &res); err != nil {
+			fmt.Printf("Error closing session: %v\n", err)
+		} else {
+			fmt.Println("Session closed, its locks were released")
+		}
+		*session = nil
+	default:
+		fmt.Println("Usage: session open [ttl] | session close")
+	}
+}
+
+// Renew the lease three times per TTL until stopped
+func keepSessionAlive(client *rpc.Client, token string, session *cliSession, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.stop:
+			return
+		case <-ticker.C:
+			req := node.SessionRequest{SessionID: session.id, Token: token}
+			var res node.KeepAliveResponse
+			if err := client.Call("Client.KeepAlive", &req, &res); err != nil {
+				fmt.Printf("\nSession %s lost: %v\n> ", session.id, err)
+				return
+			}
+		}
+	}
+}
+
+// lock <name> | unlock <name>
+func runLockCommand(client *rpc.Client, token string, command string, name string, session *cliSession) {
+	if session == nil {
+		fmt.Println("Open a session first with 'session open [ttl]'")
+		return
+	}
+	if name == "" {
+		fmt.Println("Please provide a lock name")
+		return
+	}
+	req := node.LockRequest{SessionID: session.id, Name: name, Token: token}
+	if command == "unlock" {
+		var res node.ReleaseResponse
+		if err := client.Call("Client.Release", &req, &res); err != nil {
+			fmt.Printf("Error releasing lock: %v\n", err)
+		} else {
+			fmt.Printf("Released %s\n", name)
+		}
+		return
+	}
+	var res node.AcquireResponse
+	if err := client.Call("Client.Acquire", &req, &res); err != nil {
+		fmt.Printf("Error acquiring lock: %v\n", err)
+	} else if !res.Acquired {
+		fmt.Printf("Lock %s is held by %s (fencing token %d)\n", name, res.Holder, res.FencingToken)
+	} else {
+		fmt.Printf("Acquired %s (fencing token %d)\n", name, res.FencingToken)
+	}
+}
+
+func listLocks(client *rpc.Client, token string) {
+	req := node.LocksRequest{Token: token}
+	var res node.LocksResponse
+	if err := client.Call("Client.Locks", &req, &res); err != nil {
+		fmt.Printf("Error listing locks: %v\n", err)
+		return
+	}
+	if len(res.Locks) == 0 {
+		fmt.Println("No locks held")
+	}
+	for _, lock := range res.Locks {
+		fmt.Printf("  %s  %s  session %s  fencing token %d\n", lock.Name, lock.Owner, lock.Session, lock.Token)
+	}
+}
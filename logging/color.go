@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Colors for terminal
+const (
+	Green  = "\033[32m"
+	Yellow = "\033[33m"
+	Red    = "\033[31m"
+	Reset  = "\033[0m"
+)
+
+// Human readable protocol trace. Each record is a single line prefixed with
+// the node ID, colored by the "result" attribute (accepted/rejected) or by
+// level for warnings and errors.
+type ColorHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	opts  slog.HandlerOptions
+	attrs []slog.Attr
+	group string
+}
+
+func NewColorHandler(w io.Writer, opts *slog.HandlerOptions) *ColorHandler {
+	h := &ColorHandler{mu: &sync.Mutex{}, w: w}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *ColorHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *ColorHandler) Handle(_ context.Context, r slog.Record) error {
+	var node string
+	var result string
+	var fields strings.Builder
+
+	appendAttr := func(a slog.Attr) {
+		switch a.Key {
+		case "node":
+			node = a.Value.String()
+			return
+		case "result":
+			result = a.Value.String()
+		}
+		fmt.Fprintf(&fields, " %s=%v", a.Key, a.Value.Any())
+	}
+	for _, a := range h.attrs {
+		appendAttr(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		appendAttr(a)
+		return true
+	})
+
+	color := ""
+	switch {
+	case r.Level >= slog.LevelError || result == "rejected":
+		color = Red
+	case r.Level >= slog.LevelWarn:
+		color = Yellow
+	case result == "accepted":
+		color = Green
+	}
+
+	var line strings.Builder
+	line.WriteString(color)
+	if node != "" {
+		fmt.Fprintf(&line, "[Node %s]: ", node)
+	}
+	line.WriteString(r.Message)
+	line.WriteString(fields.String())
+	if color != "" {
+		line.WriteString(Reset)
+	}
+	line.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line.String())
+	return err
+}
+
+func (h *ColorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		next.attrs = append(next.attrs, a)
+	}
+	return &next
+}
+
+func (h *ColorHandler) WithGroup(name string) slog.Handler {
+	next := *h
+	if next.group != "" {
+		name = next.group + "." + name
+	}
+	next.group = name
+	return &next
+}
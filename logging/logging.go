@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Output formats for utils.LogFormat
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatColor = "color" // ANSI colored protocol trace, for debugging
+)
+
+// Create a logger for a node. Records go to stdout and to a per-node log
+// file under utils.LogDir, and always carry the node ID.
+func NewNodeLogger(nodeID int) (*slog.Logger, error) {
+	level, err := ParseLevel(utils.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	writers := make([]io.Writer, 0, 2)
+	if utils.LogToStdout {
+		writers = append(writers, os.Stdout)
+	}
+	if utils.LogDir != "" {
+		if err := os.MkdirAll(utils.LogDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating log directory: %v", err)
+		}
+		filePath := filepath.Join(utils.LogDir, fmt.Sprintf("node_%d.log", nodeID))
+		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("opening log file: %v", err)
+		}
+		writers = append(writers, file)
+	}
+
+	handler, err := NewHandler(io.MultiWriter(writers...), utils.LogFormat, level)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(handler).With("node", nodeID), nil
+}
+
+// Create a handler writing records in the given format
+func NewHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	case FormatColor:
+		return NewColorHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Parse a level name (debug, info, warn, error)
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// Logger that drops everything, for components created without one
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
@@ -9,10 +9,17 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/derekjtong/mini-cloud/auth"
 	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/shard"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/transport"
 	"github.com/derekjtong/mini-cloud/utils"
 )
 
@@ -21,6 +28,12 @@ func main() {
 		switch os.Args[1] {
 		case "client":
 			startClient()
+		case "trace":
+			runTraceCommand(os.Args[2:])
+		case "certs":
+			generateCerts()
+		case "bench":
+			runBench(os.Args[2:])
 		default:
 			fmt.Printf("Invalid arg")
 		}
@@ -37,28 +50,61 @@ func startClient() {
 	var Port int
 	fmt.Scanln(&Port)
 	fmt.Printf("Connecting to %s:%d...\n", IPAddress, Port)
-	client, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", IPAddress, Port))
+	client, err := transport.DialClient(fmt.Sprintf("%s:%d", IPAddress, Port))
 	if err != nil {
 		fmt.Printf("Error dialing RPC server: %v\n", err)
 		os.Exit(1)
 	}
 	defer client.Close()
 
-	var request node.PingRequest
+	token := os.Getenv("MINI_CLOUD_TOKEN")
+	request := node.PingRequest{Token: token}
 	var response node.PingResponse
-	if err := client.Call("Node.Ping", &request, &response); err != nil {
-		fmt.Printf("Error calling RPC method: %v\n", err)
-		os.Exit(1)
+	if err := client.Call("Client.Ping", &request, &response); err != nil {
+		if !strings.Contains(err.Error(), auth.ErrUnauthenticated.Error()) {
+			fmt.Printf("Error calling RPC method: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Connected! Not authenticated, use 'login <token>' or set MINI_CLOUD_TOKEN")
+	} else {
+		fmt.Printf("Connected to node %v as %s!\n", response.NodeID, response.User)
 	}
-
-	fmt.Printf("Connected to node %v!\n", response.NodeID)
 	if os.Args[1] == "kill" {
 		os.Setenv("TERMINATE", "true")
 		fmt.Println("TERMINATE signal sent. Exiting.")
 		os.Exit(0)
 	}
 
-	runCLI(client)
+	runCLI(&connection{client: client, clientAddr: fmt.Sprintf("%s:%d", IPAddress, Port), adminAddr: response.AdminAddr}, token)
+}
+
+// CLI connection to a node, the Admin service may listen on its own address
+type connection struct {
+	client     *rpc.Client
+	clientAddr string
+	admin      *rpc.Client // Dialed on first admin command
+	adminAddr  string      // Learned from ping, empty if unknown
+}
+
+// Connection to the node's Admin service
+func (c *connection) Admin() (*rpc.Client, error) {
+	if c.adminAddr == "" || c.adminAddr == c.clientAddr {
+		return c.client, nil
+	}
+	if c.admin == nil {
+		admin, err := transport.DialClient(c.adminAddr)
+		if err != nil {
+			return nil, fmt.Errorf("dialing admin service at %s: %v", c.adminAddr, err)
+		}
+		c.admin = admin
+	}
+	return c.admin, nil
+}
+
+func (c *connection) Close() {
+	if c.admin != nil {
+		c.admin.Close()
+	}
 }
 
 func startServer() {
@@ -77,7 +123,19 @@ func startServer() {
 		}
 	}
 
-	var nodeAddrList []string
+	if _, err := startCluster(); err != nil {
+		fmt.Printf("Error starting cluster: %v\n", err)
+		return
+	}
+	select {}
+}
+
+// Start NodeCount nodes in this process and tell each about the others
+func startCluster() ([]node.Addresses, error) {
+	var nodeAddrList []node.Addresses
+	var peerAddrList []string
+	roles := make(map[string]string)
+	ids := make(map[string]int)
 
 	// Start nodes
 	if utils.MinimalStartUpLogging {
@@ -87,27 +145,32 @@ func startServer() {
 		if !utils.MinimalStartUpLogging {
 			fmt.Printf("[SERVER]: Creating node %d\n", nodeID)
 		}
-		port, err := findAvailablePort()
+		addrs, err := allocateAddresses()
 		if err != nil {
-			fmt.Printf("Error finding available port: %v\n", err)
-			return
+			return nil, fmt.Errorf("finding available port: %v", err)
+		}
+		nodeAddrList = append(nodeAddrList, addrs)
+		peerAddrList = append(peerAddrList, addrs.Peer)
+		ids[addrs.Peer] = nodeID
+		if role, ok := utils.NodeRoles[nodeID]; ok {
+			roles[addrs.Peer] = role
 		}
-		addr := fmt.Sprintf("%s:%d", utils.IPAddress, port)
-		nodeAddrList = append(nodeAddrList, addr)
-		go func(addr string, nodeNumber int) {
-			fmt.Printf("[Node %d]: Starting on %s\n", nodeNumber, addr)
-			node, err := node.NewNode(nodeNumber, addr)
+		go func(addrs node.Addresses, nodeNumber int) {
+			fmt.Printf("[Node %d]: Starting on %s\n", nodeNumber, addrs.Client)
+			if utils.SeparateServiceListeners {
+				fmt.Printf("[Node %d]: Peer service on %s, admin service on %s\n", nodeNumber, addrs.Peer, addrs.Admin)
+			}
+			node, err := node.NewNode(nodeNumber, addrs)
 			if err != nil {
-				fmt.Printf("Error creating node %d: %v", nodeID, err)
+				fmt.Printf("Error creating node %d: %v\n", nodeNumber, err)
 				return
 			}
 			node.Start()
-		}(addr, nodeID)
+		}(addrs, nodeID)
 		// Wait until server is ready
-		err = waitForServerReady(addr)
+		err = waitForServerReady(addrs.Client)
 		if err != nil {
-			fmt.Printf("Error waiting for node %d to be ready: %v\n", nodeID, err)
-			return
+			return nil, fmt.Errorf("waiting for node %d to be ready: %v", nodeID, err)
 		}
 	}
 
@@ -115,23 +178,37 @@ func startServer() {
 	if utils.MinimalStartUpLogging {
 		fmt.Printf("[SERVER]: Sending list of node IP addresses to each node\n")
 	}
-	for _, nodeAddr := range nodeAddrList {
+	for _, addrs := range nodeAddrList {
 		if !utils.MinimalStartUpLogging {
 			fmt.Printf("[SERVER]: RPC to set neighbors\n")
 		}
-		client, err := rpc.Dial("tcp", nodeAddr)
+		nodeAddr := addrs.Admin
+		client, err := transport.DialClient(nodeAddr)
 		if err != nil {
 			fmt.Printf("[SERVER] Error dialing node %s: %v\n", nodeAddr, err)
 			continue
 		}
-		var setNeighborsRequest = node.SetNeighborsRequest{Neighbors: nodeAddrList}
+		var setNeighborsRequest = node.SetNeighborsRequest{Neighbors: peerAddrList, Roles: roles, IDs: ids, Token: utils.ClusterToken}
 		var setNeighborsResponse node.SetNeighborsResponse
-		if err := client.Call("Node.SetNeighbors", &setNeighborsRequest, &setNeighborsResponse); err != nil {
+		if err := client.Call("Admin.SetNeighbors", &setNeighborsRequest, &setNeighborsResponse); err != nil {
 			fmt.Printf("Error setting neighbors for node %s: %v\n", nodeAddr, err)
 		}
 		client.Close()
 	}
-	select {}
+	return nodeAddrList, nil
+}
+
+// Generate a dev CA and node/client certificates for TLS
+func generateCerts() {
+	files, err := transport.GenerateDevCerts()
+	if err != nil {
+		fmt.Printf("Error generating certificates: %v\n", err)
+		os.Exit(1)
+	}
+	for _, file := range files {
+		fmt.Printf("Wrote %s\n", file)
+	}
+	fmt.Println("Set TLSEnabled = true in utils/config.go to use them")
 }
 
 // Check server is ready
@@ -144,11 +221,11 @@ func waitForServerReady(address string) error {
 	startTime := time.Now()
 
 	for retries := 0; retries < maxRetries; retries++ {
-		client, err := rpc.Dial("tcp", address)
+		client, err := transport.DialClient(address)
 		if err == nil {
 			var req node.HealthCheckRequest
 			var res node.HealthCheckResponse
-			err = client.Call("Node.HealthCheck", &req, &res)
+			err = client.Call("Client.HealthCheck", &req, &res)
 			client.Close()
 			if err == nil && res.Status == "OK" {
 				return nil
@@ -167,6 +244,30 @@ func waitForServerReady(address string) error {
 	return fmt.Errorf("server at %s did not become ready afte %d attemps", address, maxRetries)
 }
 
+// Pick addresses for a node's services, sharing one port unless
+// SeparateServiceListeners is set
+func allocateAddresses() (node.Addresses, error) {
+	var ports []int
+	count := 1
+	if utils.SeparateServiceListeners {
+		count = 3
+	}
+	for len(ports) < count {
+		port, err := findAvailablePort()
+		if err != nil {
+			return node.Addresses{}, err
+		}
+		if slices.Contains(ports, port) {
+			continue
+		}
+		ports = append(ports, port)
+	}
+	addr := func(i int) string {
+		return fmt.Sprintf("%s:%d", utils.IPAddress, ports[min(i, len(ports)-1)])
+	}
+	return node.Addresses{Client: addr(0), Peer: addr(1), Admin: addr(2)}, nil
+}
+
 // Find available port on system
 func findAvailablePort() (int, error) {
 	// Find a free port
@@ -192,7 +293,10 @@ func findAvailablePort() (int, error) {
 }
 
 // Client CLI
-func runCLI(client *rpc.Client) {
+func runCLI(conn *connection, token string) {
+	defer conn.Close()
+	client := conn.client
+	var session *cliSession
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Println("Enter commands (get 'help' to see full options):")
 
@@ -215,68 +319,204 @@ func runCLI(client *rpc.Client) {
 
 		// Process commands
 		switch command {
+		case "login":
+			if argument == "" {
+				fmt.Println("Please provide a token")
+				continue
+			}
+			token = argument
+			req := node.PingRequest{Token: token}
+			var res node.PingResponse
+			if err := client.Call("Client.Ping", &req, &res); err != nil {
+				fmt.Printf("Login failed: %v\n", err)
+				continue
+			}
+			conn.adminAddr = res.AdminAddr
+			fmt.Printf("Logged in as %s (%s)\n", res.User, res.Role)
 		case "ping":
-			var req node.PingRequest
+			req := node.PingRequest{Token: token}
 			var res node.PingResponse
-			if err := client.Call("Node.Ping", &req, &res); err != nil {
+			if err := client.Call("Client.Ping", &req, &res); err != nil {
 				fmt.Printf("Error calling RPC method: %v\n", err)
 				continue
 			}
 			fmt.Println(res.Message)
-		case "write":
-			if argument == "" {
-				fmt.Println("Please provide a string to write")
+		case "write", "forcewrite", "create", "cas", "append", "ephemeral":
+			req := node.WriteFileRequest{Token: token, TraceID: telemetry.NewTraceID()}
+			if rest, ok := strings.CutPrefix(argument, "--ttl "); ok {
+				var ttl string
+				ttl, argument, _ = strings.Cut(rest, " ")
+				d, err := time.ParseDuration(ttl)
+				if err != nil || d <= 0 {
+					fmt.Println("Please provide a positive TTL, e.g. --ttl 30s")
+					continue
+				}
+				req.TTL = d
+			}
+			var ok bool
+			req.Path, req.Body, ok = strings.Cut(argument, " ")
+			if command == "cas" {
+				var version string
+				version, req.Body, ok = strings.Cut(req.Body, " ")
+				v, err := strconv.Atoi(version)
+				if !ok || err != nil || v < 1 {
+					fmt.Println("Usage: cas <path> <version> <string>")
+					continue
+				}
+				req.IfVersion = v
+			}
+			if !ok || req.Path == "" {
+				fmt.Println("Please provide a path and a string to write")
 				continue
 			}
-			var req node.WriteFileRequest
+			method, name := "Client.WriteFile", "Write"
+			switch command {
+			case "forcewrite":
+				method, name = "Client.ForceWrite", "Force write"
+			case "create":
+				req.IfAbsent = true
+			case "append":
+				method, name = "Client.Append", "Append"
+			case "ephemeral":
+				if session == nil {
+					fmt.Println("Open a session first with 'session open [ttl]'")
+					continue
+				}
+				req.SessionID = session.id
+			}
 			var res node.WriteFileResponse
-			req.Body = argument
-			if err := client.Call("Node.WriteFile", &req, &res); err != nil {
-				fmt.Printf("Write operation failure: %v\n", err)
+			if err := client.Call(method, &req, &res); err != nil {
+				fmt.Printf("%s operation failure: %v (trace ID %s)\n", name, err, req.TraceID)
+			} else if res.Conflict {
+				fmt.Printf("%s conflict: %s is at version %d\n", name, req.Path, res.Version)
 			} else {
-				fmt.Println("Write operation successful")
+				fmt.Printf("%s operation successful (slot %d, version %d)\n", name, res.Slot, res.Version)
 			}
-		case "forcewrite":
-			if argument == "" {
-				fmt.Println("Please provide a string to write")
+		case "delete":
+			fields := strings.Fields(argument)
+			if len(fields) == 0 || len(fields) > 2 {
+				fmt.Println("Usage: delete <path> [version]")
 				continue
 			}
-			var req node.WriteFileRequest
-			var res node.WriteFileResponse
-			req.Body = argument
-			if err := client.Call("Node.ForceWrite", &req, &res); err != nil {
-				fmt.Printf("Force write operation failure: %v\n", err)
+			req := node.DeleteFileRequest{Path: fields[0], Token: token, TraceID: telemetry.NewTraceID()}
+			if len(fields) == 2 {
+				v, err := strconv.Atoi(fields[1])
+				if err != nil || v < 1 {
+					fmt.Println("Usage: delete <path> [version]")
+					continue
+				}
+				req.IfVersion = v
+			}
+			var res node.DeleteFileResponse
+			if err := client.Call("Client.DeleteFile", &req, &res); err != nil {
+				fmt.Printf("Delete operation failure: %v (trace ID %s)\n", err, req.TraceID)
+			} else if res.Conflict {
+				fmt.Printf("Delete conflict: %s is at version %d\n", req.Path, res.Version)
 			} else {
-				fmt.Println("Force write operation successful")
+				fmt.Printf("Delete operation successful (slot %d)\n", res.Slot)
 			}
 		case "read":
-			var req node.ReadFileRequest
+			fields := strings.Fields(argument)
+			req := node.ReadFileRequest{Token: token}
+			if len(fields) == 3 && fields[0] == "--version" {
+				v, err := strconv.Atoi(fields[1])
+				if err != nil || v < 1 {
+					fmt.Println("Usage: read [--version N] <path>")
+					continue
+				}
+				req.Version, fields = v, fields[2:]
+			}
+			if len(fields) != 1 {
+				fmt.Println("Please provide a path to read")
+				continue
+			}
+			req.Path = fields[0]
 			var res node.ReadFileResponse
-			if err := client.Call("Node.ReadFile", &req, &res); err != nil {
+			if err := client.Call("Client.ReadFile", &req, &res); err != nil {
 				fmt.Printf("Read operation failure: %v\n", err)
 			} else {
-				fmt.Println("Data read from file:", res.Data)
+				fmt.Printf("Data read from file (version %d): %s\n", res.Version, res.Data)
+				if res.SessionID != "" {
+					fmt.Printf("Ephemeral, owned by session %s\n", res.SessionID)
+				}
+				if !res.Expires.IsZero() {
+					fmt.Printf("Expires at %s\n", res.Expires.Local().Format(time.DateTime))
+				}
+			}
+		case "txn":
+			runTxnBlock(scanner, client, token)
+		case "session":
+			runSessionCommand(client, token, argument, &session)
+		case "lock", "unlock":
+			runLockCommand(client, token, command, argument, session)
+		case "locks":
+			listLocks(client, token)
+		case "watch":
+			runWatchCommand(scanner, client, token, argument)
+		case "history":
+			if argument == "" {
+				fmt.Println("Please provide a path")
+				continue
 			}
+			req := node.HistoryRequest{Path: argument, Token: token}
+			var res node.HistoryResponse
+			if err := client.Call("Client.History", &req, &res); err != nil {
+				fmt.Printf("History failure: %v\n", err)
+				continue
+			}
+			for _, revision := range res.Revisions {
+				change := "write"
+				if revision.Deleted {
+					change = "delete"
+				}
+				fmt.Printf("  v%d  %s  %s  %s\n", revision.Version, revision.Time.Local().Format(time.DateTime), revision.Author, change)
+			}
+		case "acl":
+			admin, err := conn.Admin()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			runACLCommand(admin, token, argument)
+		case "shards":
+			runShardsCommand(conn, token, argument)
 		case "info":
-			var req node.InfoRequest
+			req := node.InfoRequest{Token: token}
 			var res node.InfoResponse
-			if err := client.Call("Node.Info", &req, &res); err != nil {
+			if err := client.Call("Client.Info", &req, &res); err != nil {
 				fmt.Printf("Error getting info: %v\n", err)
 			} else {
-				fmt.Printf("%s\n%s\n", res.AcceptorInfo, res.ProposerInfo)
+				fmt.Printf("Role=%s\nEngine=%s\n", res.Role, res.Engine)
+				for _, line := range res.EngineInfo {
+					fmt.Println(line)
+				}
+				fmt.Printf("%s\nLeader=%d\n", res.LogInfo, res.Leader)
+				for _, line := range res.Groups {
+					fmt.Println(line)
+				}
 			}
 		case "kill":
-			var req node.TerminateRequest
+			req := node.TerminateRequest{Token: token}
 			var res node.TerminateResponse
-			if err := client.Call("Node.Terminate", &req, &res); err != nil {
+			admin, err := conn.Admin()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if err := admin.Call("Admin.Terminate", &req, &res); err != nil {
 				fmt.Printf("Error calling Terminate RPC method: %v\n", err)
 			} else {
 				fmt.Println("Termination command sent to all nodes.")
 			}
 		case "timeout":
-			var req node.TimeoutRequest
+			req := node.TimeoutRequest{Token: token}
 			var res node.TimeoutResponse
-			if err := client.Call("Node.ToggleTimeout", &req, &res); err != nil {
+			admin, err := conn.Admin()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if err := admin.Call("Admin.ToggleTimeout", &req, &res); err != nil {
 				fmt.Printf("Error toggling timeout: %v\n", err)
 			} else {
 				fmt.Printf("Timeout ")
@@ -287,9 +527,14 @@ func runCLI(client *rpc.Client) {
 				}
 			}
 		case "stop":
-			var req node.StopRequest
+			req := node.StopRequest{Token: token}
 			var res node.StopResponse
-			if err := client.Call("Node.ToggleStop", &req, &res); err != nil {
+			admin, err := conn.Admin()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if err := admin.Call("Admin.ToggleStop", &req, &res); err != nil {
 				fmt.Printf("Error Stop: %v\n", err)
 			} else {
 				if res.IsStopped {
@@ -300,10 +545,25 @@ func runCLI(client *rpc.Client) {
 			}
 		case "help":
 			fmt.Println("Available commands:")
+			fmt.Println("  login <token> - authenticate as the user owning token")
 			fmt.Println("  ping - send ping request to node")
-			fmt.Println("  write <string> - write string to file")
-			fmt.Println("  read - read string from file")
+			fmt.Println("  write [--ttl 30s] <path> <string> - write string to file, deleted after the TTL if given")
+			fmt.Println("  forcewrite <path> <string> - write, retrying until consensus")
+			fmt.Println("  append <path> <string> - append string to file, creating it if needed")
+			fmt.Println("  create <path> <string> - write only if the file doesn't exist")
+			fmt.Println("  cas <path> <version> <string> - write only if the file is at version")
+			fmt.Println("  delete <path> [version] - delete file, only if at version when given")
+			fmt.Println("  txn - start a transaction block, end it with 'commit' or 'abort'")
+			fmt.Println("  read [--version N] <path> - read string from file, or a retained older version")
+			fmt.Println("  history <path> - list retained versions of a file")
+			fmt.Println("  watch <path> [fromVersion] - print changes to a file or directory")
+			fmt.Println("  session open [ttl] | session close - lease that locks and ephemeral files are tied to")
+			fmt.Println("  ephemeral <path> <string> - write a file that is deleted when the session ends")
+			fmt.Println("  lock <name>, unlock <name>, locks - named locks with fencing tokens")
+			fmt.Println("  acl list|set|rm - manage path ACLs (admin)")
+			fmt.Println("  shards [list|split|move] - show the shard map, split or move a shard (admin)")
 			fmt.Println("  info - show info about node proposer and acceptor")
+			fmt.Println("  stop, timeout, kill - cluster controls (admin)")
 			fmt.Println("  help - show this message")
 			fmt.Println("  exit - exit program")
 		default:
@@ -312,6 +572,197 @@ func runCLI(client *rpc.Client) {
 	}
 }
 
+// Read transaction operations until commit or abort, then send them as one
+func runTxnBlock(scanner *bufio.Scanner, client *rpc.Client, token string) {
+	fmt.Println("Transaction: write, append, create, cas, delete or check <path> <version> (0 for absent), then 'commit' or 'abort'")
+	var ops []store.TxnOp
+	for {
+		fmt.Print("txn> ")
+		if !scanner.Scan() {
+			return
+		}
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		command := fields[0]
+		switch command {
+		case "commit":
+			req := node.TxnRequest{Ops: ops, Token: token, TraceID: telemetry.NewTraceID()}
+			var res node.TxnResponse
+			if err := client.Call("Client.Txn", &req, &res); err != nil {
+				fmt.Printf("Transaction failure: %v (trace ID %s)\n", err, req.TraceID)
+			} else if res.Conflict {
+				fmt.Printf("Transaction conflict: %s is at version %d, nothing changed\n", res.ConflictPath, res.Version)
+			} else {
+				fmt.Printf("Transaction committed (slot %d, %d operations)\n", res.Slot, len(ops))
+			}
+			return
+		case "abort":
+			fmt.Println("Transaction aborted")
+			return
+		case "":
+			continue
+		}
+
+		if len(fields) < 2 {
+			fmt.Println("Please provide a path")
+			continue
+		}
+		op := store.TxnOp{Op: command, Path: fields[1]}
+		var arg string
+		if len(fields) == 3 {
+			arg = fields[2]
+		}
+		var version string
+		switch command {
+		case "write", "append":
+			op.Data = arg
+		case "create":
+			op.Op, op.Data, op.IfAbsent = store.OpWrite, arg, true
+		case "cas":
+			op.Op = store.OpWrite
+			version, op.Data, _ = strings.Cut(arg, " ")
+		case "delete", "check":
+			version = arg
+		default:
+			fmt.Println("Unknown transaction command:", command)
+			continue
+		}
+		if version != "" {
+			v, err := strconv.Atoi(version)
+			if err != nil || v < 0 {
+				fmt.Println("Please provide a valid version")
+				continue
+			}
+			op.IfVersion = v
+		}
+		if command == "check" && op.IfVersion == 0 {
+			op.IfAbsent = true
+		}
+		ops = append(ops, op)
+	}
+}
+
+// acl list | acl set <prefix> <principal> <perms> | acl rm <prefix> <principal>
+func runACLCommand(client *rpc.Client, token string, argument string) {
+	fields := strings.Fields(argument)
+	if len(fields) == 0 {
+		fields = []string{"list"}
+	}
+	switch {
+	case fields[0] == "list":
+		req := node.ListACLsRequest{Token: token}
+		var res node.ListACLsResponse
+		if err := client.Call("Admin.ListACLs", &req, &res); err != nil {
+			fmt.Printf("Error listing ACLs: %v\n", err)
+			return
+		}
+		if len(res.Rules) == 0 {
+			fmt.Println("No ACLs, access follows roles")
+		}
+		for _, rule := range res.Rules {
+			fmt.Printf("  %s %s %s\n", rule.Prefix, rule.Principal, rule.Perms)
+		}
+	case fields[0] == "set" && (len(fields) == 4 || len(fields) == 3):
+		rule := auth.Rule{Prefix: fields[1], Principal: fields[2]}
+		if len(fields) == 4 {
+			rule.Perms = fields[3]
+		}
+		req := node.SetACLRequest{Rule: rule, Token: token}
+		var res node.SetACLResponse
+		if err := client.Call("Admin.SetACL", &req, &res); err != nil {
+			fmt.Printf("Error setting ACL: %v\n", err)
+			return
+		}
+		fmt.Printf("ACL set (slot %d)\n", res.Slot)
+	case fields[0] == "rm" && len(fields) == 3:
+		req := node.RemoveACLRequest{Rule: auth.Rule{Prefix: fields[1], Principal: fields[2]}, Token: token}
+		var res node.RemoveACLResponse
+		if err := client.Call("Admin.RemoveACL", &req, &res); err != nil {
+			fmt.Printf("Error removing ACL: %v\n", err)
+			return
+		}
+		fmt.Printf("ACL removed (slot %d)\n", res.Slot)
+	default:
+		fmt.Println("Usage: acl list | acl set <prefix> <user|role:<role>|*> <r|w|rw> | acl rm <prefix> <principal>")
+	}
+}
+
+func runShardsCommand(conn *connection, token string, argument string) {
+	fields := strings.Fields(argument)
+	if len(fields) == 0 {
+		fields = []string{"list"}
+	}
+	var m shard.Map
+	switch {
+	case fields[0] == "list":
+		req := node.ShardMapRequest{Token: token}
+		var res node.ShardMapResponse
+		if err := conn.client.Call("Client.ShardMap", &req, &res); err != nil {
+			fmt.Printf("Error getting shard map: %v\n", err)
+			return
+		}
+		m = res.Shards
+	case fields[0] == "split" && (len(fields) == 2 || len(fields) == 3):
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			fmt.Printf("Invalid shard: %v\n", err)
+			return
+		}
+		admin, err := conn.Admin()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		req := node.SplitShardRequest{Shard: id, Token: token}
+		if len(fields) == 3 {
+			req.At = fields[2]
+		}
+		var res node.SplitShardResponse
+		if err := admin.Call("Admin.SplitShard", &req, &res); err != nil {
+			fmt.Printf("Error splitting shard: %v\n", err)
+			return
+		}
+		m = res.Shards
+	case fields[0] == "move" && len(fields) == 3:
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			fmt.Printf("Invalid shard: %v\n", err)
+			return
+		}
+		group, err := strconv.Atoi(fields[2])
+		if err != nil {
+			fmt.Printf("Invalid group: %v\n", err)
+			return
+		}
+		admin, err := conn.Admin()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		req := node.MoveShardRequest{Shard: id, Group: group, Token: token}
+		var res node.MoveShardResponse
+		if err := admin.Call("Admin.MoveShard", &req, &res); err != nil {
+			fmt.Printf("Error moving shard: %v\n", err)
+			return
+		}
+		m = res.Shards
+	default:
+		fmt.Println("Usage: shards list | shards split <id> [key] | shards move <id> <group>")
+		return
+	}
+	if m.Version == 0 {
+		fmt.Println("Cluster isn't sharded")
+		return
+	}
+	fmt.Printf("Shard map version %d, by %s\n", m.Version, m.By)
+	for _, s := range m.Shards {
+		moving := ""
+		if s.Moving != 0 {
+			moving = fmt.Sprintf(", moving to group %d", s.Moving)
+		}
+		fmt.Printf("  shard %d %s group %d %v%s\n", s.ID, s.Range, s.Group, m.Groups[s.Group], moving)
+	}
+}
+
 // Clear node_data directory
 func clearDir(dir string) error {
 	d, err := os.Open(dir)
@@ -338,7 +789,7 @@ func waitForTermination(client *rpc.Client) {
 	var healthCheckRes node.HealthCheckResponse
 
 	for {
-		if err := client.Call("Node.HealthCheck", &healthCheckReq, &healthCheckRes); err != nil {
+		if err := client.Call("Client.HealthCheck", &healthCheckReq, &healthCheckRes); err != nil {
 			fmt.Printf("Error checking health status: %v\n", err)
 			break
 		}
@@ -0,0 +1,229 @@
+// main_test.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/client"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/node"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Nodes write their data, logs and traces below the working directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mini-cloud-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	utils.LogToStdout = false
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Concurrent writes, compare-and-swaps and appends through every node of
+// an in-process cluster, run with -race to cover the engines and the store.
+// Every node must end up with the same files.
+func TestClusterConcurrentUpdates(t *testing.T) {
+	for _, engine := range []string{consensus.EnginePaxos, consensus.EngineRaft, consensus.EngineEPaxos} {
+		t.Run(engine, func(t *testing.T) {
+			defer func(engine string) { utils.ConsensusEngine = engine }(utils.ConsensusEngine)
+			utils.ConsensusEngine = engine
+			testConcurrentUpdates(t)
+		})
+	}
+}
+
+func testConcurrentUpdates(t *testing.T) {
+	cluster, err := startCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let heartbeats settle who the leader is
+	time.Sleep(2 * utils.HeartbeatInterval)
+
+	clients := dialAll(t, cluster)
+	const workers, perWorker = 6, 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	increments := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			c := clients[w%len(clients)]
+			for i := 0; i < perWorker; i++ {
+				if _, err := c.Write(fmt.Sprintf("/test/file%d", w), strconv.Itoa(i)); err != nil {
+					t.Errorf("write: %v", err)
+				}
+				if _, err := c.Append("/test/log", fmt.Sprintf("%d-%d;", w, i)); err != nil {
+					t.Errorf("append: %v", err)
+				}
+				if err := increment(c, "/test/counter"); err != nil {
+					t.Errorf("increment: %v", err)
+				} else {
+					mu.Lock()
+					increments++
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// Appends are all kept, each once
+	seen := make(map[string]int)
+	for _, entry := range strings.Split(strings.TrimSuffix(readConverged(t, clients, "/test/log"), ";"), ";") {
+		seen[entry]++
+	}
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			if n := seen[fmt.Sprintf("%d-%d", w, i)]; n != 1 {
+				t.Errorf("append %d-%d appears %d times", w, i, n)
+			}
+		}
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("log has %d distinct appends, want %d", len(seen), workers*perWorker)
+	}
+	// No increment is lost to a concurrent one
+	if counter := readConverged(t, clients, "/test/counter"); counter != strconv.Itoa(increments) {
+		t.Errorf("counter is %s after %d increments", counter, increments)
+	}
+	for w := 0; w < workers; w++ {
+		if data := readConverged(t, clients, fmt.Sprintf("/test/file%d", w)); data != strconv.Itoa(perWorker-1) {
+			t.Errorf("file%d is %s, want the last write %d", w, data, perWorker-1)
+		}
+	}
+}
+
+func dialAll(t *testing.T, cluster []node.Addresses) []*client.Client {
+	var clients []*client.Client
+	for _, addrs := range cluster {
+		c, err := client.Dial(addrs.Client, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Add one to a counter file, retrying on conflicts
+func increment(c *client.Client, path string) error {
+	for {
+		data, version, err := c.Read(path)
+		if err != nil && strings.Contains(err.Error(), "does not exist") {
+			data, err = "0", nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(data)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			_, err = c.Create(path, strconv.Itoa(n+1))
+		} else {
+			_, err = c.CompareAndSwap(path, version, strconv.Itoa(n+1))
+		}
+		var conflict *client.ConflictError
+		if !errors.As(err, &conflict) {
+			return err
+		}
+	}
+}
+
+// Contents of a file once every node has applied the same version of it
+func readConverged(t *testing.T, clients []*client.Client, path string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var datas []string
+		var versions []int
+		var err error
+		for _, c := range clients {
+			data, version, readErr := c.Read(path)
+			if readErr != nil {
+				// A node may not have applied the file yet
+				err = readErr
+			}
+			datas, versions = append(datas, data), append(versions, version)
+		}
+		same := err == nil
+		for i := range clients {
+			same = same && versions[i] == versions[0] && datas[i] == datas[0]
+		}
+		if same {
+			return datas[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes disagree on %s: versions %v, error %v", path, versions, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// A transaction changes several files at one version; a watcher resumed
+// halfway through them delivers the rest, each once
+func TestWatchResumesWithinVersion(t *testing.T) {
+	cluster, err := startCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * utils.HeartbeatInterval)
+	c := dialAll(t, cluster)[0]
+
+	if _, err := c.Write("/watch/before", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Txn().Write("/watch/a", "1").Write("/watch/b", "2").Write("/watch/c", "3").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("/watch/after", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	w := c.Watch("/watch", 0)
+	for i := 0; i < 3; i++ {
+		event, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, event.Path)
+	}
+	// Two of the transaction's three changes were delivered
+	resumed := c.Watch("/watch", w.Version)
+	resumed.Offset = w.Offset
+	for i := 0; i < 2; i++ {
+		event, err := resumed.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, event.Path)
+	}
+	want := []string{"/watch/before", "/watch/a", "/watch/b", "/watch/c", "/watch/after"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("watched %v, want %v", paths, want)
+	}
+}
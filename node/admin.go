@@ -0,0 +1,236 @@
+// node/admin.go
+
+package node
+
+import (
+	"net/rpc"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/transport"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Control plane: cluster membership, fault injection and ACLs
+type AdminService struct {
+	node *Node
+}
+
+// PRC: SetNeighbors
+type SetNeighborsRequest struct {
+	Neighbors []string          // Peer addresses
+	Roles     map[string]string // Role by peer address, voter if missing
+	IDs       map[string]int    // Node ID by peer address, needed with sharding and to verify peers with TLS
+	Token     string
+}
+type SetNeighborsResponse struct {
+}
+
+// Update node's list of neighbors
+func (s *AdminService) SetNeighbors(req *SetNeighborsRequest, res *SetNeighborsResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleAdmin, auth.RolePeer); err != nil {
+		return err
+	}
+	clients := make(map[string]*rpc.Client, len(req.Neighbors))
+	for _, neighbor := range req.Neighbors {
+		client, err := transport.DialPeer(neighbor, n.NodeID, req.IDs[neighbor])
+		if err != nil {
+			n.logger.Error("error connecting to neighbor", "neighbor", neighbor, "error", err)
+			continue
+		}
+		clients[neighbor] = client
+	}
+	n.logger.Info("set neighbors", "neighbors", req.Neighbors)
+
+	n.neighborsMu.Lock()
+	defer n.neighborsMu.Unlock()
+	first := len(n.rpcClients) == 0
+	n.NeighborNodes = req.Neighbors
+	for addr, client := range clients {
+		n.rpcClients[addr] = client
+	}
+
+	members := make(map[string]consensus.Member, len(n.rpcClients))
+	for addr, client := range n.rpcClients {
+		role := req.Roles[addr]
+		if role == "" {
+			role = consensus.RoleVoter
+		}
+		members[addr] = consensus.Member{Connection: client, Role: role}
+	}
+	n.engine.SetMembers(members)
+
+	n.leaderMu.Lock()
+	for addr, id := range req.IDs {
+		n.peers[id] = addr
+	}
+	n.leaderMu.Unlock()
+	for _, g := range n.groups {
+		groupMembers := make(map[string]consensus.Member, len(g.members))
+		for addr, member := range members {
+			if slices.Contains(g.members, req.IDs[addr]) {
+				groupMembers[addr] = member
+			}
+		}
+		g.engine.SetMembers(groupMembers)
+	}
+
+	if first {
+		go n.heartbeat()
+		go n.expireSessions()
+		go n.expireFiles()
+	}
+	return nil
+}
+
+// RPC: Toggletimeout
+type TimeoutRequest struct {
+	Token string
+}
+type TimeoutResponse struct {
+	IsTimeout bool
+}
+
+func (s *AdminService) ToggleTimeout(req *TimeoutRequest, res *TimeoutResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleAdmin); err != nil {
+		return err
+	}
+	timeout := !n.faults.Timeout.Load()
+	n.faults.Timeout.Store(timeout)
+
+	res.IsTimeout = timeout
+	n.logger.Info("client toggled timeout", "timeout", timeout)
+	return nil
+}
+
+// RPC: ToggleStop
+type StopRequest struct {
+	Token string
+}
+type StopResponse struct {
+	IsStopped bool
+}
+
+func (s *AdminService) ToggleStop(req *StopRequest, res *StopResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleAdmin); err != nil {
+		return err
+	}
+	stopped := !n.faults.Stop.Load()
+	n.faults.Stop.Store(stopped)
+	if stopped {
+		n.logger.Info("client toggled stop, server will no longer respond to consensus", "engine", utils.ConsensusEngine)
+	} else {
+		n.logger.Info("client toggled stop, server will respond to consensus", "engine", utils.ConsensusEngine)
+	}
+	res.IsStopped = stopped
+	return nil
+}
+
+// RPC: Terminate
+type TerminateRequest struct {
+	Token string
+}
+type TerminateResponse struct{}
+
+func (s *AdminService) Terminate(req *TerminateRequest, res *TerminateResponse) error {
+	if _, err := auth.Require(req.Token, auth.RoleAdmin); err != nil {
+		return err
+	}
+	s.node.terminate()
+	return nil
+}
+
+// Shut down this node and its neighbors
+func (n *Node) terminate() {
+	n.logger.Info("terminate method called")
+
+	// Avoid repeated termination
+	if !n.terminated.CompareAndSwap(false, true) {
+		return
+	}
+
+	// Only send Terminate RPC to neighbors
+	for neighborAddr, client := range n.neighbors() {
+		if neighborAddr != n.addrs.Peer {
+			terminateRequest := TerminateRequest{Token: utils.ClusterToken}
+			var terminateResponse TerminateResponse
+			if err := client.Call("Peer.Terminate", &terminateRequest, &terminateResponse); err != nil {
+				n.logger.Error("error calling Terminate RPC method", "neighbor", neighborAddr, "error", err)
+			}
+		}
+	}
+
+	os.Exit(0)
+}
+
+// RPC: SetACL - add or replace the rule for a prefix and principal
+type SetACLRequest struct {
+	Rule  auth.Rule
+	Token string
+}
+type SetACLResponse struct {
+	Slot int
+}
+
+func (s *AdminService) SetACL(req *SetACLRequest, res *SetACLResponse) error {
+	return s.node.proposeACL(store.OpSetACL, req.Rule, req.Token, &res.Slot)
+}
+
+// RPC: RemoveACL - drop the rule for a prefix and principal
+type RemoveACLRequest struct {
+	Rule  auth.Rule
+	Token string
+}
+type RemoveACLResponse struct {
+	Slot int
+}
+
+func (s *AdminService) RemoveACL(req *RemoveACLRequest, res *RemoveACLResponse) error {
+	return s.node.proposeACL(store.OpRemoveACL, req.Rule, req.Token, &res.Slot)
+}
+
+func (n *Node) proposeACL(op string, rule auth.Rule, token string, slot *int) error {
+	principal, err := auth.Require(token, auth.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if err := auth.ValidateRule(rule); err != nil {
+		return err
+	}
+	rule.Prefix = path.Clean(rule.Prefix)
+
+	cmd := store.NewCommand(op)
+	cmd.Rule = &rule
+	cmd.Principal = principal.Name
+	n.logger.Info("client ACL change, running Paxos", "op", op, "prefix", rule.Prefix, "principal", rule.Principal, "perms", rule.Perms)
+	*slot, _, err = n.proposeCommand(cmd, telemetry.SpanContext{})
+	return err
+}
+
+// RPC: ListACLs
+type ListACLsRequest struct {
+	Token string
+}
+type ListACLsResponse struct {
+	Rules []auth.Rule
+}
+
+func (s *AdminService) ListACLs(req *ListACLsRequest, res *ListACLsResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleAdmin); err != nil {
+		return err
+	}
+	if err := n.checkStoresFiles(); err != nil {
+		return err
+	}
+	res.Rules = n.store.ACLs()
+	return nil
+}
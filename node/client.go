@@ -0,0 +1,407 @@
+// node/client.go
+
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/store"
+)
+
+// Data plane: file operations for clients
+type ClientService struct {
+	node *Node
+}
+
+// RPC: Ping
+type PingRequest struct {
+	Token string
+}
+type PingResponse struct {
+	Message   string
+	NodeID    int
+	User      string
+	Role      string
+	AdminAddr string // Where the Admin service listens
+}
+
+func (s *ClientService) Ping(req *PingRequest, res *PingResponse) error {
+	n := s.node
+	principal, err := auth.Require(req.Token, auth.RoleReader)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("pinged", "user", principal.Name)
+	res.Message = "Pong from node " + strconv.Itoa(n.NodeID)
+	res.NodeID = n.NodeID
+	res.User = principal.Name
+	res.Role = principal.Role
+	res.AdminAddr = n.addrs.Admin
+	return nil
+}
+
+// RPC: Health Check, open to everyone
+type HealthCheckRequest struct{}
+type HealthCheckResponse struct {
+	Status string
+}
+
+func (s *ClientService) HealthCheck(req *HealthCheckRequest, res *HealthCheckResponse) error {
+	res.Status = "OK"
+	return nil
+}
+
+// RPC: WriteFile
+type WriteFileRequest struct {
+	Path      string
+	Body      string
+	IfVersion int           // Optional, only write if the file is at this version
+	IfAbsent  bool          // Only write if the file doesn't exist
+	SessionID string        // Optional, a new file is deleted when this session ends. An existing file keeps its owner: a persistent one stays persistent, and one of another session ends with that session.
+	TTL       time.Duration // Optional, the leader deletes the file once it expires
+	Token     string
+	TraceID   string // Optional, generated by the node if empty
+}
+type WriteFileResponse struct {
+	TraceID  string
+	Slot     int  // Log position of the write
+	Version  int  // New version, or the current version on conflict
+	Conflict bool // A precondition failed and nothing was written
+}
+
+func (s *ClientService) WriteFile(req *WriteFileRequest, res *WriteFileResponse) (err error) {
+	n := s.node
+	span := n.startRequestSpan("WriteFile", req.TraceID)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	res.TraceID = span.TraceID
+
+	cmd, err := n.writeFileCommand(store.OpWrite, req)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("client write, running Paxos", "path", cmd.Path, "value", req.Body, "user", cmd.Principal, "trace_id", span.TraceID)
+
+	slot, result, err := n.proposeCommand(cmd, span.Context())
+	if err != nil {
+		return err
+	}
+
+	res.Slot, res.Version, res.Conflict = slot, result.Version, result.Conflict
+	n.logger.Info("Paxos completed", "slot", slot, "version", result.Version, "conflict", result.Conflict)
+	return nil
+}
+
+// RPC: ForceWrite - WriteFile with retry
+func (s *ClientService) ForceWrite(req *WriteFileRequest, res *WriteFileResponse) (err error) {
+	n := s.node
+	span := n.startRequestSpan("ForceWrite", req.TraceID)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	res.TraceID = span.TraceID
+
+	cmd, err := n.writeFileCommand(store.OpWrite, req)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("client force write, running Paxos", "path", cmd.Path, "value", req.Body, "user", cmd.Principal, "trace_id", span.TraceID)
+
+	slot, result, err := n.proposeWithRetry(cmd, span.Context(), defaultRetry)
+	if err != nil {
+		return err
+	}
+
+	res.Slot, res.Version, res.Conflict = slot, result.Version, result.Conflict
+	n.logger.Info("Paxos completed successfully", "slot", slot, "version", result.Version, "conflict", result.Conflict)
+	return nil
+}
+
+// RPC: Append - add to the end of a file, creating it if needed. Appends
+// from different clients are ordered by the log and retried when they lose
+// to a competing proposal, so none are lost.
+func (s *ClientService) Append(req *WriteFileRequest, res *WriteFileResponse) (err error) {
+	n := s.node
+	span := n.startRequestSpan("Append", req.TraceID)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	res.TraceID = span.TraceID
+
+	cmd, err := n.writeFileCommand(store.OpAppend, req)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("client append, running Paxos", "path", cmd.Path, "value", req.Body, "user", cmd.Principal, "trace_id", span.TraceID)
+
+	slot, result, err := n.proposeWithRetry(cmd, span.Context(), defaultRetry)
+	if err != nil {
+		return err
+	}
+
+	res.Slot, res.Version, res.Conflict = slot, result.Version, result.Conflict
+	n.logger.Info("Paxos completed", "slot", slot, "version", result.Version, "conflict", result.Conflict)
+	return nil
+}
+
+// Check access and build the log command for a write or append
+func (n *Node) writeFileCommand(op string, req *WriteFileRequest) (store.Command, error) {
+	if req.TTL < 0 {
+		return store.Command{}, fmt.Errorf("TTL cannot be negative")
+	}
+	cmd, err := n.writeCommand(op, req.Path, req.IfVersion, req.Token)
+	if err != nil {
+		return store.Command{}, err
+	}
+	cmd.Data, cmd.IfAbsent, cmd.Session, cmd.TTL = req.Body, req.IfAbsent, req.SessionID, req.TTL
+	return cmd, nil
+}
+
+// Check access and build the log command for a change to a path
+func (n *Node) writeCommand(op string, path string, ifVersion int, token string) (store.Command, error) {
+	path, err := store.CleanPath(path)
+	if err != nil {
+		return store.Command{}, err
+	}
+	principal, err := n.authorizePath(token, auth.PermWrite, path)
+	if err != nil {
+		return store.Command{}, err
+	}
+	if ifVersion < 0 {
+		return store.Command{}, fmt.Errorf("version cannot be negative")
+	}
+	cmd := store.NewCommand(op)
+	cmd.Path = path
+	cmd.IfVersion = ifVersion
+	cmd.Principal = principal.Name
+	return cmd, nil
+}
+
+// RPC: DeleteFile
+type DeleteFileRequest struct {
+	Path      string
+	IfVersion int // Optional, only delete if the file is at this version
+	Token     string
+	TraceID   string
+}
+type DeleteFileResponse struct {
+	TraceID  string
+	Slot     int
+	Version  int  // Current version on conflict
+	Conflict bool // IfVersion didn't match and nothing was deleted
+}
+
+func (s *ClientService) DeleteFile(req *DeleteFileRequest, res *DeleteFileResponse) (err error) {
+	n := s.node
+	span := n.startRequestSpan("DeleteFile", req.TraceID)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	res.TraceID = span.TraceID
+
+	cmd, err := n.writeCommand(store.OpDelete, req.Path, req.IfVersion, req.Token)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("client delete, running Paxos", "path", cmd.Path, "user", cmd.Principal, "trace_id", span.TraceID)
+
+	slot, result, err := n.proposeCommand(cmd, span.Context())
+	if err != nil {
+		return err
+	}
+	res.Slot, res.Version, res.Conflict = slot, result.Version, result.Conflict
+	return nil
+}
+
+// RPC: Txn - apply several file operations atomically
+type TxnRequest struct {
+	Ops       []store.TxnOp
+	SessionID string // Optional, files created by the transaction are ephemeral, existing ones keep their owner
+	Token     string
+	TraceID   string
+}
+type TxnResponse struct {
+	TraceID      string
+	Slot         int
+	Version      int    // Version of every written file, or the current version of ConflictPath
+	Conflict     bool   // A precondition failed and nothing was changed
+	ConflictPath string // Path whose precondition failed
+}
+
+// Most operations in one transaction
+const maxTxnOps = 64
+
+func (s *ClientService) Txn(req *TxnRequest, res *TxnResponse) (err error) {
+	n := s.node
+	span := n.startRequestSpan("Txn", req.TraceID)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	res.TraceID = span.TraceID
+
+	if len(req.Ops) == 0 || len(req.Ops) > maxTxnOps {
+		return fmt.Errorf("transaction must have 1 to %d operations", maxTxnOps)
+	}
+	cmd := store.NewCommand(store.OpTxn)
+	cmd.Session = req.SessionID
+	for _, op := range req.Ops {
+		perm := auth.PermWrite
+		switch op.Op {
+		case store.OpWrite, store.OpAppend, store.OpDelete:
+		case store.OpCheck:
+			perm = auth.PermRead
+		default:
+			return fmt.Errorf("unknown transaction operation %q", op.Op)
+		}
+		if op.IfVersion < 0 {
+			return fmt.Errorf("version cannot be negative")
+		}
+		if op.Path, err = store.CleanPath(op.Path); err != nil {
+			return err
+		}
+		principal, err := n.authorizePath(req.Token, perm, op.Path)
+		if err != nil {
+			return err
+		}
+		cmd.Principal = principal.Name
+		cmd.Ops = append(cmd.Ops, op)
+	}
+	n.logger.Info("client transaction, running Paxos", "ops", len(cmd.Ops), "user", cmd.Principal, "trace_id", span.TraceID)
+
+	slot, result, err := n.proposeCommand(cmd, span.Context())
+	if err != nil {
+		return err
+	}
+	res.Slot, res.Version, res.Conflict, res.ConflictPath = slot, result.Version, result.Conflict, result.ConflictPath
+	n.logger.Info("Paxos completed", "slot", slot, "conflict", result.Conflict)
+	return nil
+}
+
+// RPC: ReadFile
+type ReadFileRequest struct {
+	Path    string
+	Version int // Optional, read a retained older version
+	Token   string
+}
+
+type ReadFileResponse struct {
+	Data      string
+	Version   int
+	SessionID string    // Owning session of an ephemeral file
+	Expires   time.Time // Zero unless written with a TTL
+}
+
+func (s *ClientService) ReadFile(req *ReadFileRequest, res *ReadFileResponse) error {
+	n := s.node
+	path, err := store.CleanPath(req.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := n.authorizePath(req.Token, auth.PermRead, path); err != nil {
+		return err
+	}
+	g, err := n.route(path)
+	if err != nil {
+		return err
+	}
+
+	if req.Version != 0 {
+		revision, ok := g.store.ReadVersion(path, req.Version)
+		if !ok {
+			return fmt.Errorf("version %d of %s is not retained", req.Version, path)
+		}
+		if revision.Deleted {
+			return fmt.Errorf("file %s was deleted at version %d", path, req.Version)
+		}
+		res.Data, res.Version = revision.Data, revision.Version
+		return nil
+	}
+
+	file, ok := g.store.Read(path)
+	if !ok {
+		return fmt.Errorf("file %s does not exist", path)
+	}
+
+	n.logger.Info("read", "path", path, "data", file.Data)
+	res.Data = file.Data
+	res.Version = file.Version
+	res.SessionID = file.Session
+	if file.Expires != nil {
+		res.Expires = *file.Expires
+	}
+	return nil
+}
+
+// RPC: History
+type HistoryRequest struct {
+	Path  string
+	Token string
+}
+type HistoryResponse struct {
+	Revisions []store.Revision // Oldest first, without data
+}
+
+func (s *ClientService) History(req *HistoryRequest, res *HistoryResponse) error {
+	n := s.node
+	path, err := store.CleanPath(req.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := n.authorizePath(req.Token, auth.PermRead, path); err != nil {
+		return err
+	}
+	g, err := n.route(path)
+	if err != nil {
+		return err
+	}
+	res.Revisions = g.store.History(path)
+	if len(res.Revisions) == 0 {
+		return fmt.Errorf("file %s has no history", path)
+	}
+	for i := range res.Revisions {
+		res.Revisions[i].Data = ""
+	}
+	return nil
+}
+
+// RPC: Info
+type InfoRequest struct {
+	Token string
+}
+type InfoResponse struct {
+	Role       string   // See utils.NodeRoles
+	Engine     string   // Consensus engine
+	EngineInfo []string // Engine state, one line per component
+	LogInfo    string
+	Leader     int
+	Groups     []string // Shard groups this node is in, one line each
+}
+
+func (s *ClientService) Info(req *InfoRequest, res *InfoResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleReader); err != nil {
+		return err
+	}
+	status := n.engine.Status()
+	res.Role = n.role
+	res.Engine = status.Engine
+	res.EngineInfo = status.State
+	res.Leader = n.leader()
+	res.LogInfo = fmt.Sprintf("Log={Applied:%d, Files:%d, ACLs:%d}", n.store.Applied(), n.store.FileCount(), len(n.store.ACLs()))
+	if sharded() {
+		for _, g := range n.fileGroups() {
+			res.Groups = append(res.Groups, fmt.Sprintf("Group %d: Nodes=%v, Leader=%d, Log={Applied:%d, Files:%d}, Fences=%d",
+				g.id, g.members, n.groupLeader(g.members), g.store.Applied(), g.store.FileCount(), len(g.store.Fences())))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// node/leader.go
+
+package node
+
+import (
+	"time"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Most files deleted by one expiry entry
+const maxExpiryBatch = 100
+
+var errStopped = consensus.ErrStopped
+
+// RPC: Heartbeat - liveness for leader selection
+type HeartbeatRequest struct {
+	Id    int
+	Token string
+}
+type HeartbeatResponse struct {
+	Id int
+}
+
+// Checked against the sender's node certificate with TLS
+func (req HeartbeatRequest) SenderID() int { return req.Id }
+
+func (s *PeerService) Heartbeat(req *HeartbeatRequest, res *HeartbeatResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RolePeer); err != nil {
+		return err
+	}
+	// A stopped node shouldn't be leader
+	if n.faults.Stop.Load() {
+		return errStopped
+	}
+	res.Id = n.NodeID
+	return nil
+}
+
+// Ping neighbors and record which ones answered
+func (n *Node) heartbeat() {
+	for range time.Tick(utils.HeartbeatInterval) {
+		for addr, client := range n.neighbors() {
+			if addr == n.addrs.Peer {
+				continue
+			}
+			req := HeartbeatRequest{Id: n.NodeID, Token: utils.ClusterToken}
+			var res HeartbeatResponse
+			call := client.Go("Peer.Heartbeat", &req, &res, nil)
+			go func(addr string) {
+				select {
+				case <-call.Done:
+					if call.Error == nil {
+						n.leaderMu.Lock()
+						n.lastHeard[res.Id] = time.Now()
+						n.peers[res.Id] = addr
+						n.leaderMu.Unlock()
+					}
+				case <-time.After(utils.LeaderTimeout):
+				}
+			}(addr)
+		}
+	}
+}
+
+// The leader is the lowest numbered voter that answers heartbeats
+func (n *Node) isLeader() bool {
+	return n.leader() == n.NodeID
+}
+
+// Current leader as seen by this node
+func (n *Node) leader() int {
+	return n.lowestAlive(func(id int) bool { return roleOf(id) == consensus.RoleVoter })
+}
+
+// Lowest numbered node answering heartbeats among those eligible, this one
+// included unless it's stopped, 0 if there's none
+func (n *Node) lowestAlive(eligible func(id int) bool) int {
+	n.leaderMu.Lock()
+	defer n.leaderMu.Unlock()
+	leader := 0
+	if !n.faults.Stop.Load() && eligible(n.NodeID) {
+		leader = n.NodeID
+	}
+	for id, heard := range n.lastHeard {
+		if (leader == 0 || id < leader) && eligible(id) && time.Since(heard) < utils.LeaderTimeout {
+			leader = id
+		}
+	}
+	return leader
+}
+
+// On the leader of each group holding files, propose deletion of files
+// whose TTL ran out. Each delete only applies if the file wasn't rewritten
+// since.
+func (n *Node) expireFiles() {
+	for range time.Tick(utils.ExpirySweepInterval) {
+		if n.terminated.Load() {
+			continue
+		}
+		for _, g := range n.fileGroups() {
+			if g == n.meta && !n.isLeader() || g != n.meta && n.groupLeader(g.members) != n.NodeID {
+				continue
+			}
+			expired := g.store.ExpiredFiles(time.Now(), maxExpiryBatch)
+			if len(expired) == 0 {
+				continue
+			}
+			cmd := store.NewCommand(store.OpExpireFiles)
+			cmd.Ops = expired
+			cmd.Principal = "cluster"
+			if _, _, err := n.proposeTo(g, cmd, telemetry.SpanContext{}); err != nil {
+				n.logger.Warn("error expiring files", "group", g.id, "files", len(expired), "error", err)
+				continue
+			}
+			n.logger.Info("files expired", "group", g.id, "files", len(expired))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// node/lock.go
+
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// RPC: OpenSession - start a lease that locks are tied to
+type OpenSessionRequest struct {
+	TTL   time.Duration // Optional, SessionDefaultTTL if 0
+	Token string
+}
+type OpenSessionResponse struct {
+	SessionID string
+	TTL       time.Duration
+}
+
+func (s *ClientService) OpenSession(req *OpenSessionRequest, res *OpenSessionResponse) error {
+	n := s.node
+	principal, err := auth.Require(req.Token, auth.RoleWriter)
+	if err != nil {
+		return err
+	}
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = utils.SessionDefaultTTL
+	}
+	if ttl < utils.SessionMinTTL || ttl > utils.SessionMaxTTL {
+		return fmt.Errorf("session TTL must be between %v and %v", utils.SessionMinTTL, utils.SessionMaxTTL)
+	}
+
+	cmd := store.NewCommand(store.OpOpenSession)
+	cmd.TTL = ttl
+	cmd.Principal = principal.Name
+	if _, err := n.proposeSessionCommand(cmd); err != nil {
+		return err
+	}
+	n.logger.Info("session opened", "session", cmd.ID, "user", principal.Name, "ttl", ttl)
+	res.SessionID, res.TTL = cmd.ID, ttl
+	return nil
+}
+
+// RPC: KeepAlive - renew a session's lease
+type SessionRequest struct {
+	SessionID string
+	Token     string
+}
+type KeepAliveResponse struct {
+	TTL time.Duration
+}
+
+func (s *ClientService) KeepAlive(req *SessionRequest, res *KeepAliveResponse) error {
+	n := s.node
+	cmd, err := n.sessionCommand(store.OpKeepAlive, req.SessionID, req.Token)
+	if err != nil {
+		return err
+	}
+	if _, _, err := n.proposeWithRetry(cmd, telemetry.SpanContext{}, keepAliveRetry); err != nil {
+		return err
+	}
+	if session, ok := n.store.Session(req.SessionID); ok {
+		res.TTL = session.TTL
+	}
+	return nil
+}
+
+// RPC: CloseSession - end a session and release its locks
+type CloseSessionResponse struct{}
+
+func (s *ClientService) CloseSession(req *SessionRequest, res *CloseSessionResponse) error {
+	n := s.node
+	cmd, err := n.sessionCommand(store.OpCloseSession, req.SessionID, req.Token)
+	if err != nil {
+		return err
+	}
+	cmd.Groups = n.sessionGroups()
+	_, err = n.proposeSessionCommand(cmd)
+	return err
+}
+
+// RPC: Acquire - take a named lock for a session without waiting
+type LockRequest struct {
+	SessionID string
+	Name      string
+	Token     string
+}
+type AcquireResponse struct {
+	Acquired     bool
+	FencingToken int    // Log index of the acquisition, increases with every new holder
+	Holder       string // Owner of the lock if not acquired
+}
+
+func (s *ClientService) Acquire(req *LockRequest, res *AcquireResponse) error {
+	n := s.node
+	if req.Name == "" {
+		return fmt.Errorf("lock name cannot be empty")
+	}
+	cmd, err := n.sessionCommand(store.OpLock, req.SessionID, req.Token)
+	if err != nil {
+		return err
+	}
+	cmd.Lock = req.Name
+	result, err := n.proposeSessionCommand(cmd)
+	if err != nil {
+		return err
+	}
+	res.Acquired = !result.Conflict
+	res.FencingToken, res.Holder = result.Version, result.Holder
+	n.logger.Info("lock acquire", "lock", req.Name, "session", req.SessionID, "acquired", res.Acquired, "fencing_token", result.Version)
+	return nil
+}
+
+// RPC: Release
+type ReleaseResponse struct{}
+
+func (s *ClientService) Release(req *LockRequest, res *ReleaseResponse) error {
+	n := s.node
+	cmd, err := n.sessionCommand(store.OpUnlock, req.SessionID, req.Token)
+	if err != nil {
+		return err
+	}
+	cmd.Lock = req.Name
+	_, err = n.proposeSessionCommand(cmd)
+	return err
+}
+
+// RPC: Locks - held locks, so resources can check fencing tokens
+type LocksRequest struct {
+	Token string
+}
+type LocksResponse struct {
+	Locks []store.Lock
+}
+
+func (s *ClientService) Locks(req *LocksRequest, res *LocksResponse) error {
+	if _, err := auth.Require(req.Token, auth.RoleReader); err != nil {
+		return err
+	}
+	if err := s.node.checkStoresFiles(); err != nil {
+		return err
+	}
+	res.Locks = s.node.store.Locks()
+	return nil
+}
+
+// Check the caller and build a command for an existing session
+func (n *Node) sessionCommand(op string, sessionID string, token string) (store.Command, error) {
+	principal, err := auth.Require(token, auth.RoleWriter)
+	if err != nil {
+		return store.Command{}, err
+	}
+	if sessionID == "" {
+		return store.Command{}, fmt.Errorf("session ID cannot be empty")
+	}
+	cmd := store.NewCommand(op)
+	cmd.Session = sessionID
+	cmd.Principal = principal.Name
+	return cmd, nil
+}
+
+// Propose a session or lock command
+func (n *Node) proposeSessionCommand(cmd store.Command) (store.Result, error) {
+	_, result, err := n.proposeWithRetry(cmd, telemetry.SpanContext{}, defaultRetry)
+	return result, err
+}
+
+// On the leader, propose the expiry of sessions whose lease ran out. An
+// expiry only applies if the session wasn't renewed in the meantime.
+func (n *Node) expireSessions() {
+	for range time.Tick(utils.ExpirySweepInterval) {
+		if n.terminated.Load() || !n.isLeader() {
+			continue
+		}
+		for _, session := range n.store.ExpiredSessions(time.Now()) {
+			cmd := store.NewCommand(store.OpExpireSession)
+			cmd.Session = session.ID
+			cmd.IfVersion = session.Version
+			cmd.Groups = n.sessionGroups()
+			cmd.Principal = "cluster"
+			_, result, err := n.proposeCommand(cmd, telemetry.SpanContext{})
+			if err != nil {
+				n.logger.Warn("error expiring session", "session", session.ID, "error", err)
+				continue
+			}
+			if !result.Conflict {
+				n.logger.Info("session expired", "session", session.ID, "owner", session.Owner)
+			}
+		}
+		n.deleteEndedSessionFiles()
+	}
+}
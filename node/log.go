@@ -0,0 +1,159 @@
+// node/log.go
+
+package node
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+)
+
+// How long a client request waits for its chosen command to be applied
+const applyTimeout = 10 * time.Second
+
+// Apply entries to a group's store as its engine commits them. Indexes
+// count the entries applied here, EPaxos orders commands that don't
+// interfere differently on different nodes.
+func (n *Node) applyCommitted(g *group) {
+	for entry := range g.engine.Committed() {
+		n.logMu.Lock()
+		results, err := g.store.Apply(entry.Index, entry.Command)
+		n.notifyWaiters(entry.Index, results)
+		n.logMu.Unlock()
+		if err != nil {
+			n.logger.Error("error applying log entry", "group", g.id, "slot", entry.Index, "error", err)
+			continue
+		}
+		n.logger.Info("applied log entry", "group", g.id, "slot", entry.Index, "commands", len(results))
+	}
+}
+
+// Hand results to the requests waiting for them, logMu must be held
+func (n *Node) notifyWaiters(slot int, results []store.Result) {
+	for _, res := range results {
+		if waiter, ok := n.waiters[res.ID]; ok {
+			waiter <- applied{slot: slot, result: res}
+			delete(n.waiters, res.ID)
+		}
+	}
+}
+
+// Result of applying a command proposed by this node
+type applied struct {
+	slot   int
+	result store.Result
+}
+
+// Hand a command to the consensus engine of the group serving its paths,
+// returns once it's committed
+func (n *Node) submit(cmd store.Command, parent telemetry.SpanContext) error {
+	if err := n.checkStoresFiles(); err != nil {
+		return err
+	}
+	g, err := n.groupFor(cmd)
+	if err != nil {
+		return err
+	}
+	if g != n.meta && cmd.Session != "" {
+		cmd.Group = g.id
+	}
+	return n.submitTo(g, cmd, parent)
+}
+
+func (n *Node) submitTo(g *group, cmd store.Command, parent telemetry.SpanContext) error {
+	return g.engine.Propose(consensus.Proposal{Command: cmd.Encode(), Keys: cmd.Keys(), Parent: parent})
+}
+
+// Propose a command and wait until it's applied locally
+func (n *Node) proposeCommand(cmd store.Command, parent telemetry.SpanContext) (int, store.Result, error) {
+	waiter := n.wait(cmd.ID)
+	if err := n.submit(cmd, parent); err != nil {
+		n.cancelWait(cmd.ID)
+		return 0, store.Result{}, err
+	}
+	return n.awaitApplied(cmd.ID, waiter)
+}
+
+// proposeCommand in a given group
+func (n *Node) proposeTo(g *group, cmd store.Command, parent telemetry.SpanContext) (int, store.Result, error) {
+	waiter := n.wait(cmd.ID)
+	if err := n.submitTo(g, cmd, parent); err != nil {
+		n.cancelWait(cmd.ID)
+		return 0, store.Result{}, err
+	}
+	return n.awaitApplied(cmd.ID, waiter)
+}
+
+// How often and how long proposeWithRetry waits for another try
+type retryPolicy struct {
+	attempts           int
+	minDelay, maxDelay time.Duration // Randomized delay between attempts
+}
+
+// Client requests can wait out a contended slot
+var defaultRetry = retryPolicy{attempts: 5, minDelay: time.Second, maxDelay: 5 * time.Second}
+
+// Keepalives come every third of a session's TTL and must renew it before it
+// runs out, their retries sleep 1.5s at most, well within SessionMinTTL
+var keepAliveRetry = retryPolicy{attempts: 4, minDelay: 100 * time.Millisecond, maxDelay: 500 * time.Millisecond}
+
+// proposeCommand, retrying with a randomized delay when another proposal
+// wins. A command is applied at most once even if an earlier attempt is
+// chosen later.
+func (n *Node) proposeWithRetry(cmd store.Command, parent telemetry.SpanContext, retry retryPolicy) (int, store.Result, error) {
+	// Routing errors don't go away by retrying here
+	if _, err := n.groupFor(cmd); err != nil {
+		return 0, store.Result{}, err
+	}
+	waiter := n.wait(cmd.ID)
+	var err error
+	for attempt := 0; attempt < retry.attempts; attempt++ {
+		if attempt > 0 {
+			n.logger.Info("retrying", "attempt", attempt, "max_retries", retry.attempts)
+			// Randomized delay
+			delay := retry.minDelay + time.Duration(rand.Int63n(int64(retry.maxDelay-retry.minDelay)+1))
+			time.Sleep(delay)
+		}
+
+		if err = n.submit(cmd, parent); err == nil {
+			return n.awaitApplied(cmd.ID, waiter)
+		}
+	}
+
+	n.cancelWait(cmd.ID)
+	n.logger.Error("Paxos failed", "attempts", retry.attempts, "error", err)
+	return 0, store.Result{}, fmt.Errorf("could not achieve consensus after %d attempts: %v", retry.attempts, err)
+}
+
+// Register for the result of a command before it's proposed
+func (n *Node) wait(id string) chan applied {
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	waiter := make(chan applied, 1)
+	n.waiters[id] = waiter
+	return waiter
+}
+
+func (n *Node) cancelWait(id string) {
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	delete(n.waiters, id)
+}
+
+// Wait for a chosen command to be applied, earlier slots may still be catching up
+func (n *Node) awaitApplied(id string, waiter chan applied) (int, store.Result, error) {
+	select {
+	case a := <-waiter:
+		if a.result.Error != "" {
+			return a.slot, a.result, fmt.Errorf("%s", a.result.Error)
+		}
+		return a.slot, a.result, nil
+	case <-time.After(applyTimeout):
+		n.cancelWait(id)
+		return 0, store.Result{}, fmt.Errorf("command chosen but not applied within %v", applyTimeout)
+	}
+}
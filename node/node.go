@@ -3,333 +3,358 @@
 package node
 
 import (
-	"encoding/json"
 	"fmt"
-	"math/rand"
+	"log/slog"
 	"net"
 	"net/rpc"
 	"os"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/epaxos"
+	"github.com/derekjtong/mini-cloud/logging"
 	"github.com/derekjtong/mini-cloud/paxos"
+	"github.com/derekjtong/mini-cloud/raft"
+	"github.com/derekjtong/mini-cloud/shard"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/transport"
 	"github.com/derekjtong/mini-cloud/utils"
 )
 
+// Where a node serves each RPC service. Empty peer and admin addresses
+// share the client address.
+type Addresses struct {
+	Client string
+	Peer   string
+	Admin  string
+}
+
 type Node struct {
 	addr          string
+	addrs         Addresses
 	NodeID        int
-	rpcClients    map[string]*rpc.Client
-	NeighborNodes []string
-	proposer      *paxos.Proposer
-	acceptor      *paxos.Acceptor
-	terminated    bool
-	stop          bool
+	role          string // See utils.NodeRoles
+	neighborsMu   sync.RWMutex
+	rpcClients    map[string]*rpc.Client // Neighbors by peer address, guarded by neighborsMu
+	NeighborNodes []string               // Guarded by neighborsMu
+	engine        consensus.Engine
+	faults        consensus.Faults
+	store         *store.Store
+	meta          *group                  // Group 0: engine and store above
+	groups        map[int]*group          // Shard groups this node is in by ID, see utils.ShardGroups
+	initial       shard.Map               // Shard map before group 0 first changes it
+	logMu         sync.Mutex              // Guards applying entries to store
+	waiters       map[string]chan applied // Proposed command IDs awaiting their result, guarded by logMu
+	leaderMu      sync.Mutex
+	lastHeard     map[int]time.Time // Last heartbeat answer by node ID, guarded by leaderMu
+	peers         map[int]string    // Peer address by node ID, from SetNeighbors and heartbeats, guarded by leaderMu
+	terminated    atomic.Bool
+	logger        *slog.Logger
+	tracer        *telemetry.Tracer
 }
 
-func NewNode(nodeID int, addr string) (*Node, error) {
-	if addr == "" {
+func NewNode(nodeID int, addrs Addresses) (*Node, error) {
+	if addrs.Client == "" {
 		return nil, fmt.Errorf("address cannot be empty")
 	}
+	if addrs.Peer == "" {
+		addrs.Peer = addrs.Client
+	}
+	if addrs.Admin == "" {
+		addrs.Admin = addrs.Client
+	}
+
+	logger, err := logging.NewNodeLogger(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("creating logger: %v", err)
+	}
+
+	tracer, err := telemetry.NewNodeTracer(nodeID, logger)
+	if err != nil {
+		return nil, fmt.Errorf("creating tracer: %v", err)
+	}
+
+	voters, err := configuredVoters()
+	if err != nil {
+		return nil, fmt.Errorf("invalid node roles: %v", err)
+	}
+	initial, err := initialShards()
+	if err != nil {
+		return nil, fmt.Errorf("invalid sharding: %v", err)
+	}
 
-	acceptor := paxos.NewAcceptor(nodeID)
-	return &Node{
+	n := &Node{
 		NodeID:        nodeID,
-		addr:          addr,
+		role:          roleOf(nodeID),
+		addr:          addrs.Client,
+		addrs:         addrs,
 		rpcClients:    make(map[string]*rpc.Client),
 		NeighborNodes: make([]string, 0),
-		acceptor:      acceptor,
-		stop:          false,
-		// proposer initialized under SetNeighbors
-	}, nil
+		waiters:       make(map[string]chan applied),
+		lastHeard:     make(map[int]time.Time),
+		peers:         make(map[int]string),
+		groups:        make(map[int]*group),
+		initial:       initial,
+		store:         store.New(fmt.Sprintf("./node_data/node_data_%s.json", addrs.Client), store.Retention{MaxVersions: utils.HistoryMaxVersions, MaxAge: utils.HistoryMaxAge}),
+		logger:        logger,
+		tracer:        tracer,
+	}
+	cfg := consensus.Config{
+		ID:        nodeID,
+		NodeCount: utils.NodeCount,
+		Role:      n.role,
+		Voters:    voters,
+		Addr:      addrs.Peer,
+		Token:     utils.ClusterToken,
+		Faults:    &n.faults,
+		Leader:    n.leaderAddr,
+		Batch:     batchCommands,
+		Logger:    logger,
+		Tracer:    tracer,
+	}
+	switch utils.ConsensusEngine {
+	case consensus.EnginePaxos:
+		n.engine, err = paxos.NewEngine(cfg)
+		if err != nil {
+			return nil, err
+		}
+	case consensus.EngineEPaxos:
+		n.engine = epaxos.NewReplica(cfg)
+		n.store.UseKeyVersions()
+	case consensus.EngineRaft:
+		n.engine = raft.New(cfg)
+	default:
+		return nil, fmt.Errorf("unknown consensus engine %q", utils.ConsensusEngine)
+	}
+	n.meta = &group{members: voters, engine: n.engine, store: n.store}
+	go n.applyCommitted(n.meta)
+	if err := n.startGroups(cfg); err != nil {
+		return nil, err
+	}
+	return n, nil
 }
 
 // Start
 func (n *Node) Start() {
 	fsDir := "./node_data/"
 	if err := os.MkdirAll(fsDir, 0755); err != nil {
-		fmt.Printf("[Node %d]: Error creating file system directory: %v\n", n.NodeID, err)
+		n.logger.Error("error creating file system directory", "dir", fsDir, "error", err)
 		return
 	}
 	if !utils.MinimalStartUpLogging {
-		fmt.Printf("[Node %d]: Creating directory %s\n", n.NodeID, fsDir)
+		n.logger.Info("creating directory", "dir", fsDir)
 	}
 
-	listener, err := net.Listen("tcp", n.addr)
-	if err != nil {
-		fmt.Printf("[Node %d]: Error starting RPC server on %s: %v\n", n.NodeID, n.addr, err)
+	client := &ClientService{node: n}
+	peer := &PeerService{node: n}
+	admin := &AdminService{node: n}
+
+	if n.addrs.Peer == n.addr && n.addrs.Admin == n.addr {
+		n.serveShared(client, peer, admin)
 		return
 	}
 
-	defer listener.Close()
-
-	rpcServer := rpc.NewServer()
-	err = rpcServer.Register(n)
+	// Separate listeners, one service each
+	peerListener, err := transport.ListenPeer(n.addrs.Peer, n.NodeID)
+	if err != nil {
+		n.logger.Error("error starting RPC server", "service", "Peer", "addr", n.addrs.Peer, "error", err)
+		return
+	}
+	adminListener, err := transport.Listen(n.addrs.Admin, n.NodeID)
 	if err != nil {
-		fmt.Printf("[Node %d]: Error registering RPC server: %v\n", n.NodeID, err)
+		n.logger.Error("error starting RPC server", "service", "Admin", "addr", n.addrs.Admin, "error", err)
 		return
 	}
+	clientListener, err := transport.Listen(n.addr, n.NodeID)
+	if err != nil {
+		n.logger.Error("error starting RPC server", "service", "Client", "addr", n.addr, "error", err)
+		return
+	}
+	go transport.ServePeers(n.newServer(peer), peerListener)
+	go n.newServer(admin).Accept(adminListener)
 	if !utils.MinimalStartUpLogging {
-		fmt.Printf("[Node %d]: Starting RPC server on %s\n", n.NodeID, n.addr)
+		n.logger.Info("starting RPC servers", "client", n.addr, "peer", n.addrs.Peer, "admin", n.addrs.Admin)
 	}
-	rpcServer.Accept(listener)
+	n.newServer(client).Accept(clientListener)
 }
 
-// RPC: Ping
-type PingRequest struct{}
-type PingResponse struct {
-	Message string
-	NodeID  int
-}
+// Serve all services on one listener. With TLS, connections authenticated
+// with a node certificate only reach the Peer service, as the node they
+// authenticated as, and everyone else only reaches Client and Admin. Without
+// TLS all services are reachable and Peer relies on the cluster token.
+func (n *Node) serveShared(client *ClientService, peer *PeerService, admin *AdminService) {
+	listener, err := transport.Listen(n.addr, n.NodeID)
+	if err != nil {
+		n.logger.Error("error starting RPC server", "addr", n.addr, "error", err)
+		return
+	}
 
-func (n *Node) Ping(req *PingRequest, res *PingResponse) error {
-	fmt.Printf("[Node %d]: Pinged\n", n.NodeID)
-	res.Message = "Pong from node " + strconv.Itoa(n.NodeID)
-	res.NodeID = n.NodeID
-	return nil
-}
+	defer listener.Close()
 
-// PRC: SetNeighbors
-type SetNeighborsRequest struct {
-	Neighbors []string
-}
-type SetNeighborsResponse struct {
-}
+	if !utils.MinimalStartUpLogging {
+		n.logger.Info("starting RPC server", "addr", n.addr)
+	}
+	if !utils.TLSEnabled {
+		n.newServer(client, peer, admin).Accept(listener)
+		return
+	}
 
-// Update node's list of neighbors
-func (n *Node) SetNeighbors(req *SetNeighborsRequest, res *SetNeighborsResponse) error {
-	n.NeighborNodes = req.Neighbors
-	for _, neighbor := range req.Neighbors {
-		// Check to not include node's own IP address
-		// if neighbor != n.addr && n.rpcClients[neighbor] == nil {
-		client, err := rpc.Dial("tcp", neighbor)
+	peerServer := n.newServer(peer)
+	publicServer := n.newServer(client, admin)
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("[Node %d]: Error connecting to neighbor at %s: %v\n", n.NodeID, neighbor, err)
-			continue
+			n.logger.Error("error accepting connection", "error", err)
+			return
 		}
-		n.rpcClients[neighbor] = client
-		// }
-	}
-	fmt.Printf("[Node %d]: Set neighbors\n", n.NodeID)
-
-	// Initialize proposer
-	n.proposer = paxos.NewProposer(n.NodeID, n.NodeID, n.rpcClients)
-
-	return nil
-}
-
-// RPC: Health Check
-type HealthCheckRequest struct{}
-type HealthCheckResponse struct {
-	Status string
-}
-
-func (n *Node) HealthCheck(req *HealthCheckRequest, res *HealthCheckResponse) error {
-	res.Status = "OK"
-	return nil
-}
-
-// RPC: WriteFile
-type WriteFileRequest struct {
-	Body string
-}
-type WriteFileResponse struct {
-}
-
-func (n *Node) WriteFile(req *WriteFileRequest, res *WriteFileResponse) error {
-	fmt.Printf("[Node %d]: Client trying to write %s, running Paxos...\n", n.NodeID, req.Body)
-	fmt.Printf("--------------------\n")
-
-	err := n.proposer.Propose(req.Body)
-	if err != nil {
-		return err
+		go func(conn net.Conn) {
+			if transport.IsNodeConn(conn) {
+				transport.ServePeer(peerServer, conn)
+			} else {
+				publicServer.ServeConn(conn)
+			}
+		}(conn)
 	}
-
-	fmt.Printf("[Node %d]: Paxos completed\n", n.NodeID)
-	fmt.Printf("--------------------\n")
-	return nil
 }
 
-// RPC: ForceWrite - WriteFile with retry
-func (n *Node) ForceWrite(req *WriteFileRequest, res *WriteFileResponse) error {
-	fmt.Printf("[Node %d]: Client trying to write %s, running Paxos...\n", n.NodeID, req.Body)
-	fmt.Printf("--------------------\n")
-
-	const maxRetries = 5
-	var err error
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			fmt.Printf("[Node %d]: Retrying attempt %d/%d\n", n.NodeID, attempt, maxRetries)
-			// Randomized delay
-			r := rand.Intn(5-1+1) + 1
-			time.Sleep(time.Duration(r) * time.Second)
+// RPC server with the given services registered under their names. The
+// consensus engines' services come with the Peer service.
+func (n *Node) newServer(services ...any) *rpc.Server {
+	server := rpc.NewServer()
+	for _, service := range services {
+		var err error
+		switch s := service.(type) {
+		case *ClientService:
+			err = server.RegisterName("Client", s)
+		case *PeerService:
+			err = server.RegisterName("Peer", s)
+			if err == nil {
+				err = server.RegisterName(n.engine.Service())
+			}
+			for _, g := range n.groups {
+				if err == nil {
+					err = server.RegisterName(g.engine.Service())
+				}
+			}
+		case *AdminService:
+			err = server.RegisterName("Admin", s)
 		}
-
-		err = n.proposer.Propose(req.Body)
-		if err == nil {
-			fmt.Printf("[Node %d]: Paxos completed successfully\n", n.NodeID)
-			fmt.Printf("--------------------\n")
-			return nil
+		if err != nil {
+			n.logger.Error("error registering RPC service", "error", err)
 		}
 	}
-
-	fmt.Printf("[Node %d]: Paxos failed after %d attempts: %v\n", n.NodeID, maxRetries, err)
-	fmt.Printf("--------------------\n")
-	return fmt.Errorf("could not achieve consensus after %d attempts: %v", maxRetries, err)
+	return server
 }
 
-func (n *Node) writeFileToLocal(data string) error {
-	filePath := fmt.Sprintf("./node_data/node_data_%s.json", n.addr)
-	// file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666) //Append
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666) // Overwrite
-	if err != nil {
-		return err
+// Connections to the neighbors by peer address, including this node
+func (n *Node) neighbors() map[string]*rpc.Client {
+	n.neighborsMu.RLock()
+	defer n.neighborsMu.RUnlock()
+	clients := make(map[string]*rpc.Client, len(n.rpcClients))
+	for addr, client := range n.rpcClients {
+		clients[addr] = client
 	}
-	defer file.Close()
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(data); err != nil {
-		return err
-	}
-	return nil
-}
-
-// RPC: ReadFile
-type ReadFileRequest struct {
+	return clients
 }
 
-type ReadFileResponse struct {
-	Data string
-}
-
-func (n *Node) ReadFile(req *ReadFileRequest, res *ReadFileResponse) error {
-	filePath := fmt.Sprintf("./node_data/node_data_%s.json", n.addr)
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	var data string
-	if err := decoder.Decode(&data); err != nil {
-		return err
+// Role of a node from utils.NodeRoles
+func roleOf(id int) string {
+	if role, ok := utils.NodeRoles[id]; ok {
+		return role
 	}
-
-	fmt.Printf("[Node %d]: Read %s\n", n.NodeID, data)
-	res.Data = data
-	return nil
+	return consensus.RoleVoter
 }
 
-// RPC: Prepare
-func (n *Node) Prepare(req *paxos.PrepareRequest, res *paxos.PrepareResponse) error {
-	if n.stop {
-		return nil
+// IDs of the nodes that vote, after checking every role is known and only
+// the paxos engine is given witnesses or learners. Some node must be a
+// voter to lead.
+func configuredVoters() ([]int, error) {
+	for id, role := range utils.NodeRoles {
+		if id < 1 || id > utils.NodeCount {
+			return nil, fmt.Errorf("role given for unknown node %d", id)
+		}
+		switch role {
+		case consensus.RoleVoter:
+		case consensus.RoleWitness, consensus.RoleLearner:
+			if utils.ConsensusEngine != consensus.EnginePaxos {
+				return nil, fmt.Errorf("node %d is a %s, which needs the %s engine", id, role, consensus.EnginePaxos)
+			}
+		default:
+			return nil, fmt.Errorf("node %d has unknown role %q", id, role)
+		}
 	}
-	fmt.Printf("    node %d: received - %#v\n", n.NodeID, req)
-	*res = n.acceptor.Prepare(req.Proposal)
-	return nil
-}
-
-// RPC: Accept
-func (n *Node) Accept(req *paxos.AcceptRequest, res *paxos.AcceptResponse) error {
-	if n.stop {
-		return nil
+	var voters []int
+	leaders := 0
+	for id := 1; id <= utils.NodeCount; id++ {
+		switch roleOf(id) {
+		case consensus.RoleVoter:
+			leaders++
+			voters = append(voters, id)
+		case consensus.RoleWitness:
+			voters = append(voters, id)
+		}
 	}
-	fmt.Printf("    node %d: received - %#v\n", n.NodeID, req)
-
-	*res = n.acceptor.Accept(req.Proposal, req.Value)
-	n.acceptor.AcceptedValue = req.Value
-	if res.OK {
-		fmt.Printf("[Node %d]: ACCEPTOR - Wrote %s\n", n.NodeID, req.Value)
-		n.writeFileToLocal(req.Value)
+	if leaders == 0 {
+		return nil, fmt.Errorf("no node is a %s", consensus.RoleVoter)
 	}
-	return nil
-}
-
-// RPC: Info
-type InfoRequest struct{}
-type InfoResponse struct {
-	ProposerInfo string
-	AcceptorInfo string
+	return voters, nil
 }
 
-func (n *Node) Info(req *InfoRequest, res *InfoResponse) error {
-	// Not used because too verbose: will print out *rpc.Clients map
-	// res.AcceptorInfo = fmt.Sprintf("%#v\n", n.acceptor)
-	// res.ProposerInfo = fmt.Sprintf("%#v\n", n.proposer)
-
-	res.AcceptorInfo = fmt.Sprintf("Acceptor={PromisedProposal:%d, AcceptedProposal:%d, AcceptedValue:\"%s\"}", n.acceptor.PromisedProposal, n.acceptor.AcceptedProposal, n.acceptor.AcceptedValue)
-	res.ProposerInfo = fmt.Sprintf("Proposer={ProposalNumber:%d, Value:\"%s\", HighestAcceptedProposalNumber:%d, HighestAcceptedValue:%s}", n.proposer.ProposalNumber, n.proposer.Value, n.proposer.HighestAcceptedProposalNumber, n.proposer.HighestAcceptedValue)
+// Refuse client requests on a witness, which has no files to serve
+func (n *Node) checkStoresFiles() error {
+	if n.role == consensus.RoleWitness {
+		return fmt.Errorf("node %d is a witness and stores no files", n.NodeID)
+	}
 	return nil
 }
 
-// RPC: Toggletimeout
-type TimeoutRequest struct{}
-type TimeoutResponse struct {
-	IsTimeout bool
+// Peer address of the leader, empty if it's this node or unknown
+func (n *Node) leaderAddr() string {
+	return n.remoteAddr(n.leader())
 }
 
-func (n *Node) ToggleTimeout(req *TimeoutRequest, res *TimeoutResponse) error {
-	if n.proposer.Timeout {
-		n.proposer.Timeout = false
-	} else {
-		n.proposer.Timeout = true
+// Peer address of another node, empty for this node or one not known
+func (n *Node) remoteAddr(id int) string {
+	if id == 0 || id == n.NodeID {
+		return ""
 	}
-
-	res.IsTimeout = n.proposer.Timeout
-	fmt.Printf("[Node %d]: Timeout ", n.NodeID)
-	if n.proposer.Timeout {
-		fmt.Printf("on\n")
-	} else {
-		fmt.Printf("off\n")
-	}
-	return nil
-}
-
-// RPC: Ping
-type StopRequest struct{}
-type StopResponse struct {
-	IsStopped bool
+	n.leaderMu.Lock()
+	defer n.leaderMu.Unlock()
+	return n.peers[id]
 }
 
-func (n *Node) ToggleStop(req *StopRequest, res *StopResponse) error {
-	n.stop = !n.stop
-	fmt.Printf("[Node %d]: Client toggled stop, ", n.NodeID)
-	if n.stop {
-		fmt.Printf("server will no longer respond to Paxos\n")
-	} else {
-		fmt.Printf("server will respond to Paxos\n")
-	}
-	res.IsStopped = n.stop
-	return nil
+// Several encoded commands as one batch command
+func batchCommands(commands []string) (string, error) {
+	batch := store.NewCommand(store.OpBatch)
+	for _, command := range commands {
+		cmd, err := store.DecodeCommand(command)
+		if err != nil {
+			return "", err
+		}
+		batch.Batch = append(batch.Batch, cmd)
+	}
+	return batch.Encode(), nil
 }
 
-// RPC: Terminate
-type TerminateRequest struct{}
-type TerminateResponse struct{}
-
-func (n *Node) Terminate(req *TerminateRequest, res *TerminateResponse) error {
-	fmt.Printf("[Node %d]: Terminate method called\n", n.NodeID)
-
-	// Avoid repeated termination
-	if n.terminated {
-		return nil
+// Authenticate and check the replicated ACLs for a path
+func (n *Node) authorizePath(token string, perm string, path string) (auth.Principal, error) {
+	principal, err := auth.Authenticate(token)
+	if err != nil {
+		return principal, err
 	}
-
-	// Set termination flag
-	n.terminated = true
-
-	// Only send Terminate RPC to neighbors
-	for neighborAddr, client := range n.rpcClients {
-		if neighborAddr != n.addr {
-			var terminateRequest TerminateRequest
-			var terminateResponse TerminateResponse
-			if err := client.Call("Node.Terminate", &terminateRequest, &terminateResponse); err != nil {
-				fmt.Printf("[Node %d]: Error calling Terminate RPC method to %s: %v\n", n.NodeID, neighborAddr, err)
-			}
-		}
+	if err := n.checkStoresFiles(); err != nil {
+		return principal, err
 	}
+	return principal, auth.CheckPath(principal, perm, path, n.store.ACLs())
+}
 
-	os.Exit(0)
-	return nil
+// Start a span for a client request, continuing the client's trace if given
+func (n *Node) startRequestSpan(name string, traceID string) *telemetry.Span {
+	span := n.tracer.Start(telemetry.SpanContext{TraceID: traceID}, name, telemetry.KindServer)
+	span.SetAttr("node.id", n.NodeID)
+	return span
 }
@@ -0,0 +1,48 @@
+package node
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Witnesses vote and learners don't, roles need the paxos engine and a
+// voter to lead
+func TestConfiguredVoters(t *testing.T) {
+	roles, count, engine := utils.NodeRoles, utils.NodeCount, utils.ConsensusEngine
+	t.Cleanup(func() { utils.NodeRoles, utils.NodeCount, utils.ConsensusEngine = roles, count, engine })
+	utils.NodeCount, utils.ConsensusEngine = 4, consensus.EnginePaxos
+
+	utils.NodeRoles = map[int]string{3: consensus.RoleWitness, 4: consensus.RoleLearner}
+	if voters, err := configuredVoters(); err != nil || !slices.Equal(voters, []int{1, 2, 3}) {
+		t.Errorf("got voters %v, error %v, want 1 2 3", voters, err)
+	}
+	for _, bad := range []map[int]string{
+		{1: consensus.RoleWitness, 2: consensus.RoleLearner, 3: consensus.RoleWitness, 4: consensus.RoleLearner},
+		{5: consensus.RoleWitness},
+		{2: "observer"},
+	} {
+		utils.NodeRoles = bad
+		if voters, err := configuredVoters(); err == nil {
+			t.Errorf("roles %v: got voters %v, want an error", bad, voters)
+		}
+	}
+	utils.NodeRoles, utils.ConsensusEngine = map[int]string{4: consensus.RoleLearner}, consensus.EngineRaft
+	if _, err := configuredVoters(); err == nil {
+		t.Errorf("learner accepted with the %s engine", consensus.EngineRaft)
+	}
+}
+
+// A witness stores no files, so it refuses client requests
+func TestWitnessServesNoFiles(t *testing.T) {
+	n := &Node{NodeID: 3, role: consensus.RoleWitness}
+	if err := n.checkStoresFiles(); err == nil {
+		t.Errorf("witness serves files")
+	}
+	n.role = consensus.RoleLearner
+	if err := n.checkStoresFiles(); err != nil {
+		t.Errorf("learner refuses to serve files: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+// node/peer.go
+
+package node
+
+import (
+	"github.com/derekjtong/mini-cloud/auth"
+)
+
+// Traffic between nodes outside the consensus engine
+type PeerService struct {
+	node *Node
+}
+
+// RPC: Terminate - propagated from a neighbor being shut down
+func (s *PeerService) Terminate(req *TerminateRequest, res *TerminateResponse) error {
+	if _, err := auth.Require(req.Token, auth.RolePeer); err != nil {
+		return err
+	}
+	s.node.terminate()
+	return nil
+}
@@ -0,0 +1,410 @@
+// node/shard.go
+
+package node
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/paxos"
+	"github.com/derekjtong/mini-cloud/shard"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Consensus group this node runs, with the state its log builds
+type group struct {
+	id      int
+	members []int // Node IDs
+	engine  consensus.Engine
+	store   *store.Store
+}
+
+func sharded() bool {
+	return len(utils.ShardGroups) > 0
+}
+
+// Shard map from utils, after checking every group's nodes exist
+func initialShards() (shard.Map, error) {
+	if !sharded() {
+		return shard.Map{}, nil
+	}
+	if utils.ConsensusEngine != consensus.EnginePaxos {
+		return shard.Map{}, fmt.Errorf("sharding needs the %s engine", consensus.EnginePaxos)
+	}
+	if len(utils.NodeRoles) > 0 {
+		return shard.Map{}, fmt.Errorf("node roles can't be combined with sharding")
+	}
+	for i, nodes := range utils.ShardGroups {
+		for _, id := range nodes {
+			if id < 1 || id > utils.NodeCount {
+				return shard.Map{}, fmt.Errorf("shard group %d has unknown node %d", i+1, id)
+			}
+		}
+	}
+	return shard.Initial(utils.ShardBy, utils.ShardGroups, utils.ShardSplits)
+}
+
+// Start the engines of the shard groups this node is in
+func (n *Node) startGroups(cfg consensus.Config) error {
+	for id, members := range n.initial.Groups {
+		if !slices.Contains(members, n.NodeID) {
+			continue
+		}
+		path := fmt.Sprintf("./node_data/node_data_%s_group_%d.json", n.addrs.Client, id)
+		g := &group{id: id, members: members, store: store.New(path, store.Retention{MaxVersions: utils.HistoryMaxVersions, MaxAge: utils.HistoryMaxAge})}
+		cfg := cfg
+		cfg.Group, cfg.Voters = id, members
+		cfg.Leader = func() string { return n.remoteAddr(n.groupLeader(g.members)) }
+		engine, err := paxos.NewEngine(cfg)
+		if err != nil {
+			return fmt.Errorf("shard group %d: %v", id, err)
+		}
+		g.engine = engine
+		n.groups[id] = g
+		go n.applyCommitted(g)
+	}
+	return nil
+}
+
+// Lowest numbered node of a group answering heartbeats
+func (n *Node) groupLeader(members []int) int {
+	return n.lowestAlive(func(id int) bool { return slices.Contains(members, id) })
+}
+
+// Groups holding this node's files: the shard groups it's in, or group 0
+// without sharding
+func (n *Node) fileGroups() []*group {
+	if !sharded() {
+		return []*group{n.meta}
+	}
+	groups := make([]*group, 0, len(n.groups))
+	for _, g := range n.groups {
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b *group) int { return a.id - b.id })
+	return groups
+}
+
+// Current shard map, the initial one until group 0 changes it
+func (n *Node) shardMap() shard.Map {
+	if m, ok := n.store.Shards(); ok {
+		return m
+	}
+	return n.initial.Clone()
+}
+
+// Group of this node serving the paths, which must all be in one group
+func (n *Node) route(paths ...string) (*group, error) {
+	if !sharded() {
+		return n.meta, nil
+	}
+	m := n.shardMap()
+	id := 0
+	for _, path := range paths {
+		s := m.Lookup(path)
+		if id != 0 && s.Group != id {
+			return nil, fmt.Errorf("paths span shard groups %d and %d, a transaction must stay within one", id, s.Group)
+		}
+		id = s.Group
+	}
+	g, ok := n.groups[id]
+	if !ok {
+		return nil, shard.WrongShard(paths[0], id, m.Groups[id])
+	}
+	return g, nil
+}
+
+// Group serving a watch on path, and whether the watch must be narrowed to
+// the file at path. A directory watch needs one group serving everything
+// below it, which hash sharding rarely leaves; a path spread over groups can
+// only be watched as a file, and fails if dir says it names a directory.
+func (n *Node) watchGroup(path string, dir bool) (*group, bool, error) {
+	if !sharded() {
+		return n.meta, false, nil
+	}
+	m := n.shardMap()
+	if id := m.DirGroup(path); id != 0 {
+		g, ok := n.groups[id]
+		if !ok {
+			return nil, false, shard.WrongShard(path, id, m.Groups[id])
+		}
+		return g, false, nil
+	}
+	if dir {
+		return nil, false, fmt.Errorf("can't watch directory %s: with %s sharding the files below it are in several shard groups, watch them individually", path, m.By)
+	}
+	g, err := n.route(path)
+	return g, true, err
+}
+
+// Group a command goes to: the one serving its paths, or group 0 for
+// commands without any. Sessions are in group 0, so a shard group can't check
+// the session of a write; it's checked here against this node's copy.
+func (n *Node) groupFor(cmd store.Command) (*group, error) {
+	var paths []string
+	if cmd.Path != "" {
+		paths = append(paths, cmd.Path)
+	}
+	for _, op := range cmd.Ops {
+		paths = append(paths, op.Path)
+	}
+	if len(paths) == 0 {
+		return n.meta, nil
+	}
+	if sharded() && cmd.Session != "" {
+		if session, ok := n.store.Session(cmd.Session); !ok || session.Owner != cmd.Principal {
+			return nil, fmt.Errorf("session %s does not exist or expired", cmd.Session)
+		}
+	}
+	return n.route(paths...)
+}
+
+// Shard groups that may hold a session's files, nil without sharding
+func (n *Node) sessionGroups() []int {
+	if !sharded() {
+		return nil
+	}
+	var groups []int
+	for id := range n.shardMap().Groups {
+		groups = append(groups, id)
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+// On the leader of group 0, have each shard group delete the files of
+// sessions that ended, and forget the session once it did
+func (n *Node) deleteEndedSessionFiles() {
+	for id, groups := range n.store.EndedSessions() {
+		for _, g := range groups {
+			end := store.NewCommand(store.OpEndSession)
+			end.Session, end.Principal = id, "cluster"
+			if _, err := n.proposeToGroup(g, end); err != nil {
+				n.logger.Warn("error deleting files of ended session", "session", id, "group", g, "error", err)
+				continue
+			}
+			forget := store.NewCommand(store.OpForgetSession)
+			forget.Session, forget.Group, forget.Principal = id, g, "cluster"
+			if _, _, err := n.proposeTo(n.meta, forget, telemetry.SpanContext{}); err != nil {
+				n.logger.Warn("error forgetting ended session", "session", id, "group", g, "error", err)
+			}
+		}
+	}
+}
+
+// Propose a command in a group, through one of its nodes if this node isn't
+// in it, and wait until it's applied there
+func (n *Node) proposeToGroup(id int, cmd store.Command) (store.Result, error) {
+	if g, ok := n.groups[id]; ok {
+		_, result, err := n.proposeTo(g, cmd, telemetry.SpanContext{})
+		return result, err
+	}
+	req := GroupProposeRequest{Group: id, Command: cmd.Encode(), Token: utils.ClusterToken}
+	var res GroupProposeResponse
+	err := n.callGroup(id, "Peer.GroupPropose", &req, &res)
+	return res.Result, err
+}
+
+// Call a node of a group, trying each until one answers
+func (n *Node) callGroup(id int, method string, req any, res any) error {
+	err := fmt.Errorf("no node of group %d is reachable", id)
+	for _, member := range n.shardMap().Groups[id] {
+		client := n.neighbors()[n.remoteAddr(member)]
+		if client == nil {
+			continue
+		}
+		if err = client.Call(method, req, res); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Replace the shard map from, failing if it changed in the meantime
+func (n *Node) setShards(from shard.Map, to shard.Map) error {
+	cmd := store.NewCommand(store.OpSetShards)
+	cmd.Shards = &to
+	cmd.IfVersion = from.Version
+	cmd.Principal = "cluster"
+	_, result, err := n.proposeTo(n.meta, cmd, telemetry.SpanContext{})
+	if err != nil {
+		return err
+	}
+	if result.Conflict {
+		return fmt.Errorf("shard map changed to version %d, retry", result.Version)
+	}
+	return nil
+}
+
+// Move a shard to another group without stopping it: the old group stops
+// taking writes for it, its files are installed in the new group, the map
+// hands the shard over and the old group drops its copy. Writes in between
+// fail with a wrong shard error clients retry. Runs on a node of the old
+// group; rerunning an interrupted move finishes it.
+func (n *Node) moveShard(id int, to int) error {
+	m := n.shardMap()
+	s, ok := m.Shard(id)
+	if !ok {
+		return fmt.Errorf("no shard %d", id)
+	}
+	source, ok := n.groups[s.Group]
+	if !ok {
+		req := MoveShardRequest{Shard: id, Group: to, Token: utils.ClusterToken}
+		return n.callGroup(s.Group, "Peer.MoveShard", &req, &MoveShardResponse{})
+	}
+
+	moving, err := m.Move(id, to)
+	if err != nil {
+		return err
+	}
+	if s.Moving == 0 {
+		if err := n.setShards(m, moving); err != nil {
+			return err
+		}
+	}
+	n.logger.Info("moving shard", "shard", id, "from", s.Group, "to", to, "range", s.Range.String())
+
+	fence := store.Fence{By: m.By, Range: s.Range, Group: to}
+	freeze := store.NewCommand(store.OpFreezeShard)
+	freeze.Fence, freeze.Principal = &fence, "cluster"
+	if _, _, err := n.proposeTo(source, freeze, telemetry.SpanContext{}); err != nil {
+		return fmt.Errorf("freezing shard %d: %v", id, err)
+	}
+
+	// Nothing changes in the range once the freeze is applied
+	snapshot := source.store.Export(m.By, s.Range)
+	install := store.NewCommand(store.OpInstallShard)
+	install.Fence, install.Snapshot, install.Principal = &fence, &snapshot, "cluster"
+	if _, err := n.proposeToGroup(to, install); err != nil {
+		return fmt.Errorf("installing shard %d in group %d: %v", id, to, err)
+	}
+
+	m = n.shardMap()
+	moved, err := m.FinishMove(id)
+	if err != nil {
+		return err
+	}
+	if err := n.setShards(m, moved); err != nil {
+		return err
+	}
+
+	drop := store.NewCommand(store.OpDropShard)
+	drop.Fence, drop.Principal = &fence, "cluster"
+	if _, _, err := n.proposeTo(source, drop, telemetry.SpanContext{}); err != nil {
+		return fmt.Errorf("dropping shard %d from group %d: %v", id, s.Group, err)
+	}
+	n.logger.Info("shard moved", "shard", id, "from", s.Group, "to", to, "files", len(snapshot.Files))
+	return nil
+}
+
+// RPC: ShardMap - for clients routing requests themselves
+type ShardMapRequest struct {
+	Token string
+}
+type ShardMapResponse struct {
+	Shards shard.Map // Empty without sharding
+}
+
+func (s *ClientService) ShardMap(req *ShardMapRequest, res *ShardMapResponse) error {
+	if _, err := auth.Require(req.Token, auth.RoleReader); err != nil {
+		return err
+	}
+	res.Shards = s.node.shardMap()
+	return nil
+}
+
+// RPC: SplitShard
+type SplitShardRequest struct {
+	Shard int
+	At    string // Shard key the new shard starts at, empty to halve a hash range
+	Token string
+}
+type SplitShardResponse struct {
+	Shards shard.Map
+}
+
+func (s *AdminService) SplitShard(req *SplitShardRequest, res *SplitShardResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleAdmin); err != nil {
+		return err
+	}
+	if !sharded() {
+		return fmt.Errorf("cluster isn't sharded")
+	}
+	m := n.shardMap()
+	split, err := m.Split(req.Shard, req.At)
+	if err != nil {
+		return err
+	}
+	if err := n.setShards(m, split); err != nil {
+		return err
+	}
+	n.logger.Info("shard split", "shard", req.Shard, "version", split.Version)
+	res.Shards = split
+	return nil
+}
+
+// RPC: MoveShard
+type MoveShardRequest struct {
+	Shard int
+	Group int // Group to serve the shard
+	Token string
+}
+type MoveShardResponse struct {
+	Shards shard.Map
+}
+
+func (s *AdminService) MoveShard(req *MoveShardRequest, res *MoveShardResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RoleAdmin); err != nil {
+		return err
+	}
+	if !sharded() {
+		return fmt.Errorf("cluster isn't sharded")
+	}
+	if err := n.moveShard(req.Shard, req.Group); err != nil {
+		return err
+	}
+	res.Shards = n.shardMap()
+	return nil
+}
+
+// RPC: MoveShard - a move handed to a node of the shard's group
+func (s *PeerService) MoveShard(req *MoveShardRequest, res *MoveShardResponse) error {
+	if _, err := auth.Require(req.Token, auth.RolePeer); err != nil {
+		return err
+	}
+	return s.node.moveShard(req.Shard, req.Group)
+}
+
+// RPC: GroupPropose - a command for a group the caller isn't in
+type GroupProposeRequest struct {
+	Group   int
+	Command string // Encoded store.Command
+	Token   string
+}
+type GroupProposeResponse struct {
+	Result store.Result
+}
+
+// Returns once the command is applied on this node
+func (s *PeerService) GroupPropose(req *GroupProposeRequest, res *GroupProposeResponse) error {
+	n := s.node
+	if _, err := auth.Require(req.Token, auth.RolePeer); err != nil {
+		return err
+	}
+	g, ok := n.groups[req.Group]
+	if !ok {
+		return fmt.Errorf("node %d isn't in group %d", n.NodeID, req.Group)
+	}
+	cmd, err := store.DecodeCommand(req.Command)
+	if err != nil {
+		return err
+	}
+	_, res.Result, err = n.proposeTo(g, cmd, telemetry.SpanContext{})
+	return err
+}
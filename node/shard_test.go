@@ -0,0 +1,104 @@
+package node
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/shard"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Node 1 of a sharded cluster with one node per group, without engines
+func shardedNode(t *testing.T, by string, groups [][]int, splits []string) *Node {
+	t.Helper()
+	saved := utils.ShardGroups
+	utils.ShardGroups = groups
+	t.Cleanup(func() { utils.ShardGroups = saved })
+
+	initial, err := shard.Initial(by, groups, splits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{NodeID: 1, store: store.New("", store.Retention{}), groups: make(map[int]*group), initial: initial}
+	n.meta = &group{store: n.store}
+	for id, members := range initial.Groups {
+		if slices.Contains(members, n.NodeID) {
+			n.groups[id] = &group{id: id, members: members, store: store.New("", store.Retention{})}
+		}
+	}
+	return n
+}
+
+func TestWatchGroupHash(t *testing.T) {
+	n := shardedNode(t, shard.ByHash, [][]int{{1}, {2}}, nil)
+	for _, dir := range []string{"/", "/dir"} {
+		if _, _, err := n.watchGroup(dir, true); err == nil || !strings.Contains(err.Error(), "several shard groups") {
+			t.Errorf("watching directory %s: got %v, want an error", dir, err)
+		}
+	}
+	// Without a trailing slash it's watched as a file, on the group serving it
+	for _, path := range []string{"/dir", "/dir/file", "/other"} {
+		g, fileOnly, err := n.watchGroup(path, false)
+		if !fileOnly {
+			t.Errorf("watch on %s isn't narrowed to the file", path)
+		}
+		if want := n.initial.Lookup(path).Group; want == 1 && (err != nil || g.id != 1) || want != 1 && !shard.IsWrongShard(err) {
+			t.Errorf("watch on %s, served by group %d: got group %v, error %v", path, want, g, err)
+		}
+	}
+}
+
+func TestWatchGroupRange(t *testing.T) {
+	// Group 1 serves paths before /m, group 2 the rest
+	n := shardedNode(t, shard.ByRange, [][]int{{1}, {2}}, []string{"/m"})
+	g, fileOnly, err := n.watchGroup("/l", true)
+	if err != nil || fileOnly || g.id != 1 {
+		t.Errorf("directory /l within group 1: got group %v, narrowed %t, error %v", g, fileOnly, err)
+	}
+	if _, _, err := n.watchGroup("/m", true); !shard.IsWrongShard(err) {
+		t.Errorf("directory /m within group 2: got %v, want a wrong shard error", err)
+	}
+	if _, _, err := n.watchGroup("/", true); err == nil {
+		t.Errorf("watching / across both groups should fail")
+	}
+}
+
+// Sessions and locks go to group 0, files to their shard group, and writes
+// tied to a session go there too once this node's group 0 shows the session
+func TestGroupForSessions(t *testing.T) {
+	n := shardedNode(t, shard.ByRange, [][]int{{1}, {2}}, []string{"/m"})
+
+	for _, op := range []string{store.OpOpenSession, store.OpKeepAlive, store.OpCloseSession, store.OpLock} {
+		cmd := store.NewCommand(op)
+		cmd.Session, cmd.Lock = "s1", "l1"
+		if g, err := n.groupFor(cmd); err != nil || g != n.meta {
+			t.Errorf("%s: got group %v, error %v, want group 0", op, g, err)
+		}
+	}
+
+	write := store.NewCommand(store.OpWrite)
+	write.Path, write.Data, write.Principal = "/a", "x", "alice"
+	if g, err := n.groupFor(write); err != nil || g.id != 1 {
+		t.Errorf("write to /a: got group %v, error %v, want group 1", g, err)
+	}
+	open := store.NewCommand(store.OpOpenSession)
+	open.TTL, open.Principal = time.Minute, "alice"
+	if _, err := n.store.Apply(0, open.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	write.Session = "unknown"
+	if _, err := n.groupFor(write); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("write with an unknown session: got %v, want it refused", err)
+	}
+	write.Session = open.ID
+	if g, err := n.groupFor(write); err != nil || g.id != 1 {
+		t.Errorf("ephemeral write to /a: got group %v, error %v, want group 1", g, err)
+	}
+	write.Principal = "bob"
+	if _, err := n.groupFor(write); err == nil {
+		t.Errorf("write with another principal's session should be refused")
+	}
+}
@@ -0,0 +1,84 @@
+// node/watch.go
+
+package node
+
+import (
+	"strings"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/store"
+)
+
+// Longest a Watch call waits for a change before returning empty
+const maxWatchWait = 30 * time.Second
+
+// RPC: Watch - long-poll for committed changes to a file or directory.
+// Watches resume from an event's Seq, which is its version while versions
+// follow the log. With sharding versions are per group, so a directory can
+// only be watched while one group serves every file below it, as a range
+// sharded directory within one shard. Otherwise only the file at Path is
+// watched, and a Path of "/" or ending in "/" is rejected. With epaxos versions are
+// per file, so Seq counts the commands the watched node applied: changes come
+// in that node's apply order, which differs between nodes for files no
+// command touches together, and a watch can only resume on the same node.
+type WatchRequest struct {
+	Path        string // File, or directory to watch everything below, "/" for all files, a trailing "/" marks a directory
+	FromVersion int    // Return changes after this Seq, 0 for all retained changes
+	Wait        time.Duration
+	Token       string
+}
+type WatchResponse struct {
+	Events  []store.Event // Ordered by Seq
+	Version int           // Pass as FromVersion to resume
+}
+
+func (s *ClientService) Watch(req *WatchRequest, res *WatchResponse) error {
+	n := s.node
+	prefix := "/"
+	if req.Path != "/" {
+		var err error
+		if prefix, err = store.CleanPath(req.Path); err != nil {
+			return err
+		}
+	}
+	principal, err := n.authorizePath(req.Token, auth.PermRead, prefix)
+	if err != nil {
+		return err
+	}
+	g, fileOnly, err := n.watchGroup(prefix, strings.HasSuffix(req.Path, "/"))
+	if err != nil {
+		return err
+	}
+	wait := req.Wait
+	if wait <= 0 || wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+
+	timeout := time.After(wait)
+	for {
+		events, version, changed, err := g.store.Events(prefix, req.FromVersion)
+		if err != nil {
+			return err
+		}
+		// ACLs below a watched directory may hide some files
+		rules := n.store.ACLs()
+		res.Events, res.Version = nil, version
+		for _, event := range events {
+			if fileOnly && event.Path != prefix {
+				continue
+			}
+			if auth.CheckPath(principal, auth.PermRead, event.Path, rules) == nil {
+				res.Events = append(res.Events, event)
+			}
+		}
+		if len(res.Events) > 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+	}
+}
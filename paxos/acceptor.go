@@ -2,69 +2,171 @@ package paxos
 
 import (
 	"fmt"
+	"log/slog"
+	"sync"
 )
 
+// Chosen slots kept below the newest one even once every node applied them:
+// acceptors keep their state for proposers still deciding them, learners
+// their values for nodes catching up
+const retainedSlots = 4096
 
-type Acceptor struct {
-	Id               int
+// Acceptor state for one slot of the log
+type Instance struct {
 	PromisedProposal int    // Highest prepare request seen so far
 	AcceptedProposal int    // Highest proposal agreed upon
 	AcceptedValue    string // Value of the highest proposal agreed upon
 }
 
-func NewAcceptor(id int) *Acceptor {
+// Safe for concurrent use, net/rpc serves each request in its own goroutine
+type Acceptor struct {
+	mu        sync.Mutex // Guards instances, lastSlot and compacted
+	Id        int
+	instances map[int]*Instance // By slot
+	lastSlot  int               // Highest slot with any activity
+	compacted int               // Slots below it were chosen and their state dropped
+	logger    *slog.Logger
+}
+
+func NewAcceptor(id int, logger *slog.Logger) *Acceptor {
 	return &Acceptor{
-		Id:               id,
-		PromisedProposal: -1,
-		AcceptedProposal: -1,
-		AcceptedValue:    "",
+		Id:        id,
+		instances: make(map[int]*Instance),
+		lastSlot:  -1,
+		logger:    logger.With("role", "acceptor"),
+	}
+}
+
+// Highest slot with any activity and a copy of its state, -1 and an empty
+// instance before the first request
+func (a *Acceptor) Status() (int, Instance) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	instance, ok := a.instances[a.lastSlot]
+	if !ok {
+		return a.lastSlot, Instance{PromisedProposal: -1, AcceptedProposal: -1}
+	}
+	return a.lastSlot, *instance
+}
+
+// Drop the state of slots below a slot, which must all be chosen. Requests
+// for them are refused from then on: no other value may be accepted there.
+// Reports whether any slot was dropped.
+func (a *Acceptor) Compact(below int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dropped := a.compacted < below
+	for ; a.compacted < below; a.compacted++ {
+		delete(a.instances, a.compacted)
+	}
+	return dropped
+}
+
+// Reason to refuse a request for a slot whose state was dropped, mu must be
+// held
+func (a *Acceptor) compactedReason(slot int) string {
+	if slot >= a.compacted {
+		return ""
 	}
+	return fmt.Sprintf("slot %d was chosen and compacted", slot)
+}
+
+// State of a slot, created on first use, mu must be held
+func (a *Acceptor) instance(slot int) *Instance {
+	instance, ok := a.instances[slot]
+	if !ok {
+		instance = &Instance{
+			PromisedProposal: -1,
+			AcceptedProposal: -1,
+			AcceptedValue:    "",
+		}
+		a.instances[slot] = instance
+		if slot > a.lastSlot {
+			a.lastSlot = slot
+		}
+	}
+	return instance
 }
 
 // Handle Prepare request
-func (a *Acceptor) Prepare(proposal int) PrepareResponse {
-	fmt.Printf("    node %d: status   - %#v\n", a.Id, a)
-	if proposal > a.PromisedProposal {
-		fmt.Printf("%s    node %d: ACCEPTED - changing PromisedProposal from %d to incoming %d%s\n", Green, a.Id, a.PromisedProposal, proposal, Reset)
-		a.PromisedProposal = proposal
-		fmt.Printf("    node %d: status   - %#v\n", a.Id, a)
-		// fmt.Printf("    node %d: {promisedProposal=%d, acceptedValue=%s, acceptedProposal=%d}\n", a.Id, a.PromisedProposal, a.AcceptedValue, a.AcceptedProposal)
+func (a *Acceptor) Prepare(slot int, proposal int) PrepareResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if reason := a.compactedReason(slot); reason != "" {
+		a.logger.Info("prepare rejected", "result", "rejected", "slot", slot, "ballot", proposal, "reason", reason)
+		return PrepareResponse{Id: a.Id, OK: false, Reason: reason}
+	}
+	instance := a.instance(slot)
+	a.logStatus(slot, instance)
+	if proposal > instance.PromisedProposal {
+		a.logger.Info("promise", "result", "accepted", "slot", slot, "ballot", proposal, "promised_from", instance.PromisedProposal)
+		instance.PromisedProposal = proposal
+		a.logStatus(slot, instance)
 		// Promise to not accept any earlier proposals
 		return PrepareResponse{
 			Id:            a.Id,
 			OK:            true,
-			Proposal:      a.AcceptedProposal,
-			AcceptedValue: a.AcceptedValue,
+			Proposal:      instance.AcceptedProposal,
+			AcceptedValue: instance.AcceptedValue,
 		}
 	}
-	fmt.Printf("%s    node %d: REJECTED - PromisedProposal:%d greater than or equal to incoming proposal:%d%s\n", Red, a.Id, a.PromisedProposal, proposal, Reset)
+	reason := fmt.Sprintf("promised ballot %d greater than or equal to incoming ballot %d", instance.PromisedProposal, proposal)
+	a.logger.Info("prepare rejected", "result", "rejected", "slot", slot, "ballot", proposal, "promised", instance.PromisedProposal, "reason", reason)
 	return PrepareResponse{
-		Id: a.Id,
-		OK: false,
+		Id:       a.Id,
+		OK:       false,
+		Reason:   reason,
+		Promised: instance.PromisedProposal,
 	}
 }
 
 // Handle Accept request
-func (a *Acceptor) Accept(proposal int, value string) AcceptResponse {
-	fmt.Printf("    node %d: status   - %#v\n", a.Id, a)
+func (a *Acceptor) Accept(slot int, proposal int, value string) AcceptResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if reason := a.compactedReason(slot); reason != "" {
+		a.logger.Info("accept rejected", "result", "rejected", "slot", slot, "ballot", proposal, "reason", reason)
+		return AcceptResponse{Id: a.Id, OK: false, Reason: reason}
+	}
+	instance := a.instance(slot)
+	a.logStatus(slot, instance)
 
-	if proposal >= a.PromisedProposal {
-		fmt.Printf("%s    node %d: ACCEPTED - proposal:%d >= PromisedProposal:%d%s\n", Green, a.Id, proposal, a.PromisedProposal, Reset)
-		fmt.Printf("    node %d: updating - value '%s' -> '%s', AcceptedProposal %d -> %d\n", a.Id, a.AcceptedValue, value, a.AcceptedProposal, proposal)
-		a.PromisedProposal = proposal
-		a.AcceptedProposal = proposal
-		a.AcceptedValue = value
+	if proposal == instance.AcceptedProposal && value != instance.AcceptedValue {
+		// Only in a fast round, where proposers send without phase 1
+		reason := fmt.Sprintf("already accepted another value at ballot %d", proposal)
+		a.logger.Info("accept rejected", "result", "rejected", "slot", slot, "ballot", proposal, "promised", instance.PromisedProposal, "reason", reason)
+		return AcceptResponse{
+			Id:       a.Id,
+			OK:       false,
+			Reason:   reason,
+			Promised: instance.PromisedProposal,
+		}
+	}
+	if proposal >= instance.PromisedProposal {
+		a.logger.Info("accepted", "result", "accepted", "slot", slot, "ballot", proposal, "promised", instance.PromisedProposal,
+			"old_value", instance.AcceptedValue, "value", value, "old_ballot", instance.AcceptedProposal)
+		instance.PromisedProposal = proposal
+		instance.AcceptedProposal = proposal
+		instance.AcceptedValue = value
 		// Accept proposal
-		fmt.Printf("    node %d: status   - %#v\n", a.Id, a)
+		a.logStatus(slot, instance)
 		return AcceptResponse{
 			Id:       a.Id,
 			OK:       true,
 			Proposal: proposal,
 		}
 	}
-	fmt.Printf("%s    node %d: REJECTED - proposal:%d < PromisedProposal:%d (should be >=)%s\n", Red, a.Id, proposal, a.PromisedProposal, Reset)
+	reason := fmt.Sprintf("ballot %d lower than promised ballot %d", proposal, instance.PromisedProposal)
+	a.logger.Info("accept rejected", "result", "rejected", "slot", slot, "ballot", proposal, "promised", instance.PromisedProposal, "reason", reason)
 	return AcceptResponse{
-		Id: a.Id,
-		OK: false,
+		Id:       a.Id,
+		OK:       false,
+		Reason:   reason,
+		Promised: instance.PromisedProposal,
 	}
 }
+
+// Dump slot state at debug level
+func (a *Acceptor) logStatus(slot int, instance *Instance) {
+	a.logger.Debug("status", "slot", slot, "promised", instance.PromisedProposal, "accepted_ballot", instance.AcceptedProposal, "accepted_value", instance.AcceptedValue)
+}
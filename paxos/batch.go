@@ -0,0 +1,242 @@
+package paxos
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Slots a batch tries before giving up when other values keep winning
+const maxBatchSlots = 10
+
+// How long a slot below a chosen one may stay empty before the leader fills
+// it
+const gapTimeout = time.Second
+
+// Groups commands arriving together into one log entry and proposes
+// several entries at once, each in its own slot
+type batcher struct {
+	engine    *Engine
+	queue     chan *pending
+	batches   chan []*pending
+	mu        sync.Mutex
+	inflight  map[int]bool          // Slots being proposed by a worker, guarded by mu
+	acceptors map[string]Connection // Current members, workers pick them up before each batch, guarded by mu
+	learners  map[string]Connection // Guarded by mu
+}
+
+// Command waiting to be chosen
+type pending struct {
+	command string
+	parent  telemetry.SpanContext
+	done    chan error
+}
+
+// Start collecting commands and PipelineDepth workers proposing them, each
+// with its own proposer
+func newBatcher(e *Engine, acceptors map[string]Connection, learners map[string]Connection) *batcher {
+	b := &batcher{
+		engine:    e,
+		queue:     make(chan *pending, utils.BatchSize),
+		batches:   make(chan []*pending),
+		inflight:  make(map[int]bool),
+		acceptors: acceptors,
+		learners:  learners,
+	}
+	go b.collect()
+	for i := 0; i < max(utils.PipelineDepth, 1); i++ {
+		go b.work(e.newProposer(acceptors, learners))
+	}
+	go b.fillGaps(e.newProposer(acceptors, learners))
+	return b
+}
+
+// Propose to these members from the next batch on
+func (b *batcher) setMembers(acceptors map[string]Connection, learners map[string]Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.acceptors, b.learners = acceptors, learners
+}
+
+func (b *batcher) members() (map[string]Connection, map[string]Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acceptors, b.learners
+}
+
+// Queue a command and wait until it's chosen, possibly together with others
+func (b *batcher) propose(command string, parent telemetry.SpanContext) error {
+	p := &pending{command: command, parent: parent, done: make(chan error, 1)}
+	b.queue <- p
+	return <-p.done
+}
+
+// Cut a batch once it's full or BatchLinger passed since its first command.
+// While every worker is busy, commands keep queueing for the next batch.
+func (b *batcher) collect() {
+	for first := range b.queue {
+		batch := []*pending{first}
+		linger := time.After(utils.BatchLinger)
+	fill:
+		for len(batch) < utils.BatchSize {
+			select {
+			case p := <-b.queue:
+				batch = append(batch, p)
+			case <-linger:
+				break fill
+			}
+		}
+		b.batches <- batch
+	}
+}
+
+func (b *batcher) work(proposer *Proposer) {
+	for batch := range b.batches {
+		value := batch[0].command
+		parent := batch[0].parent
+		var err error
+		var spans []*telemetry.Span
+		if len(batch) > 1 {
+			commands := make([]string, len(batch))
+			for i, p := range batch {
+				commands[i] = p.command
+			}
+			value, err = b.engine.cfg.Batch(commands)
+			spans = b.traceBatch(batch)
+			parent = spans[0].Context()
+		}
+		slot := 0
+		if err == nil {
+			// Only this worker runs rounds on its proposer
+			proposer.Acceptors, proposer.Learners = b.members()
+			proposer.Timeout.Store(b.engine.cfg.Faults.Timeout.Load())
+			slot, err = b.proposeValue(proposer, value, parent)
+		}
+		if err != nil {
+			b.engine.cfg.Logger.Warn("error proposing batch", "commands", len(batch), "error", err)
+		} else {
+			b.engine.cfg.Logger.Info("batch chosen", "slot", slot, "commands", len(batch))
+		}
+		for _, span := range spans {
+			span.SetAttr("paxos.slot", slot)
+			span.SetError(err)
+			span.Finish()
+		}
+		for _, p := range batch {
+			p.done <- err
+		}
+	}
+}
+
+// Spans tying the commands of a batch together: one in each command's trace
+// and the batch's, which the rounds run under, below the first command's.
+// The batch links to the other commands' spans and they link back to it.
+// Returns the batch span first.
+func (b *batcher) traceBatch(batch []*pending) []*telemetry.Span {
+	tracer := b.engine.cfg.Tracer
+	spans := make([]*telemetry.Span, 0, len(batch)+1)
+	for _, p := range batch {
+		spans = append(spans, tracer.Start(p.parent, "paxos.batched", telemetry.KindInternal))
+	}
+	span := tracer.Start(spans[0].Context(), "paxos.batch", telemetry.KindInternal)
+	span.SetAttr("paxos.batch_size", len(batch))
+	for _, command := range spans[1:] {
+		span.AddLink(command.Context())
+		command.AddLink(span.Context())
+	}
+	return append([]*telemetry.Span{span}, spans...)
+}
+
+// Run rounds in reserved slots until the value is chosen in one of them
+func (b *batcher) proposeValue(proposer *Proposer, value string, parent telemetry.SpanContext) (int, error) {
+	for attempt := 0; attempt < maxBatchSlots; attempt++ {
+		slot := b.reserveSlot()
+		_, err := proposer.RunSlot(slot, value, parent)
+		if err == nil {
+			return slot, nil
+		}
+		if !errors.Is(err, ErrNotClientValue) {
+			// Nothing known to be chosen, leave the slot for the next batch
+			b.release(slot)
+			return slot, err
+		}
+	}
+	return 0, fmt.Errorf("no free slot after %d attempts", maxBatchSlots)
+}
+
+// A round that fails leaves its slot empty, while other workers may have
+// chosen later ones that can't be applied until it's filled. The leader
+// proposes a no-op in slots that stayed empty for gapTimeout; where a value
+// was chosen after all, the round commits that value instead.
+func (b *batcher) fillGaps(proposer *Proposer) {
+	var empty map[int]bool // Empty at the previous check
+	for range time.Tick(gapTimeout) {
+		if b.engine.cfg.Faults.Stop.Load() || b.engine.cfg.Leader() != "" {
+			empty = nil
+			continue
+		}
+		missing := b.engine.missingSlots()
+		previous := empty
+		empty = make(map[int]bool, len(missing))
+		for _, slot := range missing {
+			empty[slot] = true
+			if previous[slot] && b.reserve(slot) {
+				b.fillGap(proposer, slot)
+			}
+		}
+	}
+}
+
+func (b *batcher) fillGap(proposer *Proposer, slot int) {
+	noop, err := b.engine.cfg.Batch(nil)
+	if err == nil {
+		proposer.Acceptors, proposer.Learners = b.members()
+		_, err = proposer.RunSlot(slot, noop, telemetry.SpanContext{})
+	}
+	if err != nil && !errors.Is(err, ErrNotClientValue) {
+		b.engine.cfg.Logger.Warn("error filling empty slot", "slot", slot, "error", err)
+		b.release(slot)
+		return
+	}
+	b.engine.cfg.Logger.Info("filled empty slot", "slot", slot, "noop", err == nil)
+}
+
+// Lowest slot that isn't known to be chosen and no worker is proposing in.
+// Reserved slots stay taken until this node learns them.
+func (b *batcher) reserveSlot() int {
+	next := b.engine.nextSlot()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for slot := range b.inflight {
+		if slot < next {
+			delete(b.inflight, slot)
+		}
+	}
+	slot := next
+	for b.inflight[slot] {
+		slot++
+	}
+	b.inflight[slot] = true
+	return slot
+}
+
+// Take a given slot unless a worker is proposing in it
+func (b *batcher) reserve(slot int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inflight[slot] {
+		return false
+	}
+	b.inflight[slot] = true
+	return true
+}
+
+func (b *batcher) release(slot int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.inflight, slot)
+}
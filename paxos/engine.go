@@ -0,0 +1,279 @@
+package paxos
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Multi-Paxos as a consensus engine: one log with a value chosen per slot.
+// Commands are batched on the leader and proposed by pipelined proposers,
+// every voter's acceptor answers them, and the learner hands chosen values
+// out in slot order, fetching slots it missed from other nodes. Learner
+// nodes only learn, witnesses only vote.
+type Engine struct {
+	cfg        consensus.Config
+	service    string // RPC service name, Paxos for group 0 and PaxosGroup<id> for the others
+	acceptor   *Acceptor
+	quorums    QuorumSystem
+	fastQuorum int // Acceptors accepting a fast round, 0 without Fast Paxos
+	recorder   *Recorder
+	committed  chan consensus.Entry
+	progress   *Progress // How far the nodes applied, from this node's commits
+
+	mu       sync.RWMutex
+	members  map[string]consensus.Member // Guarded by mu
+	proposer *Proposer                   // For commands that aren't batched, guarded by mu
+	batcher  *batcher                    // Guarded by mu
+
+	logMu      sync.Mutex // Guards learner, stable and handing out entries
+	learner    *Learner
+	stable     int // Highest stable slot a commit told of, see Progress
+	catchingUp bool
+}
+
+func NewEngine(cfg consensus.Config) (*Engine, error) {
+	var recorder *Recorder
+	if utils.MessageTraceDir != "" {
+		name := fmt.Sprintf("node_%d.jsonl", cfg.ID)
+		if cfg.Group != 0 {
+			name = fmt.Sprintf("node_%d_group_%d.jsonl", cfg.ID, cfg.Group)
+		}
+		path := filepath.Join(utils.MessageTraceDir, name)
+		var err error
+		recorder, err = NewRecorder(cfg.ID, cfg.Group, cfg.Addr, path)
+		if err != nil {
+			return nil, fmt.Errorf("creating message recorder: %v", err)
+		}
+	}
+
+	// Quorum settings are for group 0, shard groups use majorities
+	var quorums QuorumSystem = MajorityQuorums(len(cfg.Voters))
+	if cfg.Group == 0 {
+		var err error
+		if quorums, err = ConfiguredQuorums(cfg.Voters); err != nil {
+			return nil, fmt.Errorf("invalid quorums: %v", err)
+		}
+	}
+	fastQuorum := 0
+	if utils.FastPaxos {
+		sizes, ok := quorums.(Quorums)
+		if !ok {
+			return nil, fmt.Errorf("fast Paxos needs the %s quorum system", QuorumMajority)
+		}
+		fastQuorum = FastQuorumSize(len(cfg.Voters), sizes.Phase1Size)
+	}
+
+	service := "Paxos"
+	if cfg.Group != 0 {
+		service = fmt.Sprintf("PaxosGroup%d", cfg.Group)
+	}
+	return &Engine{
+		cfg:        cfg,
+		service:    service,
+		acceptor:   NewAcceptor(cfg.ID, cfg.Logger),
+		quorums:    quorums,
+		fastQuorum: fastQuorum,
+		recorder:   recorder,
+		committed:  make(chan consensus.Entry, utils.BatchSize),
+		members:    make(map[string]consensus.Member),
+		progress:   NewProgress(),
+		learner:    NewLearner(),
+	}, nil
+}
+
+// Get a command chosen. With batching, other nodes forward commands to the
+// leader so they share its batches, and propose them themselves if it can't
+// be reached. Fast Paxos needs no leader, every node proposes its own.
+func (e *Engine) Propose(p consensus.Proposal) error {
+	e.mu.RLock()
+	proposer, batcher := e.proposer, e.batcher
+	e.mu.RUnlock()
+	if proposer == nil {
+		return fmt.Errorf("node has no neighbors yet")
+	}
+	if utils.BatchSize <= 1 {
+		proposer.Timeout.Store(e.cfg.Faults.Timeout.Load())
+		_, err := proposer.Propose(p.Command, p.Parent)
+		return err
+	}
+	if leader := e.cfg.Leader(); leader != "" && !utils.FastPaxos {
+		if client := e.member(leader); client != nil {
+			req := SubmitRequest{Command: p.Command, Token: e.cfg.Token, TraceID: p.Parent.TraceID}
+			var res SubmitResponse
+			err := client.Call(e.service+".Submit", &req, &res)
+			if err == nil {
+				return nil
+			}
+			e.cfg.Logger.Warn("error forwarding to leader, proposing locally", "leader", leader, "error", err)
+		}
+	}
+	return batcher.propose(p.Command, p.Parent)
+}
+
+func (e *Engine) Committed() <-chan consensus.Entry {
+	return e.committed
+}
+
+// Propose to the new members' acceptors from now on, and tell learners
+// what's chosen
+func (e *Engine) SetMembers(members map[string]consensus.Member) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.members = members
+	acceptors := make(map[string]Connection, len(members))
+	learners := make(map[string]Connection)
+	var logs []string // Nodes keeping a log, which others may catch up from
+	for addr, member := range members {
+		if member.Role == consensus.RoleLearner {
+			learners[addr] = member
+		} else {
+			acceptors[addr] = member
+		}
+		if member.Role != consensus.RoleWitness {
+			logs = append(logs, addr)
+		}
+	}
+	e.progress.SetNodes(logs)
+	e.proposer = e.newProposer(acceptors, learners)
+	e.proposer.NextSlot = e.nextSlot
+	if e.batcher == nil {
+		e.batcher = newBatcher(e, acceptors, learners)
+	} else {
+		e.batcher.setMembers(acceptors, learners)
+	}
+}
+
+func (e *Engine) newProposer(acceptors map[string]Connection, learners map[string]Connection) *Proposer {
+	proposer := NewProposer(e.cfg.ID, e.cfg.ID, acceptors, e.cfg.Logger, e.cfg.Tracer, e.recorder)
+	proposer.Learners = learners
+	proposer.Service = e.service
+	proposer.Token = e.cfg.Token
+	proposer.Quorums = e.quorums
+	proposer.Fast, proposer.FastQuorum = utils.FastPaxos, e.fastQuorum
+	proposer.Progress = e.progress
+	return proposer
+}
+
+func (e *Engine) Status() consensus.Status {
+	status := consensus.Status{Engine: consensus.EnginePaxos}
+	if e.cfg.Role != consensus.RoleLearner {
+		slot, instance := e.acceptor.Status()
+		status.State = append(status.State, fmt.Sprintf("Acceptor={LastSlot:%d, PromisedProposal:%d, AcceptedProposal:%d, AcceptedValue:%s}", slot, instance.PromisedProposal, instance.AcceptedProposal, instance.AcceptedValue))
+	}
+	e.mu.RLock()
+	proposer := e.proposer
+	e.mu.RUnlock()
+	if proposer != nil {
+		p := proposer.Status()
+		status.State = append(status.State, fmt.Sprintf("Proposer={Slot:%d, ProposalNumber:%d, Value:%s, HighestAcceptedProposalNumber:%d, HighestAcceptedValue:%s}", p.Slot, p.ProposalNumber, p.Value, p.HighestAcceptedProposalNumber, p.HighestAcceptedValue))
+	}
+	return status
+}
+
+func (e *Engine) Service() (string, any) {
+	return e.service, &Service{engine: e}
+}
+
+func (e *Engine) member(addr string) consensus.Connection {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	member, ok := e.members[addr]
+	if !ok {
+		return nil
+	}
+	return member
+}
+
+// Record chosen entries and hand out everything that is now contiguous.
+// Returns the number of entries handed out so far.
+func (e *Engine) learn(entries []Entry, stable int) int {
+	e.logMu.Lock()
+	defer e.logMu.Unlock()
+	e.stable = max(e.stable, stable)
+	e.deliver(entries)
+	if e.learner.HasGap() && !e.catchingUp {
+		e.catchingUp = true
+		go e.catchUp()
+	}
+	return e.learner.Applied()
+}
+
+// logMu must be held
+func (e *Engine) deliver(entries []Entry) {
+	for _, entry := range entries {
+		e.learner.Learn(entry.Slot, entry.Value)
+	}
+	for _, entry := range e.learner.Ready() {
+		e.committed <- consensus.Entry{Index: entry.Slot, Command: entry.Value}
+	}
+	// Only slots every node applied are dropped, so a node that fell
+	// behind can still catch up, and rounds it runs in slots it missed find
+	// the chosen value
+	below := compactBelow(e.stable, e.learner.Applied())
+	e.learner.Compact(below)
+	e.compactAcceptor(below)
+}
+
+// Drop acceptor state below a slot. It's recorded, so replay refuses the
+// same requests for dropped slots as the acceptor did.
+func (e *Engine) compactAcceptor(below int) {
+	if e.acceptor.Compact(below) {
+		e.recorder.Record(Message{Type: MsgCompact, From: e.cfg.ID, Slot: below})
+	}
+}
+
+// Fetch missing entries from other nodes
+func (e *Engine) catchUp() {
+	defer func() {
+		e.logMu.Lock()
+		e.catchingUp = false
+		e.logMu.Unlock()
+	}()
+
+	e.mu.RLock()
+	members := e.members
+	e.mu.RUnlock()
+	for addr, member := range members {
+		// Witnesses don't learn anything to catch up from
+		if addr == e.cfg.Addr || member.Role == consensus.RoleWitness {
+			continue
+		}
+		e.logMu.Lock()
+		from := e.learner.Applied()
+		e.logMu.Unlock()
+
+		req := LearnedRequest{FromSlot: from, Token: e.cfg.Token}
+		var res LearnedResponse
+		if err := member.Call(e.service+".Learned", &req, &res); err != nil {
+			e.cfg.Logger.Warn("error catching up", "neighbor", addr, "error", err)
+			continue
+		}
+		e.cfg.Logger.Info("catching up", "neighbor", addr, "from_slot", from, "entries", len(res.Entries))
+
+		e.logMu.Lock()
+		e.deliver(res.Entries)
+		done := !e.learner.HasGap()
+		e.logMu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// Lowest slot this node doesn't know the value of
+func (e *Engine) nextSlot() int {
+	e.logMu.Lock()
+	defer e.logMu.Unlock()
+	return e.learner.NextSlot()
+}
+
+// Slots this node doesn't know the value of below one it does
+func (e *Engine) missingSlots() []int {
+	e.logMu.Lock()
+	defer e.logMu.Unlock()
+	return e.learner.Missing()
+}
@@ -0,0 +1,330 @@
+package paxos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/logging"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Engines of a cluster in this process calling each other's services
+// directly, node 1 leading
+type localCluster struct {
+	engines []*Engine
+	mu      sync.Mutex
+	fault   func(from int, method string, args any) error // Checked before every call, nil lets everything through
+}
+
+type engineConnection struct {
+	cluster *localCluster
+	from    int
+	to      *Engine
+}
+
+func (c *engineConnection) Call(serviceMethod string, args any, reply any) error {
+	_, method, _ := strings.Cut(serviceMethod, ".")
+	c.cluster.mu.Lock()
+	fault := c.cluster.fault
+	c.cluster.mu.Unlock()
+	if fault != nil {
+		if err := fault(c.from, method, args); err != nil {
+			return err
+		}
+	}
+	service := &Service{engine: c.to}
+	switch method {
+	case "Prepare":
+		req := args.(PrepareRequest)
+		return service.Prepare(&req, reply.(*PrepareResponse))
+	case "Accept":
+		req := args.(AcceptRequest)
+		return service.Accept(&req, reply.(*AcceptResponse))
+	case "Commit":
+		req := args.(CommitRequest)
+		return service.Commit(&req, reply.(*CommitResponse))
+	case "Learned":
+		return service.Learned(args.(*LearnedRequest), reply.(*LearnedResponse))
+	case "Submit":
+		return service.Submit(args.(*SubmitRequest), reply.(*SubmitResponse))
+	}
+	return errors.New("unexpected call " + serviceMethod)
+}
+
+// Start n engines with the given roles, voters if roles is empty
+func startLocalCluster(t *testing.T, n int, roles map[int]string) *localCluster {
+	t.Helper()
+	trace, count := utils.MessageTraceDir, utils.NodeCount
+	utils.MessageTraceDir, utils.NodeCount = "", n
+	t.Cleanup(func() { utils.MessageTraceDir, utils.NodeCount = trace, count })
+
+	var voters []int
+	for id := 1; id <= n; id++ {
+		if roles[id] != consensus.RoleLearner {
+			voters = append(voters, id)
+		}
+	}
+	c := &localCluster{}
+	for id := 1; id <= n; id++ {
+		role := roles[id]
+		if role == "" {
+			role = consensus.RoleVoter
+		}
+		leader := acceptorAddr(1)
+		if id == 1 {
+			leader = ""
+		}
+		e, err := NewEngine(consensus.Config{
+			ID:        id,
+			NodeCount: n,
+			Role:      role,
+			Voters:    voters,
+			Addr:      acceptorAddr(id),
+			Token:     utils.ClusterToken,
+			Faults:    &consensus.Faults{},
+			Leader:    func() string { return leader },
+			Batch:     func(commands []string) (string, error) { return "batch[" + strings.Join(commands, ",") + "]", nil },
+			Logger:    logging.Discard(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.engines = append(c.engines, e)
+	}
+	for from, e := range c.engines {
+		members := make(map[string]consensus.Member, n)
+		for to, other := range c.engines {
+			members[acceptorAddr(to+1)] = consensus.Member{Connection: &engineConnection{cluster: c, from: from + 1, to: other}, Role: other.cfg.Role}
+		}
+		e.SetMembers(members)
+	}
+	return c
+}
+
+// Hand an engine's committed entries to nobody, counting them
+func drain(e *Engine) *atomic.Int64 {
+	var count atomic.Int64
+	go func() {
+		for range e.Committed() {
+			count.Add(1)
+		}
+	}()
+	return &count
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Slots below it were dropped by the engine's learner
+func compacted(e *Engine) int {
+	e.logMu.Lock()
+	defer e.logMu.Unlock()
+	return e.learner.compacted
+}
+
+func (c *localCluster) setFault(fault func(from int, method string, args any) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fault = fault
+}
+
+// Next entries node 1 hands out
+func nextCommitted(t *testing.T, e *Engine, n int) []consensus.Entry {
+	t.Helper()
+	var entries []consensus.Entry
+	timeout := time.After(5 * gapTimeout)
+	for len(entries) < n {
+		select {
+		case entry := <-e.Committed():
+			entries = append(entries, entry)
+		case <-timeout:
+			t.Fatalf("got %d of %d committed entries: %v", len(entries), n, entries)
+		}
+	}
+	return entries
+}
+
+// A pipelined slot whose round fails leaves a gap below a chosen slot, the
+// leader fills it so the slots after it are applied
+func TestFillGaps(t *testing.T) {
+	c := startLocalCluster(t, 3, nil)
+	leader := c.engines[0]
+	drain(c.engines[1])
+	drain(c.engines[2])
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	c.setFault(func(from int, method string, args any) error {
+		if req, ok := args.(AcceptRequest); ok && req.Value == "lost" {
+			once.Do(func() { close(blocked) })
+			<-release
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+
+	lost := make(chan error, 1)
+	go func() { lost <- leader.Propose(consensus.Proposal{Command: "lost"}) }()
+	<-blocked
+	// Another worker takes the next slot while the first round is stuck
+	if err := leader.Propose(consensus.Proposal{Command: "chosen"}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-lost; err == nil {
+		t.Fatal("round without accepts succeeded")
+	}
+
+	entries := nextCommitted(t, leader, 2)
+	if entries[0].Index != 0 || entries[0].Command != "batch[]" {
+		t.Errorf("slot 0 has %+v, want the no-op", entries[0])
+	}
+	if entries[1].Index != 1 || entries[1].Command != "chosen" {
+		t.Errorf("slot 1 has %+v, want the chosen command", entries[1])
+	}
+}
+
+// Nodes keep the slots a stopped node hasn't applied, so it catches up once
+// it's back, and drop them after
+func TestLaggingNodeCatchesUp(t *testing.T) {
+	batchSize := utils.BatchSize
+	utils.BatchSize = 1
+	t.Cleanup(func() { utils.BatchSize = batchSize })
+	c := startLocalCluster(t, 3, nil)
+	applied := []*atomic.Int64{drain(c.engines[0]), drain(c.engines[1]), drain(c.engines[2])}
+	lagging := c.engines[2]
+
+	lagging.cfg.Faults.Stop.Store(true)
+	slots := retainedSlots + 100
+	for i := 0; i < slots; i++ {
+		if err := c.engines[0].Propose(consensus.Proposal{Command: fmt.Sprintf("command %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range c.engines[:2] {
+		if below := compacted(e); below != 0 {
+			t.Fatalf("node %d dropped slots below %d the stopped node hasn't applied", e.cfg.ID, below)
+		}
+	}
+
+	// The next commit shows the node what it missed
+	lagging.cfg.Faults.Stop.Store(false)
+	if err := c.engines[0].Propose(consensus.Proposal{Command: "after restart"}); err != nil {
+		t.Fatal(err)
+	}
+	slots++
+	waitFor(t, "the lagging node to catch up", func() bool { return applied[2].Load() == int64(slots) })
+	if err := lagging.Propose(consensus.Proposal{Command: "from the lagging node"}); err != nil {
+		t.Fatal(err)
+	}
+	slots++
+
+	// Once every node answered a commit with what it applied, the next ones
+	// let them drop it
+	for i := 0; i < 2; i++ {
+		if err := c.engines[0].Propose(consensus.Proposal{Command: fmt.Sprintf("last %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		slots++
+	}
+	for i, e := range c.engines {
+		waitFor(t, fmt.Sprintf("node %d to apply every slot", i+1), func() bool { return applied[i].Load() == int64(slots) })
+		if below := compacted(e); below < slots-retainedSlots-2 {
+			t.Errorf("node %d dropped slots below %d, want at least %d", e.cfg.ID, below, slots-retainedSlots-2)
+		}
+	}
+}
+
+// Acceptor state a node keeps: slots below the first were dropped, and the
+// number of slots it holds
+func acceptorState(e *Engine) (int, int) {
+	e.acceptor.mu.Lock()
+	defer e.acceptor.mu.Unlock()
+	return e.acceptor.compacted, len(e.acceptor.instances)
+}
+
+// A witness makes a quorum with the leader while the other voter is down,
+// but never applies anything. It drops its acceptor state only for slots
+// every node with a log applied, and retainedSlots below the newest.
+func TestWitness(t *testing.T) {
+	batchSize := utils.BatchSize
+	utils.BatchSize = 1
+	t.Cleanup(func() { utils.BatchSize = batchSize })
+	c := startLocalCluster(t, 3, map[int]string{3: consensus.RoleWitness})
+	applied := []*atomic.Int64{drain(c.engines[0]), drain(c.engines[1]), drain(c.engines[2])}
+	witness := c.engines[2]
+
+	c.engines[1].cfg.Faults.Stop.Store(true)
+	slots := retainedSlots + 100
+	for i := 0; i < slots; i++ {
+		if err := c.engines[0].Propose(consensus.Proposal{Command: fmt.Sprintf("command %d", i)}); err != nil {
+			t.Fatalf("proposing with the witness: %v", err)
+		}
+	}
+	if below, _ := acceptorState(witness); below != 0 {
+		t.Errorf("witness dropped slots below %d a stopped node hasn't applied", below)
+	}
+
+	c.engines[1].cfg.Faults.Stop.Store(false)
+	if err := c.engines[0].Propose(consensus.Proposal{Command: "after restart"}); err != nil {
+		t.Fatal(err)
+	}
+	slots++
+	waitFor(t, "node 2 to catch up", func() bool { return applied[1].Load() == int64(slots) })
+	for i := 0; i < 2; i++ {
+		if err := c.engines[0].Propose(consensus.Proposal{Command: fmt.Sprintf("last %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		slots++
+	}
+	waitFor(t, "the witness to drop chosen slots", func() bool {
+		below, _ := acceptorState(witness)
+		return below >= slots-retainedSlots-2
+	})
+	if below, kept := acceptorState(witness); below > slots-retainedSlots || kept > retainedSlots+1 {
+		t.Errorf("witness dropped slots below %d and keeps %d, want the last %d kept", below, kept, retainedSlots)
+	}
+	if n := applied[2].Load(); n != 0 {
+		t.Errorf("witness applied %d entries", n)
+	}
+}
+
+// A learner applies everything but is never asked to vote, refuses to, and
+// doesn't make a quorum for the leader
+func TestLearner(t *testing.T) {
+	c := startLocalCluster(t, 3, map[int]string{3: consensus.RoleLearner})
+	learner := c.engines[2]
+	drain(c.engines[1])
+	if err := c.engines[0].Propose(consensus.Proposal{Command: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := nextCommitted(t, learner, 1); entries[0].Command != "a" {
+		t.Errorf("learner applied %+v", entries[0])
+	}
+	if _, kept := acceptorState(learner); kept != 0 {
+		t.Errorf("learner holds acceptor state for %d slots", kept)
+	}
+	service := &Service{engine: learner}
+	if err := service.Prepare(&PrepareRequest{Slot: 5, Proposal: 100, Token: utils.ClusterToken}, &PrepareResponse{}); !errors.Is(err, errNotVoter) {
+		t.Errorf("learner answered a prepare with %v", err)
+	}
+
+	c.engines[1].cfg.Faults.Stop.Store(true)
+	if err := c.engines[0].Propose(consensus.Proposal{Command: "b"}); err == nil {
+		t.Errorf("leader and learner chose a value without the other voter")
+	}
+}
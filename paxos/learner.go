@@ -0,0 +1,151 @@
+package paxos
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Tracks chosen values and hands them out in log order. Applied values are
+// kept until Compact drops them.
+type Learner struct {
+	chosen    map[int]string
+	nextApply int // Next slot to hand out
+	maxChosen int // Highest slot learned, -1 before the first
+	compacted int // Slots below it were handed out and dropped
+}
+
+func NewLearner() *Learner {
+	return &Learner{chosen: make(map[int]string), maxChosen: -1}
+}
+
+// Record a chosen value. Returns false if the slot was already known.
+func (l *Learner) Learn(slot int, value string) bool {
+	if _, ok := l.chosen[slot]; ok || slot < l.nextApply {
+		return false
+	}
+	l.chosen[slot] = value
+	l.maxChosen = max(l.maxChosen, slot)
+	return true
+}
+
+// Chosen entries that are ready to apply, in order
+func (l *Learner) Ready() []Entry {
+	var entries []Entry
+	for {
+		value, ok := l.chosen[l.nextApply]
+		if !ok {
+			break
+		}
+		entries = append(entries, Entry{Slot: l.nextApply, Value: value})
+		l.nextApply++
+	}
+	return entries
+}
+
+// Drop applied values below a slot, nodes can't catch up from them anymore
+func (l *Learner) Compact(below int) {
+	for ; l.compacted < min(below, l.nextApply); l.compacted++ {
+		delete(l.chosen, l.compacted)
+	}
+}
+
+// Lowest slot without a known chosen value
+func (l *Learner) NextSlot() int {
+	slot := l.nextApply
+	for {
+		if _, ok := l.chosen[slot]; !ok {
+			return slot
+		}
+		slot++
+	}
+}
+
+// Whether slots below the highest learned one are missing
+func (l *Learner) HasGap() bool {
+	return l.maxChosen >= l.nextApply
+}
+
+// Slots below the highest learned one without a known value, lowest first
+func (l *Learner) Missing() []int {
+	var slots []int
+	for slot := l.nextApply; slot < l.maxChosen; slot++ {
+		if _, ok := l.chosen[slot]; !ok {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// Number of entries handed out so far
+func (l *Learner) Applied() int {
+	return l.nextApply
+}
+
+// Known chosen entries from a slot onwards, in order. Fails if some of them
+// were already dropped.
+func (l *Learner) Entries(fromSlot int) ([]Entry, error) {
+	if fromSlot < l.compacted {
+		return nil, fmt.Errorf("slots before %d are compacted, can't catch up from slot %d", l.compacted, fromSlot)
+	}
+	var entries []Entry
+	for slot := fromSlot; slot <= l.maxChosen; slot++ {
+		if value, ok := l.chosen[slot]; ok {
+			entries = append(entries, Entry{Slot: slot, Value: value})
+		}
+	}
+	return entries, nil
+}
+
+// How far each node keeping a log applied it, from their answers to commits.
+// Slots below the lowest are stable: no node catches up from them or runs a
+// round for them anymore. Safe for concurrent use.
+type Progress struct {
+	mu      sync.Mutex
+	nodes   []string       // Addresses of the nodes keeping a log
+	applied map[string]int // Highest reported by each node
+}
+
+func NewProgress() *Progress {
+	return &Progress{applied: make(map[string]int)}
+}
+
+// Track these nodes from now on
+func (p *Progress) SetNodes(addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nodes = addrs
+}
+
+// A node applied the slots below applied. Nodes that don't answer, like
+// stopped ones, keep what they reported last.
+func (p *Progress) Report(addr string, applied int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.applied[addr] = max(p.applied[addr], applied)
+}
+
+// Slots below it were applied by every node, 0 until they all reported
+func (p *Progress) Stable() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nodes) == 0 {
+		return 0
+	}
+	stable := p.applied[p.nodes[0]]
+	for _, addr := range p.nodes[1:] {
+		stable = min(stable, p.applied[addr])
+	}
+	return stable
+}
+
+// Slots whose state can be dropped: stable ones more than retainedSlots
+// below the newest
+func compactBelow(stable int, newest int) int {
+	return min(stable, newest-retainedSlots)
+}
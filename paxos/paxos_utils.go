@@ -3,35 +3,77 @@ package paxos
 // Prepare phase request
 type PrepareRequest struct {
 	Id       int
+	Slot     int // Log position being decided
 	Proposal int
+	Token    string // Cluster credentials
+	TraceID  string // Trace of the client request being proposed
+	SpanID   string // Parent span on the proposer
 }
 
+// Proposer that sent the request, checked against its certificate with TLS
+func (req PrepareRequest) SenderID() int { return req.Id }
+
 // Prepare phase response
 type PrepareResponse struct {
 	Id            int
 	OK            bool
 	Proposal      int
 	AcceptedValue string
+	Reason        string // Why the prepare was rejected
+	Promised      int    // Rejected: ballot the acceptor has promised
 }
 
 // Accept phase request
 type AcceptRequest struct {
 	Id       int
+	Slot     int
 	Proposal int
 	Value    string
+	Token    string
+	TraceID  string
+	SpanID   string
 }
 
+func (req AcceptRequest) SenderID() int { return req.Id }
+
 // Accept phase response
 type AcceptResponse struct {
 	Id       int
 	OK       bool
 	Proposal int
+	Reason   string // Why the accept was rejected
+	Promised int    // Rejected: ballot the acceptor has promised
+}
+
+// Value chosen for a slot, sent to every node after the accept phase
+type CommitRequest struct {
+	Id      int
+	Slot    int
+	Value   string
+	Stable  int // Every node keeping a log applied the slots below it
+	Token   string
+	TraceID string
+	SpanID  string
+}
+
+func (req CommitRequest) SenderID() int { return req.Id }
+
+type CommitResponse struct {
+	Applied int // Slots the node applied, 0 from witnesses
+}
+
+// Chosen values from a slot onwards, used by lagging nodes to catch up
+type LearnedRequest struct {
+	FromSlot int
+	Token    string
 }
 
-// Colors for terminal
-const (
-	Green  = "\033[32m"
-	Yellow = "\033[33m"
-	Red    = "\033[31m"
-	Reset  = "\033[0m"
-)
+type LearnedResponse struct {
+	Entries []Entry
+}
+
+// Chosen log entry
+type Entry struct {
+	Slot  int
+	Value string
+}
@@ -1,121 +1,410 @@
 package paxos
 
 import (
+	"errors"
 	"fmt"
-	"net/rpc"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/derekjtong/mini-cloud/telemetry"
+	"github.com/derekjtong/mini-cloud/utils"
 )
 
+// Returned by a round when a previously accepted value was chosen instead of the client's
+var ErrNotClientValue = errors.New("consensus achieved, but was not client value")
+
+// Slots Propose tries before giving up when other values keep winning
+const maxSlotAttempts = 10
+
+// Ballot of the fast round every slot starts with in Fast Paxos. Classic
+// ballots are above it since node IDs start at 1.
+const FastBallot = 0
+
+// Connection to an acceptor, satisfied by *rpc.Client
+type Connection interface {
+	Call(serviceMethod string, args any, reply any) error
+}
+
+// Safe for concurrent use. Rounds run one at a time, so concurrent callers
+// queue and each gets the outcome of its own value.
 type Proposer struct {
+	mu             sync.Mutex // Held for a whole round, guards the round state and highestSeen
 	id             int
 	ProposalNumber int
 	Value          string
-	Acceptors      map[string]*rpc.Client // Given from node.go
+	Slot           int                   // Slot of the latest round
+	Acceptors      map[string]Connection // Given from node.go
+	Learners       map[string]Connection // Nodes that don't vote but are told what's chosen
+	Service        string                // RPC service of the acceptors, one per consensus group
+	Quorums        QuorumSystem          // Acceptors needed in each phase, majorities by default
+	Fast           bool                  // Try a fast round before each classic round
+	FastQuorum     int                   // Acceptors that must accept a value in a fast round
 
 	HighestAcceptedProposalNumber int
-	HighestAcceptedValue          string // Highest accepted value
-	Timeout                       bool
+	HighestAcceptedValue          string      // Highest accepted value
+	Timeout                       atomic.Bool // Stall rounds between the prepare and accept phases
 	OriginalRequest               string
+	Token                         string     // Cluster credentials sent to acceptors
+	NextSlot                      func() int // Lowest slot not known to be chosen, from the node's learner
+	Progress                      *Progress  // How far nodes applied, told to them in commits, nil to not track it
+	highestSeen                   int        // Highest ballot seen in rejections, guarded by mu
+	logger                        *slog.Logger
+	tracer                        *telemetry.Tracer
+	recorder                      *Recorder
 }
 
-func NewProposer(id int, proposalNumber int, acceptors map[string]*rpc.Client) *Proposer {
+func NewProposer(id int, proposalNumber int, acceptors map[string]Connection, logger *slog.Logger, tracer *telemetry.Tracer, recorder *Recorder) *Proposer {
 	return &Proposer{
 		id:                            id,
 		ProposalNumber:                proposalNumber,
+		Slot:                          -1,
 		Acceptors:                     acceptors,
+		Quorums:                       MajorityQuorums(len(acceptors)),
+		Service:                       "Paxos",
 		HighestAcceptedProposalNumber: -1,
+		NextSlot:                      func() int { return 0 },
+		logger:                        logger.With("role", "proposer"),
+		tracer:                        tracer,
+		recorder:                      recorder,
+	}
+}
+
+// Get value chosen in the next free slot of the log. When another value wins
+// a slot, it is committed there and the client value moves to the next slot.
+func (p *Proposer) Propose(value string, parent telemetry.SpanContext) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slot := p.NextSlot()
+	for attempt := 0; attempt < maxSlotAttempts; attempt++ {
+		_, err := p.runSlot(slot, value, parent)
+		if err == nil {
+			return slot, nil
+		}
+		if !errors.Is(err, ErrNotClientValue) {
+			return slot, err
+		}
+		// Slot taken, don't trust a learner that may not have seen our commit
+		slot = max(p.NextSlot(), slot+1)
+	}
+	return slot, fmt.Errorf("no free slot after %d attempts", maxSlotAttempts)
+}
+
+// Get a value chosen in a slot, with a fast round first in fast mode and a
+// classic round if that doesn't choose it. Returns ErrNotClientValue if
+// another value was chosen.
+func (p *Proposer) RunSlot(slot int, value string, parent telemetry.SpanContext) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.runSlot(slot, value, parent)
+}
+
+func (p *Proposer) runSlot(slot int, value string, parent telemetry.SpanContext) (string, error) {
+	if p.Fast && p.fastRound(slot, value, parent) == nil {
+		return value, nil
+	}
+	return p.runRound(slot, p.nextBallot(), value, parent)
+}
+
+// Send the value straight to the acceptors at FastBallot, without phase 1.
+// It's chosen if a fast quorum accepts it, otherwise the error says so.
+// Proposers sending different values at once collide, and a classic round
+// recovers the slot.
+func (p *Proposer) fastRound(slot int, value string, parent telemetry.SpanContext) (err error) {
+	logger := p.logger.With("slot", slot, "ballot", FastBallot, "trace_id", parent.TraceID)
+	span := p.tracer.Start(parent, "paxos.fast", telemetry.KindInternal)
+	defer span.Finish()
+	span.SetAttr("paxos.slot", slot)
+	span.SetAttr("paxos.value", value)
+	p.Slot, p.Value, p.OriginalRequest = slot, value, value
+	p.recorder.Record(Message{Type: MsgPropose, From: p.id, Slot: slot, Ballot: FastBallot, Value: value, FastQuorum: p.FastQuorum, TraceID: parent.TraceID})
+	defer func() { p.recordResult(slot, FastBallot, err, parent) }()
+
+	logger.Info("fast round", "value", value)
+	var accepted []int
+	for addr, acceptor := range p.Acceptors {
+		response, err := p.sendAcceptRequest(acceptor, addr, slot, FastBallot, value, span.Context())
+		if err != nil {
+			logger.Warn("fast accept request failed", "acceptor", addr, "error", err)
+			continue
+		}
+		if response.OK {
+			accepted = append(accepted, response.Id)
+		} else {
+			p.highestSeen = max(p.highestSeen, response.Promised)
+		}
+	}
+	span.SetAttr("paxos.accepts", len(accepted))
+	span.SetAttr("paxos.quorum", p.FastQuorum)
+	if len(accepted) < p.FastQuorum {
+		logger.Info("fast round failed, falling back to classic round", "accepted", accepted, "fast_quorum", p.FastQuorum)
+		span.Fail("no fast quorum")
+		return fmt.Errorf("failed to get fast quorum of %d", p.FastQuorum)
+	}
+	p.sendCommit(slot, value, span.Context())
+	return nil
+}
+
+// Record the outcome of a round, with the value it got chosen
+func (p *Proposer) recordResult(slot int, ballot int, err error, parent telemetry.SpanContext) {
+	result := Message{Type: MsgResult, From: p.id, Slot: slot, Ballot: ballot, Value: p.Value, TraceID: parent.TraceID}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	p.recorder.Record(result)
+}
+
+// Ballots are unique per node: round*NodeCount + id, above anything seen so far
+func (p *Proposer) nextBallot() int {
+	floor := max(p.ProposalNumber, p.highestSeen)
+	ballot := (floor/utils.NodeCount)*utils.NodeCount + p.id
+	for ballot <= floor {
+		ballot += utils.NodeCount
+	}
+	p.ProposalNumber = ballot
+	return ballot
+}
+
+// Run one Paxos instance for a slot and commit the chosen value. Returns
+// ErrNotClientValue if a previously accepted value had to be chosen instead.
+func (p *Proposer) RunRound(slot int, ballot int, value string, parent telemetry.SpanContext) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.runRound(slot, ballot, value, parent)
+}
+
+// Snapshot of the latest round, waits for a running round to finish
+type ProposerStatus struct {
+	Slot                          int
+	ProposalNumber                int
+	Value                         string
+	HighestAcceptedProposalNumber int
+	HighestAcceptedValue          string
+}
+
+func (p *Proposer) Status() ProposerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ProposerStatus{
+		Slot:                          p.Slot,
+		ProposalNumber:                p.ProposalNumber,
+		Value:                         p.Value,
+		HighestAcceptedProposalNumber: p.HighestAcceptedProposalNumber,
+		HighestAcceptedValue:          p.HighestAcceptedValue,
 	}
 }
 
-// Paxos
-func (p *Proposer) Propose(value string) error {
-	fmt.Printf("---PAXOS---\n")
+// RunRound with mu held
+func (p *Proposer) runRound(slot int, ballot int, value string, parent telemetry.SpanContext) (chosen string, err error) {
 	p.OriginalRequest = value
 	p.Value = value
-	proposalNumber := p.ProposalNumber + 1
-	p.ProposalNumber = proposalNumber
+	p.Slot = slot
+	logger := p.logger.With("slot", slot, "ballot", ballot, "trace_id", parent.TraceID)
+
+	span := p.tracer.Start(parent, "paxos.propose", telemetry.KindInternal)
+	span.SetAttr("paxos.slot", slot)
+	span.SetAttr("paxos.ballot", ballot)
+	span.SetAttr("paxos.client_value", value)
+	propose := Message{Type: MsgPropose, From: p.id, Slot: slot, Ballot: ballot, Value: value, TraceID: parent.TraceID}
+	if p.Fast {
+		// Replay needs it to recover fast rounds the same way
+		propose.FastQuorum = p.FastQuorum
+	}
+	p.recorder.Record(propose)
+	defer func() {
+		p.recordResult(slot, ballot, err, parent)
+		span.SetError(err)
+		span.Finish()
+	}()
 
 	// Phase 1: Prepare
-	fmt.Printf("------PHASE 1: PREPARE------\n")
-	fmt.Printf("Current proposal number: %d\n", p.ProposalNumber)
-	receivedPromises := 0
+	logger.Info("phase 1: prepare", "value", value)
+	phaseSpan := p.tracer.Start(span.Context(), "paxos.prepare", telemetry.KindInternal)
+	var promised []int // Acceptor IDs
+	fastVotes := make(map[string]int)
+	p.HighestAcceptedProposalNumber = -1
 	p.HighestAcceptedValue = ""
-	for _, acceptor := range p.Acceptors {
-		response, err := p.sendPrepareRequest(acceptor, proposalNumber)
+	for addr, acceptor := range p.Acceptors {
+		response, err := p.sendPrepareRequest(acceptor, addr, slot, ballot, phaseSpan.Context())
 		if err != nil {
+			logger.Warn("prepare request failed", "acceptor", addr, "error", err)
 			continue
 		}
 		if response.OK {
-			receivedPromises++
-			if response.Proposal > p.HighestAcceptedProposalNumber {
-				fmt.Printf("!!HIGHER ACCEPTED PROPOSAL DETECTED (%d > %d) - Changing accepted value from '%s' to '%s'\n", response.Proposal, p.HighestAcceptedProposalNumber, p.HighestAcceptedValue, response.AcceptedValue)
+			promised = append(promised, response.Id)
+			if response.Proposal == FastBallot && response.AcceptedValue != "" {
+				fastVotes[response.AcceptedValue]++
+			}
+			if response.Proposal > p.HighestAcceptedProposalNumber && response.AcceptedValue != "" {
+				logger.Info("higher accepted proposal detected", "accepted_ballot", response.Proposal, "highest_ballot", p.HighestAcceptedProposalNumber,
+					"old_value", p.HighestAcceptedValue, "value", response.AcceptedValue)
 				p.HighestAcceptedProposalNumber = response.Proposal
 				p.HighestAcceptedValue = response.AcceptedValue
 			}
+		} else {
+			p.highestSeen = max(p.highestSeen, response.Promised)
 		}
 	}
-	if p.HighestAcceptedProposalNumber != -1 && p.HighestAcceptedValue != "" {
+	if p.HighestAcceptedProposalNumber == FastBallot {
+		// Votes from a fast round only. A value can have been chosen there
+		// only if it has every vote of some fast quorum among these
+		// promises; there is at most one such value. Otherwise any value is
+		// safe.
+		p.Value = value
+		for v, votes := range fastVotes {
+			if votes >= p.FastQuorum+len(promised)-len(p.Acceptors) {
+				p.Value = v
+			}
+		}
+		logger.Info("recovering fast round", "votes", len(fastVotes), "value", p.Value)
+	} else if p.HighestAcceptedProposalNumber != -1 {
 		// Use the highest accepted value from the prepare phase
-		fmt.Printf("!!SENDING NEW VALUE - Changing send value from '%s' to '%s'\n", p.Value, p.HighestAcceptedValue)
+		logger.Info("sending previously accepted value", "old_value", p.Value, "value", p.HighestAcceptedValue)
 		p.Value = p.HighestAcceptedValue
 	}
 
-	if receivedPromises < len(p.Acceptors)/2+1 {
-		fmt.Printf("failed to gain consensus: accepted by %d nodes which is less than the majority requirement of %d\n", receivedPromises, len(p.Acceptors)/2+1)
-		return fmt.Errorf("failed to get majority in prepare phase")
+	phaseSpan.SetAttr("paxos.promises", len(promised))
+	phaseSpan.SetAttr("paxos.quorum", p.Quorums.String())
+	if !p.Quorums.Phase1(promised) {
+		logger.Warn("failed to gain consensus in prepare phase", "promised", promised, "quorum", p.Quorums)
+		phaseSpan.Fail("no quorum")
+		phaseSpan.Finish()
+		return "", fmt.Errorf("failed to get %s quorum in prepare phase", p.Quorums)
 	}
-	fmt.Printf("proceeding to accept phase: accepted by %d nodes which is greater than the majority requirement of %d\n", receivedPromises, len(p.Acceptors)/2+1)
+	phaseSpan.Finish()
+	logger.Info("proceeding to accept phase", "promised", promised, "quorum", p.Quorums)
 
-	if p.Timeout {
+	if p.Timeout.Load() {
 		time.Sleep(10 * time.Second)
 	}
 
 	// Phase 2: Accept
-	fmt.Printf("------PHASE 2: ACCEPT------\n")
-	fmt.Printf("Sending %s\n", p.Value)
-	acceptCount := 0
-	for _, acceptor := range p.Acceptors {
-		response, err := p.sendAcceptRequest(acceptor, p.ProposalNumber, p.Value)
+	logger.Info("phase 2: accept", "value", p.Value)
+	phaseSpan = p.tracer.Start(span.Context(), "paxos.accept", telemetry.KindInternal)
+	phaseSpan.SetAttr("paxos.value", p.Value)
+	var accepted []int
+	for addr, acceptor := range p.Acceptors {
+		response, err := p.sendAcceptRequest(acceptor, addr, slot, ballot, p.Value, phaseSpan.Context())
 		if err != nil {
+			logger.Warn("accept request failed", "acceptor", addr, "error", err)
 			continue
 		}
 		if response.OK {
-			acceptCount++
+			accepted = append(accepted, response.Id)
+		} else {
+			p.highestSeen = max(p.highestSeen, response.Promised)
 		}
 	}
 
-	if acceptCount < len(p.Acceptors)/2+1 {
-		return fmt.Errorf("failed to get majority in accept phase")
+	phaseSpan.SetAttr("paxos.accepts", len(accepted))
+	phaseSpan.SetAttr("paxos.quorum", p.Quorums.String())
+	if !p.Quorums.Phase2(accepted) {
+		logger.Warn("failed to gain consensus in accept phase", "accepted", accepted, "quorum", p.Quorums)
+		phaseSpan.Fail("no quorum")
+		phaseSpan.Finish()
+		return "", fmt.Errorf("failed to get %s quorum in accept phase", p.Quorums)
 	}
-	p.HighestAcceptedProposalNumber = proposalNumber
+	phaseSpan.Finish()
+
+	// Phase 3: Commit
+	p.sendCommit(slot, p.Value, span.Context())
 	if p.OriginalRequest != p.Value {
-		fmt.Printf("%sconsensus achieved, but was not client value\n%s", Yellow, Reset)
-		return fmt.Errorf("consensus achieved, but was not client value")
+		logger.Warn("consensus achieved, but was not client value", "value", p.Value, "client_value", p.OriginalRequest)
+		return p.Value, ErrNotClientValue
 	}
-	return nil
+	return p.Value, nil
 }
 
-func (p *Proposer) sendPrepareRequest(acceptor *rpc.Client, proposalNumber int) (*PrepareResponse, error) {
+func (p *Proposer) sendPrepareRequest(acceptor Connection, addr string, slot int, proposalNumber int, parent telemetry.SpanContext) (*PrepareResponse, error) {
+	span := p.tracer.Start(parent, "Paxos.Prepare", telemetry.KindClient)
+	defer span.Finish()
+	span.SetAttr("net.peer.name", addr)
+
 	request := PrepareRequest{
 		Id:       p.id,
+		Slot:     slot,
 		Proposal: proposalNumber,
+		Token:    p.Token,
+		TraceID:  span.TraceID,
+		SpanID:   span.SpanID,
 	}
-	fmt.Printf("  node %d: sending  - %#v\n", p.id, request)
+	p.logger.Debug("sending", "message", "prepare", "slot", slot, "ballot", proposalNumber)
+	p.recorder.Record(Message{Type: MsgPrepare, From: p.id, Slot: slot, Ballot: proposalNumber, Addr: addr, TraceID: request.TraceID})
 	var response PrepareResponse
-	err := acceptor.Call("Node.Prepare", request, &response)
+	err := acceptor.Call(p.Service+".Prepare", request, &response)
 
-	fmt.Printf("  node %d: received - %#v\n", p.id, response)
+	p.logger.Debug("received", "message", "promise", "slot", slot, "ballot", proposalNumber, "from", response.Id, "ok", response.OK,
+		"accepted_ballot", response.Proposal, "accepted_value", response.AcceptedValue)
+	recordResponse(span, err, response.Id, response.OK, response.Reason)
 	return &response, err
 }
 
-func (p *Proposer) sendAcceptRequest(acceptor *rpc.Client, proposalNumber int, value string) (*AcceptResponse, error) {
+func (p *Proposer) sendAcceptRequest(acceptor Connection, addr string, slot int, proposalNumber int, value string, parent telemetry.SpanContext) (*AcceptResponse, error) {
+	span := p.tracer.Start(parent, "Paxos.Accept", telemetry.KindClient)
+	defer span.Finish()
+	span.SetAttr("net.peer.name", addr)
+
 	request := AcceptRequest{
 		Id:       p.id,
+		Slot:     slot,
 		Proposal: proposalNumber,
 		Value:    value,
+		Token:    p.Token,
+		TraceID:  span.TraceID,
+		SpanID:   span.SpanID,
 	}
-	fmt.Printf("  node %d: sending  - %#v\n", p.id, request)
+	p.logger.Debug("sending", "message", "accept", "slot", slot, "ballot", proposalNumber, "value", value)
+	p.recorder.Record(Message{Type: MsgAccept, From: p.id, Slot: slot, Ballot: proposalNumber, Value: value, Addr: addr, TraceID: request.TraceID})
 	var response AcceptResponse
-	err := acceptor.Call("Node.Accept", request, &response)
+	err := acceptor.Call(p.Service+".Accept", request, &response)
+	recordResponse(span, err, response.Id, response.OK, response.Reason)
 	return &response, err
 }
+
+// Tell every acceptor and learner the chosen value, best effort. Nodes that
+// miss it catch up later.
+func (p *Proposer) sendCommit(slot int, value string, parent telemetry.SpanContext) {
+	span := p.tracer.Start(parent, "paxos.commit", telemetry.KindInternal)
+	defer span.Finish()
+	span.SetAttr("paxos.slot", slot)
+
+	p.recorder.Record(Message{Type: MsgCommit, From: p.id, Slot: slot, Value: value, TraceID: parent.TraceID})
+	request := CommitRequest{
+		Id:      p.id,
+		Slot:    slot,
+		Value:   value,
+		Stable:  p.Progress.Stable(),
+		Token:   p.Token,
+		TraceID: span.TraceID,
+		SpanID:  span.SpanID,
+	}
+	for _, nodes := range []map[string]Connection{p.Acceptors, p.Learners} {
+		for addr, node := range nodes {
+			var response CommitResponse
+			if err := node.Call(p.Service+".Commit", request, &response); err != nil {
+				p.logger.Warn("commit request failed", "slot", slot, "node", addr, "error", err)
+				continue
+			}
+			p.Progress.Report(addr, response.Applied)
+		}
+	}
+}
+
+// Record an acceptor's answer on its span
+func recordResponse(span *telemetry.Span, err error, acceptorID int, ok bool, reason string) {
+	if err != nil {
+		span.SetError(err)
+		return
+	}
+	span.SetAttr("paxos.acceptor", acceptorID)
+	span.SetAttr("paxos.ok", ok)
+	if !ok {
+		if reason == "" {
+			// Stopped nodes answer with an empty response
+			reason = "no response from acceptor"
+		}
+		span.SetAttr("paxos.reason", reason)
+		span.Fail("rejected: " + reason)
+	}
+}
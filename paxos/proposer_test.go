@@ -0,0 +1,166 @@
+package paxos
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/derekjtong/mini-cloud/logging"
+	"github.com/derekjtong/mini-cloud/telemetry"
+)
+
+// Connection straight to an acceptor in this process, recording its answers
+// like the Paxos service does. Calls to a down acceptor fail.
+type localConnection struct {
+	acceptor *Acceptor
+	recorder *Recorder
+	down     bool
+}
+
+func (c *localConnection) Call(serviceMethod string, args any, reply any) error {
+	if c.down {
+		return errors.New("connection refused")
+	}
+	_, method, _ := strings.Cut(serviceMethod, ".")
+	switch method {
+	case "Prepare":
+		req := args.(PrepareRequest)
+		res := reply.(*PrepareResponse)
+		*res = c.acceptor.Prepare(req.Slot, req.Proposal)
+		c.recorder.RecordPromise(req, *res)
+	case "Accept":
+		req := args.(AcceptRequest)
+		res := reply.(*AcceptResponse)
+		*res = c.acceptor.Accept(req.Slot, req.Proposal, req.Value)
+		c.recorder.RecordAccepted(req, *res)
+	case "Commit":
+	default:
+		return fmt.Errorf("unexpected call %s", serviceMethod)
+	}
+	return nil
+}
+
+// Acceptors 1 to n of a group, recording into dir if it isn't empty
+func localAcceptors(t *testing.T, n int, dir string, group int) map[int]*localConnection {
+	t.Helper()
+	conns := make(map[int]*localConnection, n)
+	for id := 1; id <= n; id++ {
+		conn := &localConnection{acceptor: NewAcceptor(id, logging.Discard())}
+		if dir != "" {
+			recorder, err := NewRecorder(id, group, acceptorAddr(id), filepath.Join(dir, fmt.Sprintf("node_%d_group_%d.jsonl", id, group)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.recorder = recorder
+		}
+		conns[id] = conn
+	}
+	return conns
+}
+
+func acceptorAddr(id int) string {
+	return fmt.Sprintf("127.0.0.1:%d", 9000+id)
+}
+
+// Fast round votes: acceptor i accepts votes[i-1] at FastBallot in slot 0
+func castFastVotes(t *testing.T, conns map[int]*localConnection, votes ...string) {
+	t.Helper()
+	for i, value := range votes {
+		req := AcceptRequest{Id: 99, Slot: 0, Proposal: FastBallot, Value: value}
+		var res AcceptResponse
+		if err := conns[i+1].Call("Paxos.Accept", req, &res); err != nil || !res.OK {
+			t.Fatalf("fast vote of acceptor %d for %q: %v %s", i+1, value, err, res.Reason)
+		}
+	}
+}
+
+func fastProposer(id int, conns map[int]*localConnection, recorder *Recorder) *Proposer {
+	acceptors := make(map[string]Connection, len(conns))
+	for id, conn := range conns {
+		acceptors[acceptorAddr(id)] = conn
+	}
+	p := NewProposer(id, id, acceptors, logging.Discard(), nil, recorder)
+	p.Fast, p.FastQuorum = true, FastQuorumSize(len(conns), p.Quorums.(Quorums).Phase1Size)
+	return p
+}
+
+// A value accepted by a fast quorum may have been chosen, a classic round
+// must pick it even when it sees fewer than a fast quorum of its votes
+func TestFastRoundRecovery(t *testing.T) {
+	// Map order decides which value a wrong rule picks, so try it repeatedly
+	for run := 0; run < 20; run++ {
+		conns := localAcceptors(t, 5, "", 0)
+		castFastVotes(t, conns, "a", "a", "a", "a", "b")
+		conns[1].down, conns[2].down = true, true
+
+		p := fastProposer(6, conns, nil)
+		if p.FastQuorum != 4 {
+			t.Fatalf("fast quorum %d with 5 acceptors, want 4", p.FastQuorum)
+		}
+		chosen, err := p.RunRound(0, 6, "c", telemetry.SpanContext{})
+		if !errors.Is(err, ErrNotClientValue) {
+			t.Fatalf("run %d: got error %v, want ErrNotClientValue", run, err)
+		}
+		if chosen != "a" {
+			t.Fatalf("run %d: chose %q, want %q which 4 acceptors accepted in the fast round", run, chosen, "a")
+		}
+	}
+}
+
+// Colliding fast rounds where no value reached a fast quorum choose nothing,
+// the classic round is free to propose its own value
+func TestFastRoundCollision(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		conns := localAcceptors(t, 5, "", 0)
+		castFastVotes(t, conns, "a", "a", "a", "b", "b")
+
+		p := fastProposer(6, conns, nil)
+		chosen, err := p.RunRound(0, 6, "c", telemetry.SpanContext{})
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if chosen != "c" {
+			t.Fatalf("run %d: chose %q, want the proposer's own value", run, chosen)
+		}
+	}
+}
+
+// Replay recovers a fast round with the fast quorum it was recorded with
+func TestReplayFastRoundRecovery(t *testing.T) {
+	dir := t.TempDir()
+	conns := localAcceptors(t, 5, dir, 0)
+	castFastVotes(t, conns, "a", "a", "a", "a", "b")
+	conns[1].down, conns[2].down = true, true
+
+	path := filepath.Join(dir, "node_6.jsonl")
+	recorder, err := NewRecorder(6, 0, "127.0.0.1:9006", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fastProposer(6, conns, recorder).RunRound(0, 6, "c", telemetry.SpanContext{}); !errors.Is(err, ErrNotClientValue) {
+		t.Fatalf("got error %v, want ErrNotClientValue", err)
+	}
+
+	paths := []string{path}
+	for id := 1; id <= 5; id++ {
+		paths = append(paths, filepath.Join(dir, fmt.Sprintf("node_%d_group_0.jsonl", id)))
+	}
+	messages, err := ReadMessages(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < 20; run++ {
+		report := Replay(messages)
+		if report.Proposals != 1 {
+			t.Fatalf("replayed %d proposals, want 1", report.Proposals)
+		}
+		for _, d := range report.Divergences {
+			t.Errorf("run %d: node %d %s diverged: %s", run, d.Node, d.Role, d.Message)
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
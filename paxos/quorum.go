@@ -0,0 +1,272 @@
+package paxos
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Quorum system kinds, see utils.QuorumSystem
+const (
+	QuorumMajority     = "majority"
+	QuorumWeighted     = "weighted"
+	QuorumGrid         = "grid"
+	QuorumHierarchical = "hierarchical"
+)
+
+// Decides which sets of acceptors, by node ID, can complete each phase.
+// Every phase 1 quorum must intersect every phase 2 quorum.
+type QuorumSystem interface {
+	Phase1(ids []int) bool
+	Phase2(ids []int) bool
+	String() string
+}
+
+// Quorum system from utils over the voting nodes
+func ConfiguredQuorums(nodes []int) (QuorumSystem, error) {
+	switch utils.QuorumSystem {
+	case QuorumMajority, "":
+		return NewQuorums(len(nodes), utils.Phase1Quorum, utils.Phase2Quorum)
+	case QuorumWeighted:
+		return NewWeighted(nodes, utils.QuorumWeights, utils.Phase1Quorum, utils.Phase2Quorum)
+	case QuorumGrid:
+		return NewGrid(nodes, utils.QuorumGroups)
+	case QuorumHierarchical:
+		return NewHierarchical(nodes, utils.QuorumGroups)
+	}
+	return nil, fmt.Errorf("unknown quorum system %q", utils.QuorumSystem)
+}
+
+// Node IDs 1 to n
+func NodeIDs(n int) []int {
+	nodes := make([]int, n)
+	for i := range nodes {
+		nodes[i] = i + 1
+	}
+	return nodes
+}
+
+// Number of acceptors that must answer each phase. Flexible Paxos only
+// needs every phase 1 quorum to intersect every phase 2 quorum, so with n
+// acceptors any sizes with Phase1+Phase2 > n are safe. A larger phase 1
+// quorum makes leader changes more expensive in exchange for fewer accepts
+// per write.
+type Quorums struct {
+	Phase1Size int
+	Phase2Size int
+}
+
+// Majorities for both phases
+func MajorityQuorums(n int) Quorums {
+	return Quorums{Phase1Size: n/2 + 1, Phase2Size: n/2 + 1}
+}
+
+// Quorums for n acceptors. Sizes left at 0 are majorities if both are
+// unset, otherwise the smallest size that intersects the other phase.
+func NewQuorums(n int, phase1 int, phase2 int) (Quorums, error) {
+	var q Quorums
+	q.Phase1Size, q.Phase2Size = intersectingThresholds(n, phase1, phase2)
+	return q, validateThresholds(n, q.Phase1Size, q.Phase2Size, "acceptors")
+}
+
+func (q Quorums) Phase1(ids []int) bool { return len(ids) >= q.Phase1Size }
+func (q Quorums) Phase2(ids []int) bool { return len(ids) >= q.Phase2Size }
+
+func (q Quorums) String() string {
+	return fmt.Sprintf("%d/%d acceptors", q.Phase1Size, q.Phase2Size)
+}
+
+// Smallest fast quorum for n acceptors and phase 1 quorums of phase1
+// acceptors: it must meet every phase 1 quorum, and any two fast quorums
+// must meet within every phase 1 quorum
+func FastQuorumSize(n int, phase1 int) int {
+	return max(n-phase1+1, (2*n-phase1)/2+1)
+}
+
+// Weighted voting: each node has a number of votes, nodes not listed have
+// one, and a phase needs its threshold of votes. Lets nodes in a primary
+// rack count more.
+type Weighted struct {
+	Weights     map[int]int
+	Phase1Votes int
+	Phase2Votes int
+	total       int
+}
+
+// Weighted quorums over nodes. Thresholds follow the same rules as
+// NewQuorums, counted in votes.
+func NewWeighted(nodes []int, weights map[int]int, phase1 int, phase2 int) (*Weighted, error) {
+	w := &Weighted{Weights: make(map[int]int, len(nodes))}
+	for id := range weights {
+		if !slices.Contains(nodes, id) {
+			return nil, fmt.Errorf("weight given for unknown node %d", id)
+		}
+	}
+	for _, id := range nodes {
+		votes, ok := weights[id]
+		if !ok {
+			votes = 1
+		}
+		if votes < 0 {
+			return nil, fmt.Errorf("node %d has negative weight %d", id, votes)
+		}
+		w.Weights[id] = votes
+		w.total += votes
+	}
+	w.Phase1Votes, w.Phase2Votes = intersectingThresholds(w.total, phase1, phase2)
+	return w, validateThresholds(w.total, w.Phase1Votes, w.Phase2Votes, "votes")
+}
+
+func (w *Weighted) votes(ids []int) int {
+	votes := 0
+	for _, id := range unique(ids) {
+		votes += w.Weights[id]
+	}
+	return votes
+}
+
+func (w *Weighted) Phase1(ids []int) bool { return w.votes(ids) >= w.Phase1Votes }
+func (w *Weighted) Phase2(ids []int) bool { return w.votes(ids) >= w.Phase2Votes }
+
+func (w *Weighted) String() string {
+	return fmt.Sprintf("weighted %d/%d of %d votes", w.Phase1Votes, w.Phase2Votes, w.total)
+}
+
+// Grid of failure domains, one row per rack or zone. Phase 2 needs every
+// node of some row, so steady-state writes stay within one domain. Phase 1
+// needs a node from every row, which always includes one of that row.
+type Grid struct {
+	Rows [][]int
+}
+
+func NewGrid(nodes []int, rows [][]int) (*Grid, error) {
+	if err := validateGroups(nodes, rows); err != nil {
+		return nil, err
+	}
+	return &Grid{Rows: rows}, nil
+}
+
+func (g *Grid) Phase1(ids []int) bool {
+	for _, row := range g.Rows {
+		if countIn(row, ids) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Grid) Phase2(ids []int) bool {
+	for _, row := range g.Rows {
+		if countIn(row, ids) == len(row) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Grid) String() string {
+	return fmt.Sprintf("grid %v", g.Rows)
+}
+
+// Majority of failure domains, each with a majority of its nodes, for both
+// phases. Survives losing a minority of domains plus a minority of nodes in
+// each remaining one.
+type Hierarchical struct {
+	Groups [][]int
+}
+
+func NewHierarchical(nodes []int, groups [][]int) (*Hierarchical, error) {
+	if err := validateGroups(nodes, groups); err != nil {
+		return nil, err
+	}
+	return &Hierarchical{Groups: groups}, nil
+}
+
+func (h *Hierarchical) quorum(ids []int) bool {
+	groups := 0
+	for _, group := range h.Groups {
+		if countIn(group, ids) > len(group)/2 {
+			groups++
+		}
+	}
+	return groups > len(h.Groups)/2
+}
+
+func (h *Hierarchical) Phase1(ids []int) bool { return h.quorum(ids) }
+func (h *Hierarchical) Phase2(ids []int) bool { return h.quorum(ids) }
+
+func (h *Hierarchical) String() string {
+	return fmt.Sprintf("hierarchical %v", h.Groups)
+}
+
+// Fill in unset thresholds out of total: majorities if neither is set,
+// otherwise the smallest one intersecting the other
+func intersectingThresholds(total int, phase1 int, phase2 int) (int, int) {
+	switch {
+	case phase1 == 0 && phase2 == 0:
+		return total/2 + 1, total/2 + 1
+	case phase1 == 0:
+		return total - phase2 + 1, phase2
+	case phase2 == 0:
+		return phase1, total - phase1 + 1
+	}
+	return phase1, phase2
+}
+
+func validateThresholds(total int, phase1 int, phase2 int, unit string) error {
+	if phase1 < 1 || phase1 > total {
+		return fmt.Errorf("phase 1 quorum %d must be between 1 and %d %s", phase1, total, unit)
+	}
+	if phase2 < 1 || phase2 > total {
+		return fmt.Errorf("phase 2 quorum %d must be between 1 and %d %s", phase2, total, unit)
+	}
+	if phase1+phase2 <= total {
+		return fmt.Errorf("phase 1 quorum %d and phase 2 quorum %d don't intersect, they must add up to more than %d %s", phase1, phase2, total, unit)
+	}
+	return nil
+}
+
+// Groups must split the nodes, each node in exactly one non-empty group
+func validateGroups(nodes []int, groups [][]int) error {
+	if len(groups) == 0 {
+		return fmt.Errorf("no groups of nodes configured")
+	}
+	var seen []int
+	for _, group := range groups {
+		if len(group) == 0 {
+			return fmt.Errorf("empty group")
+		}
+		for _, id := range group {
+			if !slices.Contains(nodes, id) {
+				return fmt.Errorf("group contains unknown node %d", id)
+			}
+			if slices.Contains(seen, id) {
+				return fmt.Errorf("node %d is in more than one group", id)
+			}
+			seen = append(seen, id)
+		}
+	}
+	if len(seen) != len(nodes) {
+		slices.Sort(seen)
+		return fmt.Errorf("groups cover nodes %v, not all of %v", seen, nodes)
+	}
+	return nil
+}
+
+// Number of distinct ids in group
+func countIn(group []int, ids []int) int {
+	count := 0
+	for _, id := range unique(ids) {
+		if slices.Contains(group, id) {
+			count++
+		}
+	}
+	return count
+}
+
+func unique(ids []int) []int {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
@@ -0,0 +1,167 @@
+package paxos
+
+import (
+	"testing"
+)
+
+func TestNewQuorums(t *testing.T) {
+	tests := []struct {
+		n, phase1, phase2 int
+		want              Quorums
+	}{
+		{3, 0, 0, Quorums{2, 2}},
+		{5, 0, 0, Quorums{3, 3}},
+		{4, 0, 0, Quorums{3, 3}},
+		{5, 4, 2, Quorums{4, 2}},
+		// An unset size is the smallest that intersects the other
+		{5, 4, 0, Quorums{4, 2}},
+		{5, 0, 2, Quorums{4, 2}},
+		{5, 5, 0, Quorums{5, 1}},
+	}
+	for _, tt := range tests {
+		q, err := NewQuorums(tt.n, tt.phase1, tt.phase2)
+		if err != nil {
+			t.Errorf("NewQuorums(%d, %d, %d): %v", tt.n, tt.phase1, tt.phase2, err)
+			continue
+		}
+		if q != tt.want {
+			t.Errorf("NewQuorums(%d, %d, %d) = %+v, want %+v", tt.n, tt.phase1, tt.phase2, q, tt.want)
+		}
+	}
+}
+
+func TestNewQuorumsRejects(t *testing.T) {
+	tests := []struct {
+		name              string
+		n, phase1, phase2 int
+	}{
+		{"not intersecting", 5, 3, 2},
+		{"not intersecting, smaller", 5, 2, 2},
+		{"phase 1 too large", 5, 6, 2},
+		{"phase 2 too large", 5, 4, 6},
+		{"negative", 5, -1, 3},
+	}
+	for _, tt := range tests {
+		if _, err := NewQuorums(tt.n, tt.phase1, tt.phase2); err == nil {
+			t.Errorf("%s: NewQuorums(%d, %d, %d) succeeded", tt.name, tt.n, tt.phase1, tt.phase2)
+		}
+	}
+}
+
+func TestQuorumsPhases(t *testing.T) {
+	q, err := NewQuorums(5, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Phase1([]int{1, 2, 3}) || !q.Phase1([]int{1, 2, 3, 4}) {
+		t.Errorf("phase 1 of %v should need 4 acceptors", q)
+	}
+	if q.Phase2([]int{1}) || !q.Phase2([]int{4, 5}) {
+		t.Errorf("phase 2 of %v should need 2 acceptors", q)
+	}
+	assertIntersecting(t, q, NodeIDs(5))
+}
+
+func TestWeighted(t *testing.T) {
+	// Node 1 has 3 votes, 7 in total
+	w, err := NewWeighted(NodeIDs(5), map[int]int{1: 3}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Phase1Votes != 4 || w.Phase2Votes != 4 {
+		t.Errorf("thresholds %d/%d, want majorities 4/4 of 7 votes", w.Phase1Votes, w.Phase2Votes)
+	}
+	if !w.Phase2([]int{1, 2}) {
+		t.Errorf("node 1 and 2 have 4 votes, should be a quorum")
+	}
+	if w.Phase2([]int{2, 3, 4}) {
+		t.Errorf("nodes 2 to 4 have 3 votes, shouldn't be a quorum")
+	}
+	if w.Phase2([]int{2, 2, 2, 3}) {
+		t.Errorf("repeated nodes counted more than once")
+	}
+	assertIntersecting(t, w, NodeIDs(5))
+
+	flexible, err := NewWeighted(NodeIDs(5), map[int]int{1: 3}, 6, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flexible.Phase2Votes != 2 {
+		t.Errorf("phase 2 threshold %d, want 2 to intersect 6 of 7 votes", flexible.Phase2Votes)
+	}
+	assertIntersecting(t, flexible, NodeIDs(5))
+
+	if _, err := NewWeighted(NodeIDs(5), map[int]int{1: 3}, 3, 3); err == nil {
+		t.Errorf("3/3 of 7 votes don't intersect, should be rejected")
+	}
+	if _, err := NewWeighted(NodeIDs(3), map[int]int{4: 1}, 0, 0); err == nil {
+		t.Errorf("weight for unknown node should be rejected")
+	}
+	if _, err := NewWeighted(NodeIDs(3), map[int]int{1: -1}, 0, 0); err == nil {
+		t.Errorf("negative weight should be rejected")
+	}
+}
+
+func TestGrid(t *testing.T) {
+	g, err := NewGrid(NodeIDs(6), [][]int{{1, 2, 3}, {4, 5, 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Phase2([]int{4, 5, 6}) || g.Phase2([]int{1, 2, 4, 5}) {
+		t.Errorf("phase 2 should need a full row")
+	}
+	if !g.Phase1([]int{3, 4}) || g.Phase1([]int{1, 2, 3}) {
+		t.Errorf("phase 1 should need a node of every row")
+	}
+	assertIntersecting(t, g, NodeIDs(6))
+
+	if _, err := NewGrid(NodeIDs(6), [][]int{{1, 2, 3}, {4, 5}}); err == nil {
+		t.Errorf("rows missing a node should be rejected")
+	}
+	if _, err := NewGrid(NodeIDs(6), [][]int{{1, 2, 3}, {3, 4, 5, 6}}); err == nil {
+		t.Errorf("node in two rows should be rejected")
+	}
+}
+
+func TestHierarchical(t *testing.T) {
+	h, err := NewHierarchical(NodeIDs(9), [][]int{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Phase1([]int{1, 2, 4, 5}) || !h.Phase2([]int{1, 2, 4, 5}) {
+		t.Errorf("majorities of 2 of 3 groups should be a quorum")
+	}
+	if h.Phase1([]int{1, 2, 3, 4, 7}) {
+		t.Errorf("a majority of only one group shouldn't be a quorum")
+	}
+	assertIntersecting(t, h, NodeIDs(9))
+
+	if _, err := NewHierarchical(NodeIDs(3), nil); err == nil {
+		t.Errorf("no groups should be rejected")
+	}
+}
+
+// Every phase 1 quorum must meet every phase 2 quorum
+func assertIntersecting(t *testing.T, q QuorumSystem, nodes []int) {
+	t.Helper()
+	subsets := func(mask int) []int {
+		var ids []int
+		for i, id := range nodes {
+			if mask&(1<<i) != 0 {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	all := 1 << len(nodes)
+	for a := 0; a < all; a++ {
+		if !q.Phase1(subsets(a)) {
+			continue
+		}
+		for b := 0; b < all; b++ {
+			if a&b == 0 && q.Phase2(subsets(b)) {
+				t.Fatalf("%v: phase 1 quorum %v and phase 2 quorum %v don't intersect", q, subsets(a), subsets(b))
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package paxos
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Recorded message types
+const (
+	MsgPropose  = "propose"  // Client value handed to a proposer
+	MsgPrepare  = "prepare"  // Phase 1a
+	MsgPromise  = "promise"  // Phase 1b, OK
+	MsgAccept   = "accept"   // Phase 2a
+	MsgAccepted = "accepted" // Phase 2b, OK
+	MsgNack     = "nack"     // Rejected prepare or accept
+	MsgCommit   = "commit"   // Chosen value sent to all nodes
+	MsgResult   = "result"   // Outcome of a proposal
+	MsgCompact  = "compact"  // Acceptor dropped the state of slots below Slot
+)
+
+// One protocol message as seen by the recording node
+type Message struct {
+	Seq            int64
+	Time           time.Time
+	Recorder       int // Node that wrote the record
+	Group          int `json:",omitempty"` // Consensus group, 0 for the one every node is in
+	Type           string
+	From           int
+	To             int
+	Addr           string `json:",omitempty"` // Address of the acceptor involved
+	Slot           int
+	Ballot         int
+	Value          string `json:",omitempty"` // Client value, or value sent in accept
+	AcceptedBallot int    `json:",omitempty"` // Promise: previously accepted ballot
+	AcceptedValue  string `json:",omitempty"` // Promise: previously accepted value
+	Phase          string `json:",omitempty"` // Nack: prepare or accept
+	Reason         string `json:",omitempty"` // Nack: why it was rejected
+	Error          string `json:",omitempty"` // Result: proposal error
+	FastQuorum     int    `json:",omitempty"` // Propose: fast quorum size, 0 without Fast Paxos
+	TraceID        string `json:",omitempty"`
+}
+
+// Appends messages to a JSON lines file. A nil recorder records nothing.
+type Recorder struct {
+	mu     sync.Mutex
+	nodeID int
+	group  int
+	addr   string
+	seq    int64
+	file   *os.File
+}
+
+func NewRecorder(nodeID int, group int, addr string, path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating message trace directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening message trace file: %v", err)
+	}
+	return &Recorder{nodeID: nodeID, group: group, addr: addr, file: file}, nil
+}
+
+func (r *Recorder) Record(m Message) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	m.Seq = r.seq
+	m.Recorder = r.nodeID
+	m.Group = r.group
+	m.Time = time.Now()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	r.file.Write(append(data, '\n'))
+}
+
+// Record an acceptor's answer to a prepare
+func (r *Recorder) RecordPromise(req PrepareRequest, res PrepareResponse) {
+	if r == nil {
+		return
+	}
+	if res.OK {
+		r.Record(Message{Type: MsgPromise, From: r.nodeID, To: req.Id, Addr: r.addr, Slot: req.Slot, Ballot: req.Proposal,
+			AcceptedBallot: res.Proposal, AcceptedValue: res.AcceptedValue, TraceID: req.TraceID})
+	} else {
+		r.Record(Message{Type: MsgNack, Phase: MsgPrepare, From: r.nodeID, To: req.Id, Addr: r.addr, Slot: req.Slot, Ballot: req.Proposal,
+			Reason: res.Reason, TraceID: req.TraceID})
+	}
+}
+
+// Record an acceptor's answer to an accept
+func (r *Recorder) RecordAccepted(req AcceptRequest, res AcceptResponse) {
+	if r == nil {
+		return
+	}
+	if res.OK {
+		r.Record(Message{Type: MsgAccepted, From: r.nodeID, To: req.Id, Addr: r.addr, Slot: req.Slot, Ballot: req.Proposal,
+			Value: req.Value, TraceID: req.TraceID})
+	} else {
+		r.Record(Message{Type: MsgNack, Phase: MsgAccept, From: r.nodeID, To: req.Id, Addr: r.addr, Slot: req.Slot, Ballot: req.Proposal,
+			Value: req.Value, Reason: res.Reason, TraceID: req.TraceID})
+	}
+}
+
+// Read messages from one or more trace files
+func ReadMessages(paths ...string) ([]Message, error) {
+	var messages []Message
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var m Message
+			if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			messages = append(messages, m)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
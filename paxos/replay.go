@@ -0,0 +1,285 @@
+package paxos
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/derekjtong/mini-cloud/logging"
+	"github.com/derekjtong/mini-cloud/telemetry"
+)
+
+// Difference between a recorded run and its replay
+type Divergence struct {
+	Node    int
+	Group   int    // Consensus group the node ran it in
+	Role    string // acceptor or proposer
+	Seq     int64  // Recorded message the replay disagreed with
+	Message string
+}
+
+type ReplayReport struct {
+	AcceptorSteps int // Prepare/accept requests re-executed on acceptors
+	Proposals     int // Rounds re-executed on proposers, fast ones included
+	Divergences   []Divergence
+}
+
+// Re-execute recorded messages on fresh acceptors and proposers and report
+// where their behavior differs from the recording
+func Replay(messages []Message) ReplayReport {
+	var report ReplayReport
+	replayAcceptors(messages, &report)
+	replayProposers(messages, &report)
+	sort.SliceStable(report.Divergences, func(i, j int) bool {
+		a, b := report.Divergences[i], report.Divergences[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Node != b.Node {
+			return a.Node < b.Node
+		}
+		return a.Seq < b.Seq
+	})
+	return report
+}
+
+// Node in one consensus group, a node of several groups records each apart
+type replica struct {
+	group int
+	node  int
+}
+
+// Messages recorded by each node in each group, in recording order
+func byRecorder(messages []Message, keep func(Message) bool) map[replica][]Message {
+	groups := make(map[replica][]Message)
+	for _, m := range messages {
+		if keep(m) {
+			r := replica{m.Group, m.Recorder}
+			groups[r] = append(groups[r], m)
+		}
+	}
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool { return group[i].Seq < group[j].Seq })
+	}
+	return groups
+}
+
+func sortedKeys(groups map[replica][]Message) []replica {
+	keys := make([]replica, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].node < keys[j].node
+	})
+	return keys
+}
+
+// Acceptor answers, recorded by the acceptor itself
+func isAcceptorRecord(m Message) bool {
+	switch m.Type {
+	case MsgPromise, MsgAccepted, MsgNack:
+		return m.From == m.Recorder
+	}
+	return false
+}
+
+func replayAcceptors(messages []Message, report *ReplayReport) {
+	groups := byRecorder(messages, func(m Message) bool {
+		return isAcceptorRecord(m) || m.Type == MsgCompact && m.From == m.Recorder
+	})
+	for _, r := range sortedKeys(groups) {
+		acceptor := NewAcceptor(r.node, logging.Discard())
+		diverge := func(m Message, format string, args ...any) {
+			report.Divergences = append(report.Divergences, Divergence{
+				Node: r.node, Group: r.group, Role: "acceptor", Seq: m.Seq, Message: fmt.Sprintf(format, args...),
+			})
+		}
+
+		for _, m := range groups[r] {
+			if m.Type == MsgCompact {
+				// Requests for the dropped slots are refused from here on
+				acceptor.Compact(m.Slot)
+				continue
+			}
+			report.AcceptorSteps++
+			if m.Type == MsgPromise || (m.Type == MsgNack && m.Phase == MsgPrepare) {
+				res := acceptor.Prepare(m.Slot, m.Ballot)
+				wantOK := m.Type == MsgPromise
+				if res.OK != wantOK {
+					diverge(m, "slot %d prepare ballot %d from node %d: recorded ok=%t, replay %s", m.Slot, m.Ballot, m.To, wantOK, describeAnswer(res.OK, res.Reason))
+				} else if res.OK && (res.Proposal != m.AcceptedBallot || res.AcceptedValue != m.AcceptedValue) {
+					diverge(m, "slot %d promise ballot %d to node %d: recorded accepted (%d, %q), replay accepted (%d, %q)",
+						m.Slot, m.Ballot, m.To, m.AcceptedBallot, m.AcceptedValue, res.Proposal, res.AcceptedValue)
+				}
+			} else {
+				res := acceptor.Accept(m.Slot, m.Ballot, m.Value)
+				wantOK := m.Type == MsgAccepted
+				if res.OK != wantOK {
+					diverge(m, "slot %d accept ballot %d from node %d: recorded ok=%t, replay %s", m.Slot, m.Ballot, m.To, wantOK, describeAnswer(res.OK, res.Reason))
+				}
+			}
+		}
+	}
+}
+
+// Key for looking up a recorded message between a proposer and an acceptor
+type exchangeKey struct {
+	group    int
+	proposer int
+	slot     int
+	ballot   int
+	addr     string
+	phase    string
+}
+
+// Connection that answers from the recording instead of the network
+type replayConnection struct {
+	group     int
+	addr      string
+	proposer  *int
+	responses map[exchangeKey]Message
+	sent      map[exchangeKey]string // Values sent in accept during replay
+}
+
+func (c *replayConnection) Call(serviceMethod string, args any, reply any) error {
+	// Every group has a service of its own, Paxos or PaxosGroup<id>
+	_, method, _ := strings.Cut(serviceMethod, ".")
+	switch method {
+	case "Prepare":
+		req := args.(PrepareRequest)
+		res := reply.(*PrepareResponse)
+		m, ok := c.responses[exchangeKey{c.group, *c.proposer, req.Slot, req.Proposal, c.addr, MsgPrepare}]
+		if !ok {
+			// Acceptor didn't answer in the recording
+			return nil
+		}
+		*res = PrepareResponse{Id: m.From, OK: m.Type == MsgPromise, Proposal: m.AcceptedBallot, AcceptedValue: m.AcceptedValue, Reason: m.Reason}
+	case "Accept":
+		req := args.(AcceptRequest)
+		res := reply.(*AcceptResponse)
+		key := exchangeKey{c.group, *c.proposer, req.Slot, req.Proposal, c.addr, MsgAccept}
+		c.sent[key] = req.Value
+		m, ok := c.responses[key]
+		if !ok {
+			return nil
+		}
+		*res = AcceptResponse{Id: m.From, OK: m.Type == MsgAccepted, Proposal: m.Ballot, Reason: m.Reason}
+	case "Commit":
+		// Learners aren't replayed
+	default:
+		return fmt.Errorf("replay: unexpected call %s", serviceMethod)
+	}
+	return nil
+}
+
+func replayProposers(messages []Message, report *ReplayReport) {
+	// Acceptor answers and proposer sends, indexed by exchange
+	responses := make(map[exchangeKey]Message)
+	sends := make(map[exchangeKey]Message)
+	results := make(map[exchangeKey]Message)
+	addrs := make(map[int]map[string]bool) // Acceptor addresses by group
+	addAddr := func(m Message) {
+		if addrs[m.Group] == nil {
+			addrs[m.Group] = make(map[string]bool)
+		}
+		addrs[m.Group][m.Addr] = true
+	}
+	for _, m := range messages {
+		switch {
+		case isAcceptorRecord(m):
+			phase := m.Phase
+			if m.Type == MsgPromise {
+				phase = MsgPrepare
+			} else if m.Type == MsgAccepted {
+				phase = MsgAccept
+			}
+			responses[exchangeKey{m.Group, m.To, m.Slot, m.Ballot, m.Addr, phase}] = m
+			addAddr(m)
+		case m.Type == MsgPrepare || m.Type == MsgAccept:
+			sends[exchangeKey{m.Group, m.From, m.Slot, m.Ballot, m.Addr, m.Type}] = m
+			addAddr(m)
+		case m.Type == MsgResult:
+			results[exchangeKey{group: m.Group, proposer: m.From, slot: m.Slot, ballot: m.Ballot}] = m
+		}
+	}
+
+	groups := byRecorder(messages, func(m Message) bool { return m.Type == MsgPropose && m.From == m.Recorder })
+	for _, r := range sortedKeys(groups) {
+		nodeID := r.node
+		diverge := func(m Message, format string, args ...any) {
+			report.Divergences = append(report.Divergences, Divergence{
+				Node: nodeID, Group: r.group, Role: "proposer", Seq: m.Seq, Message: fmt.Sprintf(format, args...),
+			})
+		}
+
+		proposerID := nodeID
+		sent := make(map[exchangeKey]string)
+		acceptors := make(map[string]Connection, len(addrs[r.group]))
+		for addr := range addrs[r.group] {
+			acceptors[addr] = &replayConnection{group: r.group, addr: addr, proposer: &proposerID, responses: responses, sent: sent}
+		}
+		proposer := NewProposer(nodeID, nodeID, acceptors, logging.Discard(), nil, nil)
+		// Quorum settings are for group 0, shard groups use majorities
+		if quorums, err := ConfiguredQuorums(NodeIDs(len(acceptors))); err == nil && r.group == 0 {
+			proposer.Quorums = quorums
+		}
+
+		for _, m := range groups[r] {
+			report.Proposals++
+			// Which fast votes a round recovers depends on the fast quorum
+			proposer.Fast, proposer.FastQuorum = m.FastQuorum > 0, m.FastQuorum
+			var err error
+			if proposer.Fast && m.Ballot == FastBallot {
+				proposer.mu.Lock()
+				err = proposer.fastRound(m.Slot, m.Value, telemetry.SpanContext{})
+				proposer.mu.Unlock()
+			} else {
+				_, err = proposer.RunRound(m.Slot, m.Ballot, m.Value, telemetry.SpanContext{})
+			}
+
+			for addr := range addrs[r.group] {
+				key := exchangeKey{r.group, nodeID, m.Slot, m.Ballot, addr, MsgAccept}
+				value, replayed := sent[key]
+				recorded, wasRecorded := sends[key]
+				switch {
+				case replayed && !wasRecorded:
+					diverge(m, "slot %d ballot %d: replay sent accept %q to %s, recording has none", m.Slot, m.Ballot, value, addr)
+				case !replayed && wasRecorded:
+					diverge(recorded, "slot %d ballot %d: recording sent accept %q to %s, replay sent none", m.Slot, m.Ballot, recorded.Value, addr)
+				case replayed && value != recorded.Value:
+					diverge(recorded, "slot %d ballot %d: accept to %s recorded value %q, replay value %q", m.Slot, m.Ballot, addr, recorded.Value, value)
+				}
+			}
+
+			result, ok := results[exchangeKey{group: r.group, proposer: nodeID, slot: m.Slot, ballot: m.Ballot}]
+			if !ok {
+				continue
+			}
+			replayErr := ""
+			if err != nil {
+				replayErr = err.Error()
+			}
+			if replayErr != result.Error {
+				diverge(result, "slot %d ballot %d: recorded result %q, replay result %q", m.Slot, m.Ballot, describeResult(result.Error), describeResult(replayErr))
+			}
+		}
+	}
+}
+
+func describeResult(err string) string {
+	if err == "" {
+		return "ok"
+	}
+	return err
+}
+
+func describeAnswer(ok bool, reason string) string {
+	if ok {
+		return "ok=true"
+	}
+	return fmt.Sprintf("ok=false (%s)", reason)
+}
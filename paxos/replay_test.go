@@ -0,0 +1,99 @@
+package paxos
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/derekjtong/mini-cloud/logging"
+	"github.com/derekjtong/mini-cloud/telemetry"
+)
+
+// Nodes in several groups run the same slots and ballots in each, replay
+// keeps the groups apart
+func TestReplayGroups(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for group := 0; group <= 2; group++ {
+		conns := localAcceptors(t, 3, dir, group)
+		acceptors := make(map[string]Connection, len(conns))
+		for id, conn := range conns {
+			acceptors[acceptorAddr(id)] = conn
+			paths = append(paths, filepath.Join(dir, fmt.Sprintf("node_%d_group_%d.jsonl", id, group)))
+		}
+		path := filepath.Join(dir, fmt.Sprintf("node_4_group_%d.jsonl", group))
+		recorder, err := NewRecorder(4, group, "127.0.0.1:9004", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+
+		p := NewProposer(4, 4, acceptors, logging.Discard(), nil, recorder)
+		if group != 0 {
+			p.Service = fmt.Sprintf("PaxosGroup%d", group)
+		}
+		for slot := 0; slot < 2; slot++ {
+			if _, err := p.RunRound(slot, 4, fmt.Sprintf("group %d slot %d", group, slot), telemetry.SpanContext{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	messages, err := ReadMessages(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Replay(messages)
+	if report.Proposals != 6 || report.AcceptorSteps != 36 {
+		t.Errorf("replayed %d proposals and %d acceptor steps, want 6 and 36", report.Proposals, report.AcceptorSteps)
+	}
+	for _, d := range report.Divergences {
+		t.Errorf("node %d group %d %s diverged: %s", d.Node, d.Group, d.Role, d.Message)
+	}
+}
+
+// Fast rounds, the classic rounds they fall back to and requests for slots
+// the acceptors compacted replay the way they ran
+func TestReplayFastRoundsAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	conns := localAcceptors(t, 3, dir, 0)
+	paths := []string{filepath.Join(dir, "node_4_group_0.jsonl")}
+	for id := range conns {
+		paths = append(paths, filepath.Join(dir, fmt.Sprintf("node_%d_group_0.jsonl", id)))
+	}
+	recorder, err := NewRecorder(4, 0, "127.0.0.1:9004", paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := fastProposer(4, conns, recorder)
+
+	if _, err := p.RunSlot(0, "a", telemetry.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+	// Too few acceptors for a fast quorum, slot 1 takes a classic round
+	conns[3].down = true
+	if _, err := p.RunSlot(1, "b", telemetry.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+	conns[3].down = false
+	for id, conn := range conns {
+		if conn.acceptor.Compact(2) {
+			conn.recorder.Record(Message{Type: MsgCompact, From: id, Slot: 2})
+		}
+	}
+	if _, err := p.RunRound(1, 8, "c", telemetry.SpanContext{}); err == nil {
+		t.Fatal("round for a compacted slot succeeded")
+	}
+
+	messages, err := ReadMessages(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Replay(messages)
+	if report.Proposals != 4 {
+		t.Errorf("replayed %d proposals, want 2 fast and 2 classic rounds", report.Proposals)
+	}
+	for _, d := range report.Divergences {
+		t.Errorf("node %d %s diverged: %s", d.Node, d.Role, d.Message)
+	}
+}
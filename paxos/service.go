@@ -0,0 +1,136 @@
+package paxos
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/store"
+	"github.com/derekjtong/mini-cloud/telemetry"
+)
+
+// Paxos traffic between nodes
+type Service struct {
+	engine *Engine
+}
+
+// Returned to proposers asking a learner to vote
+var errNotVoter = errors.New("learners don't vote")
+
+// Whether to answer a request, an error if its sender isn't a node
+func (s *Service) answer(token string) (bool, error) {
+	if _, err := auth.Require(token, auth.RolePeer); err != nil {
+		return false, err
+	}
+	return !s.engine.cfg.Faults.Stop.Load(), nil
+}
+
+// RPC: Prepare
+func (s *Service) Prepare(req *PrepareRequest, res *PrepareResponse) error {
+	e := s.engine
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	if e.cfg.Role == consensus.RoleLearner {
+		return errNotVoter
+	}
+	e.cfg.Logger.Debug("received", "message", "prepare", "from", req.Id, "slot", req.Slot, "ballot", req.Proposal)
+	span := e.cfg.Tracer.Start(telemetry.SpanContext{TraceID: req.TraceID, SpanID: req.SpanID}, "acceptor.prepare", telemetry.KindServer)
+	defer span.Finish()
+
+	*res = e.acceptor.Prepare(req.Slot, req.Proposal)
+	e.recorder.RecordPromise(*req, *res)
+	recordAcceptorSpan(span, req.Slot, req.Proposal, res.OK, res.Reason)
+	return nil
+}
+
+// RPC: Accept
+func (s *Service) Accept(req *AcceptRequest, res *AcceptResponse) error {
+	e := s.engine
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	if e.cfg.Role == consensus.RoleLearner {
+		return errNotVoter
+	}
+	e.cfg.Logger.Debug("received", "message", "accept", "from", req.Id, "slot", req.Slot, "ballot", req.Proposal, "value", req.Value)
+	span := e.cfg.Tracer.Start(telemetry.SpanContext{TraceID: req.TraceID, SpanID: req.SpanID}, "acceptor.accept", telemetry.KindServer)
+	defer span.Finish()
+
+	*res = e.acceptor.Accept(req.Slot, req.Proposal, req.Value)
+	e.recorder.RecordAccepted(*req, *res)
+	recordAcceptorSpan(span, req.Slot, req.Proposal, res.OK, res.Reason)
+	return nil
+}
+
+// RPC: Commit - a value was chosen for a slot
+func (s *Service) Commit(req *CommitRequest, res *CommitResponse) error {
+	e := s.engine
+	if ok, err := s.answer(req.Token); !ok {
+		return err
+	}
+	// Witnesses keep no log, only their acceptor state for recent slots
+	if e.cfg.Role == consensus.RoleWitness {
+		e.compactAcceptor(compactBelow(req.Stable, req.Slot))
+		return nil
+	}
+	span := e.cfg.Tracer.Start(telemetry.SpanContext{TraceID: req.TraceID, SpanID: req.SpanID}, "learner.commit", telemetry.KindServer)
+	defer span.Finish()
+	span.SetAttr("paxos.slot", req.Slot)
+
+	res.Applied = e.learn([]Entry{{Slot: req.Slot, Value: req.Value}}, req.Stable)
+	return nil
+}
+
+// RPC: Learned - chosen entries for nodes that missed commits
+func (s *Service) Learned(req *LearnedRequest, res *LearnedResponse) error {
+	if _, err := auth.Require(req.Token, auth.RolePeer); err != nil {
+		return err
+	}
+	s.engine.logMu.Lock()
+	defer s.engine.logMu.Unlock()
+	var err error
+	res.Entries, err = s.engine.learner.Entries(req.FromSlot)
+	return err
+}
+
+// RPC: Submit - a command forwarded to the leader for batching
+type SubmitRequest struct {
+	Command string
+	Token   string
+	TraceID string
+}
+type SubmitResponse struct{}
+
+// Returns once the command is chosen, the caller waits for it to be applied
+// locally
+func (s *Service) Submit(req *SubmitRequest, res *SubmitResponse) error {
+	e := s.engine
+	if ok, err := s.answer(req.Token); err != nil {
+		return err
+	} else if !ok {
+		return consensus.ErrStopped
+	}
+	e.mu.RLock()
+	batcher := e.batcher
+	e.mu.RUnlock()
+	if batcher == nil {
+		return fmt.Errorf("node has no neighbors yet")
+	}
+	// Refuse what can't be batched before it holds up other commands
+	if _, err := store.DecodeCommand(req.Command); err != nil {
+		return err
+	}
+	return batcher.propose(req.Command, telemetry.SpanContext{TraceID: req.TraceID})
+}
+
+func recordAcceptorSpan(span *telemetry.Span, slot int, ballot int, ok bool, reason string) {
+	span.SetAttr("paxos.slot", slot)
+	span.SetAttr("paxos.ballot", ballot)
+	span.SetAttr("paxos.ok", ok)
+	if !ok {
+		span.SetAttr("paxos.reason", reason)
+		span.Fail("rejected: " + reason)
+	}
+}
@@ -0,0 +1,53 @@
+package raft
+
+type LogEntry struct {
+	Term    int
+	Command string // Empty for the entry a new leader commits its term with
+}
+
+// Candidate asking for a vote
+type VoteRequest struct {
+	Term        int
+	CandidateID int
+	LastIndex   int // Index of the candidate's last entry, -1 if its log is empty
+	LastTerm    int
+	Token       string // Cluster credentials
+}
+
+// The candidate must be the node whose certificate the connection presents
+func (req VoteRequest) SenderID() int { return req.CandidateID }
+
+type VoteResponse struct {
+	Term    int
+	Granted bool
+}
+
+// Leader replicating entries, or a heartbeat without any
+type AppendRequest struct {
+	Term       int
+	LeaderID   int
+	LeaderAddr string // Peer address followers forward commands to
+	PrevIndex  int    // Index of the entry before Entries, -1 if they start the log
+	PrevTerm   int
+	Entries    []LogEntry
+	Commit     int // Entries the leader knows are committed
+	Compact    int // Entries every node stores and knows are committed, which they may drop
+	Token      string
+}
+
+// Likewise the leader
+func (req AppendRequest) SenderID() int { return req.LeaderID }
+
+type AppendResponse struct {
+	Term int
+	OK   bool
+	Next int // Index the leader should send from next
+}
+
+// Command forwarded to the leader
+type SubmitRequest struct {
+	Command string
+	Token   string
+}
+
+type SubmitResponse struct{}
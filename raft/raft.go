@@ -0,0 +1,512 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Roles
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+// How long a proposal waits to be committed
+const commitTimeout = 5 * time.Second
+
+// Most entries sent in one append
+const maxAppend = 256
+
+var ErrNoLeader = errors.New("no Raft leader elected yet")
+
+// Raft as a consensus engine. Nodes elect a leader for a term, which appends
+// commands to its log and replicates it to the followers; an entry is
+// committed once a majority stores it, and followers forward commands to the
+// leader. Logs are kept in memory like the Paxos acceptors' state; entries
+// every node stores and has applied are dropped, so a node that's down keeps
+// them on the others until it's back.
+//
+// Safe for concurrent use.
+type Raft struct {
+	cfg       consensus.Config
+	committed chan consensus.Entry
+
+	mu          sync.Mutex
+	peers       map[string]consensus.Connection // Other nodes by peer address
+	role        string
+	term        int
+	votedFor    int // Node voted for in term, 0 if none
+	leaderID    int
+	leaderAddr  string         // Empty while no leader is known
+	log         []LogEntry     // Entries from base on
+	base        int            // Entries below it were dropped
+	baseTerm    int            // Term of the entry before base, 0 if base is 0
+	commitIndex int            // Entries known to be committed
+	applied     int            // Entries handed out
+	nextIndex   map[string]int // Leader: next entry to send to each follower
+	matchIndex  map[string]int // Leader: entries each follower is known to store
+	sending     map[string]bool
+	heard       time.Time     // Last contact with a leader, or vote granted
+	timeout     time.Duration // Current randomized election timeout
+	changed     chan struct{} // Closed and replaced when commitIndex or term changes
+	kick        chan struct{} // Wakes the leader to replicate right away
+}
+
+// Engine for this node, elections start once members are set
+func New(cfg consensus.Config) *Raft {
+	r := &Raft{
+		cfg:        cfg,
+		committed:  make(chan consensus.Entry, 64),
+		peers:      make(map[string]consensus.Connection),
+		role:       Follower,
+		nextIndex:  make(map[string]int),
+		matchIndex: make(map[string]int),
+		sending:    make(map[string]bool),
+		heard:      time.Now(),
+		timeout:    electionTimeout(),
+		changed:    make(chan struct{}),
+		kick:       make(chan struct{}, 1),
+	}
+	go r.run()
+	go r.deliver()
+	return r
+}
+
+func electionTimeout() time.Duration {
+	return utils.RaftElectionTimeout + time.Duration(rand.Int63n(int64(utils.RaftElectionTimeout)))
+}
+
+// Append a command on the leader, or forward it there, and wait until it's
+// committed. Without a leader to reach it waits for the next election.
+func (r *Raft) Propose(p consensus.Proposal) error {
+	deadline := time.After(commitTimeout)
+	for {
+		r.mu.Lock()
+		role, leader, changed := r.role, r.peers[r.leaderAddr], r.changed
+		r.mu.Unlock()
+		if role == Leader {
+			return r.append(p.Command)
+		}
+		err := ErrNoLeader
+		if leader != nil {
+			if err = leader.Call("Raft.Submit", &SubmitRequest{Command: p.Command, Token: r.cfg.Token}, &SubmitResponse{}); err == nil {
+				return nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return err
+		}
+	}
+}
+
+// Append to the leader's log and wait for a majority to store it
+func (r *Raft) append(command string) error {
+	if r.cfg.Faults.Timeout.Load() {
+		time.Sleep(10 * time.Second)
+	}
+	r.mu.Lock()
+	if r.role != Leader {
+		r.mu.Unlock()
+		return fmt.Errorf("node %d is no longer the Raft leader", r.cfg.ID)
+	}
+	index, term := r.length(), r.term
+	r.log = append(r.log, LogEntry{Term: term, Command: command})
+	r.advanceCommit()
+	r.mu.Unlock()
+	r.replicateNow()
+
+	deadline := time.After(commitTimeout)
+	for {
+		r.mu.Lock()
+		if r.commitIndex > index {
+			// A leader never replaces entries of its own term
+			var err error
+			switch {
+			case r.term == term:
+			case index < r.base:
+				err = fmt.Errorf("entry %d dropped before checking it wasn't replaced by a later leader", index)
+			case r.termAt(index) != term:
+				err = fmt.Errorf("entry %d replaced by a later leader", index)
+			}
+			r.mu.Unlock()
+			return err
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("entry %d not committed within %v", index, commitTimeout)
+		}
+	}
+}
+
+func (r *Raft) Committed() <-chan consensus.Entry {
+	return r.committed
+}
+
+func (r *Raft) SetMembers(members map[string]consensus.Member) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = make(map[string]consensus.Connection, len(members))
+	for addr, member := range members {
+		if addr != r.cfg.Addr {
+			r.peers[addr] = member.Connection
+		}
+	}
+}
+
+func (r *Raft) Status() consensus.Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return consensus.Status{
+		Engine: consensus.EngineRaft,
+		State:  []string{fmt.Sprintf("Raft={Role:%s, Term:%d, Leader:%d, LogLength:%d, Compacted:%d, Committed:%d}", r.role, r.term, r.leaderID, r.length(), r.base, r.commitIndex)},
+	}
+}
+
+func (r *Raft) Service() (string, any) {
+	return "Raft", &Service{raft: r}
+}
+
+// Send heartbeats while leading, campaign when the leader goes quiet. A
+// stopped node does neither.
+func (r *Raft) run() {
+	ticker := time.NewTicker(utils.RaftHeartbeatInterval / 2)
+	defer ticker.Stop()
+	lastBeat := time.Time{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.kick:
+			lastBeat = time.Time{}
+		}
+		if r.cfg.Faults.Stop.Load() {
+			continue
+		}
+		r.mu.Lock()
+		role, quiet := r.role, time.Since(r.heard) > r.timeout
+		hasPeers := len(r.peers) > 0 || r.cfg.NodeCount == 1
+		r.mu.Unlock()
+		switch {
+		case role == Leader && time.Since(lastBeat) >= utils.RaftHeartbeatInterval:
+			lastBeat = time.Now()
+			r.replicate()
+		case role != Leader && quiet && hasPeers:
+			r.campaign()
+		}
+	}
+}
+
+func (r *Raft) replicateNow() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Start a new term and ask every node for its vote
+func (r *Raft) campaign() {
+	r.mu.Lock()
+	r.term++
+	r.role, r.votedFor, r.leaderID, r.leaderAddr = Candidate, r.cfg.ID, 0, ""
+	r.heard, r.timeout = time.Now(), electionTimeout()
+	term := r.term
+	req := VoteRequest{Term: term, CandidateID: r.cfg.ID, LastIndex: r.length() - 1, LastTerm: r.lastTerm(), Token: r.cfg.Token}
+	peers := maps.Clone(r.peers)
+	r.changedLocked()
+	r.mu.Unlock()
+	r.cfg.Logger.Info("raft campaign", "term", term)
+
+	votes := 1
+	r.mu.Lock()
+	r.winIfMajority(term, votes)
+	r.mu.Unlock()
+	for addr, peer := range peers {
+		go func(addr string, peer consensus.Connection) {
+			var res VoteResponse
+			if err := peer.Call("Raft.RequestVote", &req, &res); err != nil {
+				r.cfg.Logger.Debug("raft vote request failed", "node", addr, "error", err)
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if res.Term > r.term {
+				r.stepDown(res.Term)
+				return
+			}
+			if res.Granted && r.term == term && r.role == Candidate {
+				votes++
+				r.winIfMajority(term, votes)
+			}
+		}(addr, peer)
+	}
+}
+
+// Lead once a majority voted, mu must be held
+func (r *Raft) winIfMajority(term int, votes int) {
+	if votes <= r.cfg.NodeCount/2 || r.role != Candidate || r.term != term {
+		return
+	}
+	r.role, r.leaderID, r.leaderAddr = Leader, r.cfg.ID, r.cfg.Addr
+	for addr := range r.peers {
+		r.nextIndex[addr], r.matchIndex[addr] = r.length(), 0
+	}
+	// Entries of earlier terms only commit along with one of this term
+	r.log = append(r.log, LogEntry{Term: term})
+	r.advanceCommit()
+	r.cfg.Logger.Info("raft leader elected", "term", term)
+	r.replicateNow()
+}
+
+// Follow a newer term, mu must be held
+func (r *Raft) stepDown(term int) {
+	if term > r.term {
+		r.term, r.votedFor = term, 0
+		r.changedLocked()
+	}
+	if r.role != Follower {
+		r.cfg.Logger.Info("raft stepping down", "term", r.term, "role", r.role)
+	}
+	r.role = Follower
+}
+
+// Send every follower the entries it's missing, or a heartbeat
+func (r *Raft) replicate() {
+	r.mu.Lock()
+	peers := maps.Clone(r.peers)
+	r.mu.Unlock()
+	for addr, peer := range peers {
+		go r.replicateTo(addr, peer)
+	}
+}
+
+func (r *Raft) replicateTo(addr string, peer consensus.Connection) {
+	r.mu.Lock()
+	if r.role != Leader || r.sending[addr] {
+		r.mu.Unlock()
+		return
+	}
+	r.sending[addr] = true
+	// Every follower stores the dropped entries, but one that answered with
+	// less than it stores is sent from base
+	next := max(min(r.nextIndex[addr], r.length()), r.base)
+	req := AppendRequest{Term: r.term, LeaderID: r.cfg.ID, LeaderAddr: r.cfg.Addr, PrevIndex: next - 1, PrevTerm: -1, Commit: r.commitIndex, Compact: r.stable(), Token: r.cfg.Token}
+	if next > 0 {
+		req.PrevTerm = r.termAt(next - 1)
+	}
+	req.Entries = slices.Clone(r.entries(next, min(r.length(), next+maxAppend)))
+	r.mu.Unlock()
+
+	var res AppendResponse
+	err := peer.Call("Raft.AppendEntries", &req, &res)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sending[addr] = false
+	if err != nil {
+		r.cfg.Logger.Debug("raft append failed", "node", addr, "error", err)
+		return
+	}
+	if res.Term > r.term {
+		r.stepDown(res.Term)
+		return
+	}
+	if r.role != Leader || r.term != req.Term {
+		return
+	}
+	if !res.OK {
+		r.nextIndex[addr] = max(0, min(res.Next, next-1))
+		r.replicateNow()
+		return
+	}
+	r.matchIndex[addr] = max(r.matchIndex[addr], next+len(req.Entries))
+	r.nextIndex[addr] = r.matchIndex[addr]
+	r.advanceCommit()
+	r.compact(r.stable())
+	if r.nextIndex[addr] < r.length() {
+		r.replicateNow()
+	}
+}
+
+// Entries every node stores and knows are committed, nothing until the
+// leader heard from all of them. mu must be held.
+func (r *Raft) stable() int {
+	if r.role != Leader || len(r.peers) < r.cfg.NodeCount-1 {
+		return 0
+	}
+	stable := r.commitIndex
+	for addr := range r.peers {
+		stable = min(stable, r.matchIndex[addr])
+	}
+	return stable
+}
+
+// Drop entries below the given index this node has applied, mu must be held
+func (r *Raft) compact(below int) {
+	below = min(below, r.applied)
+	if below <= r.base {
+		return
+	}
+	r.baseTerm = r.termAt(below - 1)
+	r.log = slices.Clone(r.log[below-r.base:])
+	r.base = below
+}
+
+// Commit the longest prefix a majority stores that ends in this term, mu
+// must be held
+func (r *Raft) advanceCommit() {
+	for n := r.length(); n > r.commitIndex && r.termAt(n-1) == r.term; n-- {
+		stored := 1
+		for _, match := range r.matchIndex {
+			if match >= n {
+				stored++
+			}
+		}
+		if stored > r.cfg.NodeCount/2 {
+			r.commitIndex = n
+			r.changedLocked()
+			// Followers apply as soon as they hear, not with the next heartbeat
+			r.replicateNow()
+			return
+		}
+	}
+}
+
+// Hand committed commands out in log order
+func (r *Raft) deliver() {
+	delivered := 0
+	for {
+		r.mu.Lock()
+		for r.applied >= r.commitIndex {
+			changed := r.changed
+			r.mu.Unlock()
+			<-changed
+			r.mu.Lock()
+		}
+		entries := slices.Clone(r.entries(r.applied, r.commitIndex))
+		r.applied = r.commitIndex
+		r.mu.Unlock()
+		for _, entry := range entries {
+			if entry.Command == "" {
+				continue
+			}
+			r.committed <- consensus.Entry{Index: delivered, Command: entry.Command}
+			delivered++
+		}
+	}
+}
+
+// Handle a vote request: grant it once per term to a candidate whose log is
+// at least as up to date
+func (r *Raft) RequestVote(req VoteRequest) VoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Term > r.term {
+		r.stepDown(req.Term)
+	}
+	res := VoteResponse{Term: r.term}
+	if req.Term < r.term {
+		return res
+	}
+	upToDate := req.LastTerm > r.lastTerm() || (req.LastTerm == r.lastTerm() && req.LastIndex >= r.length()-1)
+	if (r.votedFor == 0 || r.votedFor == req.CandidateID) && upToDate {
+		r.votedFor = req.CandidateID
+		r.heard = time.Now()
+		res.Granted = true
+	}
+	return res
+}
+
+// Handle entries from the leader: keep them if the log matches up to
+// PrevIndex, replacing any conflicting suffix. Dropped entries are committed,
+// so they match whatever the leader sends.
+func (r *Raft) AppendEntries(req AppendRequest) AppendResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Term < r.term {
+		return AppendResponse{Term: r.term, Next: r.length()}
+	}
+	r.stepDown(req.Term)
+	r.leaderID, r.leaderAddr, r.heard = req.LeaderID, req.LeaderAddr, time.Now()
+
+	res := AppendResponse{Term: r.term}
+	if req.PrevIndex >= r.length() {
+		res.Next = r.length()
+		return res
+	}
+	if req.PrevIndex >= r.base && r.termAt(req.PrevIndex) != req.PrevTerm {
+		// Skip back over the whole conflicting term
+		conflict := r.termAt(req.PrevIndex)
+		next := req.PrevIndex
+		for next > r.base && r.termAt(next-1) == conflict {
+			next--
+		}
+		res.Next = next
+		return res
+	}
+	for i, entry := range req.Entries {
+		index := req.PrevIndex + 1 + i
+		if index < r.base {
+			continue
+		}
+		if index < r.length() {
+			if r.termAt(index) == entry.Term {
+				continue
+			}
+			r.log = r.log[:index-r.base]
+		}
+		r.log = append(r.log, entry)
+	}
+	last := req.PrevIndex + 1 + len(req.Entries)
+	if commit := min(req.Commit, last); commit > r.commitIndex {
+		r.commitIndex = commit
+		r.changedLocked()
+	}
+	r.compact(min(req.Compact, r.commitIndex))
+	res.OK, res.Next = true, last
+	return res
+}
+
+// Index after the last entry, mu must be held
+func (r *Raft) length() int {
+	return r.base + len(r.log)
+}
+
+// Term of an entry from base-1 on, mu must be held
+func (r *Raft) termAt(index int) int {
+	if index == r.base-1 {
+		return r.baseTerm
+	}
+	return r.log[index-r.base].Term
+}
+
+// Entries in [from, to) from base on, mu must be held
+func (r *Raft) entries(from, to int) []LogEntry {
+	return r.log[from-r.base : to-r.base]
+}
+
+// mu must be held
+func (r *Raft) lastTerm() int {
+	if len(r.log) == 0 {
+		return r.baseTerm
+	}
+	return r.log[len(r.log)-1].Term
+}
+
+// Wake everyone waiting on commitIndex or term, mu must be held
+func (r *Raft) changedLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
@@ -0,0 +1,262 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/consensus"
+	"github.com/derekjtong/mini-cloud/logging"
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Nodes of a cluster in this process calling each other's services directly
+type localCluster struct {
+	nodes []*Raft
+}
+
+type raftConnection struct {
+	to *Raft
+}
+
+func (c *raftConnection) Call(serviceMethod string, args any, reply any) error {
+	service := &Service{raft: c.to}
+	switch req := args.(type) {
+	case *VoteRequest:
+		return service.RequestVote(req, reply.(*VoteResponse))
+	case *AppendRequest:
+		return service.AppendEntries(req, reply.(*AppendResponse))
+	case *SubmitRequest:
+		return service.Submit(req, reply.(*SubmitResponse))
+	}
+	return errors.New("unexpected call " + serviceMethod)
+}
+
+// Shorter timeouts so elections take a fraction of a second. Nodes of earlier
+// tests keep running, so they're set once for all of them.
+func TestMain(m *testing.M) {
+	utils.RaftHeartbeatInterval, utils.RaftElectionTimeout = 20*time.Millisecond, 100*time.Millisecond
+	os.Exit(m.Run())
+}
+
+func startLocalCluster(t *testing.T, n int) *localCluster {
+	t.Helper()
+	c := &localCluster{}
+	for id := 1; id <= n; id++ {
+		c.nodes = append(c.nodes, newNode(id, n))
+	}
+	for _, r := range c.nodes {
+		members := make(map[string]consensus.Member, n)
+		for _, other := range c.nodes {
+			members[other.cfg.Addr] = consensus.Member{Connection: &raftConnection{to: other}, Role: consensus.RoleVoter}
+		}
+		r.SetMembers(members)
+	}
+	return c
+}
+
+func newNode(id, n int) *Raft {
+	return New(consensus.Config{
+		ID:        id,
+		NodeCount: n,
+		Addr:      fmt.Sprintf("127.0.0.1:%d", 9200+id),
+		Token:     utils.ClusterToken,
+		Faults:    &consensus.Faults{},
+		Logger:    logging.Discard(),
+	})
+}
+
+// The only node leading among those not stopped, once there's exactly one
+func (c *localCluster) leader(t *testing.T) *Raft {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Raft
+		for _, r := range c.nodes {
+			if r.cfg.Faults.Stop.Load() {
+				continue
+			}
+			if role, _ := roleOf(r); role == Leader {
+				leaders = append(leaders, r)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no single leader elected")
+	return nil
+}
+
+func roleOf(r *Raft) (string, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role, r.term
+}
+
+// Entries below it were dropped, and the log's length
+func logOf(r *Raft) (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.base, r.length()
+}
+
+// Next commands a node hands out
+func delivered(t *testing.T, r *Raft, n int) []string {
+	t.Helper()
+	var commands []string
+	timeout := time.After(5 * time.Second)
+	for len(commands) < n {
+		select {
+		case entry := <-r.Committed():
+			commands = append(commands, entry.Command)
+		case <-timeout:
+			t.Fatalf("node %d delivered %d of %d commands: %v", r.cfg.ID, len(commands), n, commands)
+		}
+	}
+	return commands
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// One node is elected, and another in a later term once it stops. It steps
+// down when it's back.
+func TestElection(t *testing.T) {
+	c := startLocalCluster(t, 3)
+	first := c.leader(t)
+	_, term := roleOf(first)
+
+	first.cfg.Faults.Stop.Store(true)
+	second := c.leader(t)
+	if _, later := roleOf(second); second == first || later <= term {
+		t.Fatalf("node %d leads in term %d after node %d led in term %d", second.cfg.ID, later, first.cfg.ID, term)
+	}
+
+	first.cfg.Faults.Stop.Store(false)
+	waitFor(t, "the old leader to step down", func() bool {
+		role, _ := roleOf(first)
+		return role == Follower
+	})
+	if leader := c.leader(t); leader == first {
+		t.Errorf("old leader took over again")
+	}
+}
+
+// Commands proposed on any node are delivered on every node in the same order
+func TestReplication(t *testing.T) {
+	c := startLocalCluster(t, 3)
+	leader := c.leader(t)
+	var follower *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			follower = r
+		}
+	}
+	want := []string{"a", "b", "c"}
+	for i, command := range want {
+		proposer := leader
+		if i%2 == 1 {
+			proposer = follower
+		}
+		if err := proposer.Propose(consensus.Proposal{Command: command}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range c.nodes {
+		if got := delivered(t, r, len(want)); !slices.Equal(got, want) {
+			t.Errorf("node %d delivered %v, want %v", r.cfg.ID, got, want)
+		}
+	}
+}
+
+// A follower drops uncommitted entries of an old term that the new leader's
+// log doesn't have, and is told to resend from before that term
+func TestLogConflict(t *testing.T) {
+	r := newNode(1, 3)
+	old := []LogEntry{{Term: 1, Command: "x"}, {Term: 1, Command: "y"}, {Term: 1, Command: "z"}}
+	if res := r.AppendEntries(AppendRequest{Term: 1, LeaderID: 2, PrevIndex: -1, Entries: old, Commit: 1}); !res.OK {
+		t.Fatalf("append to an empty log answered %+v", res)
+	}
+
+	// The leader of term 2 has a term 2 entry at index 2
+	res := r.AppendEntries(AppendRequest{Term: 2, LeaderID: 3, PrevIndex: 2, PrevTerm: 2, Commit: 1})
+	if res.OK || res.Next != 0 {
+		t.Fatalf("mismatched append answered %+v, want a retry from 0", res)
+	}
+	res = r.AppendEntries(AppendRequest{Term: 2, LeaderID: 3, PrevIndex: 0, PrevTerm: 1, Entries: []LogEntry{{Term: 2, Command: "w"}}, Commit: 2})
+	if !res.OK || res.Next != 2 {
+		t.Fatalf("matching append answered %+v", res)
+	}
+	r.mu.Lock()
+	log := slices.Clone(r.log)
+	r.mu.Unlock()
+	if want := []LogEntry{{Term: 1, Command: "x"}, {Term: 2, Command: "w"}}; !slices.Equal(log, want) {
+		t.Errorf("log is %v, want %v", log, want)
+	}
+	if got := delivered(t, r, 2); !slices.Equal(got, []string{"x", "w"}) {
+		t.Errorf("delivered %v", got)
+	}
+
+	if res := r.AppendEntries(AppendRequest{Term: 1, LeaderID: 2, PrevIndex: 2, PrevTerm: 1, Entries: old[2:]}); res.OK || res.Term != 2 {
+		t.Errorf("append from an old term answered %+v", res)
+	}
+}
+
+// Nodes drop entries every node stores, but keep the ones a stopped node
+// misses until it caught up
+func TestCompaction(t *testing.T) {
+	c := startLocalCluster(t, 3)
+	leader := c.leader(t)
+	propose := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := leader.Propose(consensus.Proposal{Command: fmt.Sprintf("%d", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	compacted := func() bool {
+		for _, r := range c.nodes {
+			if base, length := logOf(r); base != length {
+				return false
+			}
+		}
+		return true
+	}
+	propose(0, 10)
+	for _, r := range c.nodes {
+		delivered(t, r, 10)
+	}
+	waitFor(t, "every node to drop its entries", compacted)
+
+	var lagging *Raft
+	for _, r := range c.nodes {
+		if r != leader {
+			lagging = r
+		}
+	}
+	lagging.cfg.Faults.Stop.Store(true)
+	kept, _ := logOf(leader)
+	propose(10, 20)
+	if base, _ := logOf(leader); base != kept {
+		t.Fatalf("leader dropped entries below %d while a node stored only %d", base, kept)
+	}
+
+	lagging.cfg.Faults.Stop.Store(false)
+	if got := delivered(t, lagging, 10); got[0] != "10" || got[9] != "19" {
+		t.Errorf("lagging node delivered %v", got)
+	}
+	waitFor(t, "every node to drop its entries", compacted)
+}
@@ -0,0 +1,50 @@
+package raft
+
+import (
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/consensus"
+)
+
+// Raft traffic between nodes. A stopped node fails every call, so it looks
+// down to the others.
+type Service struct {
+	raft *Raft
+}
+
+func (s *Service) check(token string) error {
+	if _, err := auth.Require(token, auth.RolePeer); err != nil {
+		return err
+	}
+	if s.raft.cfg.Faults.Stop.Load() {
+		return consensus.ErrStopped
+	}
+	return nil
+}
+
+// RPC: RequestVote
+func (s *Service) RequestVote(req *VoteRequest, res *VoteResponse) error {
+	if err := s.check(req.Token); err != nil {
+		return err
+	}
+	s.raft.cfg.Logger.Debug("received", "message", "requestvote", "from", req.CandidateID, "term", req.Term)
+	*res = s.raft.RequestVote(*req)
+	return nil
+}
+
+// RPC: AppendEntries
+func (s *Service) AppendEntries(req *AppendRequest, res *AppendResponse) error {
+	if err := s.check(req.Token); err != nil {
+		return err
+	}
+	*res = s.raft.AppendEntries(*req)
+	return nil
+}
+
+// RPC: Submit - a command forwarded to the leader, returns once it's
+// committed
+func (s *Service) Submit(req *SubmitRequest, res *SubmitResponse) error {
+	if err := s.check(req.Token); err != nil {
+		return err
+	}
+	return s.raft.append(req.Command)
+}
@@ -0,0 +1,273 @@
+package shard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Ways of assigning paths to shards, see utils.ShardBy
+const (
+	ByHash  = "hash"
+	ByRange = "range"
+)
+
+// Marks errors of requests that reached a group not owning the path, or one
+// the path is moving away from. Clients refresh their shard map and retry.
+const wrongShard = "wrong shard"
+
+func IsWrongShard(err error) bool {
+	return err != nil && strings.Contains(err.Error(), wrongShard)
+}
+
+// Error for a path some other group serves
+func WrongShard(path string, group int, nodes []int) error {
+	return fmt.Errorf("%s: %s is served by group %d on nodes %v", wrongShard, path, group, nodes)
+}
+
+// Error for a path whose shard is moving to another group
+func Moving(path string, group int) error {
+	return fmt.Errorf("%s: %s is moving to group %d, retry", wrongShard, path, group)
+}
+
+// Where a path falls in the key space that shards divide: the path itself,
+// or with hash sharding the first 8 hex digits of its SHA-256, which spreads
+// paths differing only in a suffix evenly
+func Key(by string, path string) string {
+	if by == ByRange {
+		return path
+	}
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Keys from Start up to but excluding End, an empty End is unbounded
+type Range struct {
+	Start string
+	End   string `json:",omitempty"`
+}
+
+func (r Range) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r Range) Overlaps(o Range) bool {
+	return (o.End == "" || r.Start < o.End) && (r.End == "" || o.Start < r.End)
+}
+
+// Parts of r outside o, none to two ranges
+func (r Range) Minus(o Range) []Range {
+	if o.End != "" && r.Start >= o.End || r.End != "" && o.Start >= r.End {
+		// No overlap
+		return []Range{r}
+	}
+	var parts []Range
+	if r.Start < o.Start {
+		parts = append(parts, Range{Start: r.Start, End: o.Start})
+	}
+	if o.End != "" && (r.End == "" || r.End > o.End) {
+		parts = append(parts, Range{Start: o.End, End: r.End})
+	}
+	return parts
+}
+
+func (r Range) String() string {
+	end := r.End
+	if end == "" {
+		end = "∞"
+	}
+	return fmt.Sprintf("[%q, %q)", r.Start, end)
+}
+
+// Part of the key space served by one group
+type Shard struct {
+	ID     int
+	Range  Range
+	Group  int
+	Moving int `json:",omitempty"` // Group the shard is being moved to, 0 if none
+}
+
+// Replicated by group 0: which group serves each shard and which nodes run
+// each group. Shards are ordered by range and cover every key.
+type Map struct {
+	Version int // Bumped by every change
+	By      string
+	Groups  map[int][]int // Node IDs by group ID, from 1
+	Shards  []Shard
+	NextID  int // ID of the next shard split off
+}
+
+// Map before any change: hash sharding divides the hash space evenly into
+// one shard per group, range sharding cuts the paths at splits and hands
+// the shards to the groups in turn
+func Initial(by string, groups [][]int, splits []string) (Map, error) {
+	if len(groups) == 0 {
+		return Map{}, fmt.Errorf("no shard groups")
+	}
+	m := Map{Version: 1, By: by, Groups: make(map[int][]int, len(groups))}
+	for i, nodes := range groups {
+		if len(nodes) == 0 {
+			return Map{}, fmt.Errorf("shard group %d has no nodes", i+1)
+		}
+		m.Groups[i+1] = slices.Clone(nodes)
+	}
+
+	var starts []string
+	switch by {
+	case ByHash:
+		if len(splits) > 0 {
+			return Map{}, fmt.Errorf("split points only apply to %s sharding", ByRange)
+		}
+		for i := range groups {
+			starts = append(starts, fmt.Sprintf("%08x", uint64(i)<<32/uint64(len(groups))))
+		}
+	case ByRange:
+		if !slices.IsSorted(splits) || len(slices.Compact(slices.Clone(splits))) != len(splits) {
+			return Map{}, fmt.Errorf("split points must be sorted and distinct")
+		}
+		starts = append([]string{""}, splits...)
+	default:
+		return Map{}, fmt.Errorf("unknown sharding %q", by)
+	}
+	for i, start := range starts {
+		shard := Shard{ID: i + 1, Range: Range{Start: start}, Group: i%len(groups) + 1}
+		if i+1 < len(starts) {
+			shard.Range.End = starts[i+1]
+		}
+		m.Shards = append(m.Shards, shard)
+	}
+	m.NextID = len(m.Shards) + 1
+	return m, nil
+}
+
+// Shard serving a path
+func (m Map) Lookup(path string) Shard {
+	key := Key(m.By, path)
+	for _, shard := range m.Shards {
+		if shard.Range.Contains(key) {
+			return shard
+		}
+	}
+	// Shards cover every key
+	panic(fmt.Sprintf("no shard for key %q", key))
+}
+
+// Group serving path and every path below it, 0 if they're spread over
+// several groups. With hash sharding that's only while one group serves
+// every shard.
+func (m Map) DirGroup(path string) int {
+	span := Range{} // Every key
+	group := 0
+	if path != "/" {
+		group = m.Lookup(path).Group
+		if m.By == ByRange {
+			// Paths below start with path+"/", and '0' follows '/'
+			span = Range{Start: path + "/", End: path + "0"}
+		}
+	}
+	for _, shard := range m.Shards {
+		if !shard.Range.Overlaps(span) {
+			continue
+		}
+		if group != 0 && shard.Group != group {
+			return 0
+		}
+		group = shard.Group
+	}
+	return group
+}
+
+func (m Map) Shard(id int) (Shard, bool) {
+	i := slices.IndexFunc(m.Shards, func(s Shard) bool { return s.ID == id })
+	if i < 0 {
+		return Shard{}, false
+	}
+	return m.Shards[i], true
+}
+
+func (m Map) Clone() Map {
+	c := m
+	c.Groups = make(map[int][]int, len(m.Groups))
+	for id, nodes := range m.Groups {
+		c.Groups[id] = slices.Clone(nodes)
+	}
+	c.Shards = slices.Clone(m.Shards)
+	return c
+}
+
+// Cut a shard in two at key, the new shard taking the upper half. Both stay
+// in the shard's group, so no data moves. With hash sharding an empty key
+// cuts the shard's hash range in the middle.
+func (m Map) Split(id int, at string) (Map, error) {
+	i := slices.IndexFunc(m.Shards, func(s Shard) bool { return s.ID == id })
+	if i < 0 {
+		return Map{}, fmt.Errorf("no shard %d", id)
+	}
+	shard := m.Shards[i]
+	if shard.Moving != 0 {
+		return Map{}, fmt.Errorf("shard %d is moving to group %d", id, shard.Moving)
+	}
+	if at == "" && m.By == ByHash {
+		start, _ := strconv.ParseUint(shard.Range.Start, 16, 64)
+		end := uint64(1) << 32
+		if shard.Range.End != "" {
+			end, _ = strconv.ParseUint(shard.Range.End, 16, 64)
+		}
+		if end-start < 2 {
+			return Map{}, fmt.Errorf("shard %d is too small to split", id)
+		}
+		at = fmt.Sprintf("%08x", (start+end)/2)
+	}
+	if at <= shard.Range.Start || shard.Range.End != "" && at >= shard.Range.End {
+		return Map{}, fmt.Errorf("split point %q is outside shard %d %s", at, id, shard.Range)
+	}
+
+	c := m.Clone()
+	upper := Shard{ID: c.NextID, Range: Range{Start: at, End: shard.Range.End}, Group: shard.Group}
+	c.Shards[i].Range.End = at
+	c.Shards = slices.Insert(c.Shards, i+1, upper)
+	c.NextID++
+	c.Version++
+	return c, nil
+}
+
+// Start moving a shard to another group
+func (m Map) Move(id int, group int) (Map, error) {
+	shard, ok := m.Shard(id)
+	if !ok {
+		return Map{}, fmt.Errorf("no shard %d", id)
+	}
+	if _, ok := m.Groups[group]; !ok {
+		return Map{}, fmt.Errorf("no group %d", group)
+	}
+	if shard.Group == group {
+		return Map{}, fmt.Errorf("shard %d is already served by group %d", id, group)
+	}
+	if shard.Moving != 0 && shard.Moving != group {
+		return Map{}, fmt.Errorf("shard %d is moving to group %d", id, shard.Moving)
+	}
+	return m.update(id, func(s *Shard) { s.Moving = group }), nil
+}
+
+// Hand a moving shard to the group it was moving to
+func (m Map) FinishMove(id int) (Map, error) {
+	shard, ok := m.Shard(id)
+	if !ok || shard.Moving == 0 {
+		return Map{}, fmt.Errorf("shard %d isn't moving", id)
+	}
+	return m.update(id, func(s *Shard) { s.Group, s.Moving = s.Moving, 0 }), nil
+}
+
+func (m Map) update(id int, change func(*Shard)) Map {
+	c := m.Clone()
+	for i := range c.Shards {
+		if c.Shards[i].ID == id {
+			change(&c.Shards[i])
+		}
+	}
+	c.Version++
+	return c
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/shard"
+)
+
+// Operations
+const (
+	OpWrite  = "write"
+	OpDelete = "delete"
+	OpAppend = "append"
+	OpTxn    = "txn"
+	OpCheck  = "check" // Transaction precondition without a change
+
+	OpOpenSession   = "session"
+	OpKeepAlive     = "keepalive"
+	OpCloseSession  = "closesession"
+	OpExpireSession = "expire"        // Proposed by the leader once a session's lease runs out
+	OpEndSession    = "endsession"    // Proposed in a shard group once a session ended in group 0, deletes its files there
+	OpForgetSession = "forgetsession" // Proposed in group 0 once a shard group deleted an ended session's files
+	OpExpireFiles   = "expirefiles"   // Proposed by the leader for files whose TTL ran out
+	OpLock          = "lock"
+	OpUnlock        = "unlock"
+	OpSetACL        = "setacl"
+	OpRemoveACL     = "rmacl"
+
+	// Sharding: group 0 holds the shard map, a shard moving between groups
+	// is frozen in its old group, installed in the new one and then dropped
+	OpSetShards    = "setshards"
+	OpFreezeShard  = "freezeshard"
+	OpInstallShard = "installshard"
+	OpDropShard    = "dropshard"
+
+	OpBatch = "batch" // Several commands in one log entry, applied in order
+)
+
+// Entry in the replicated log, encoded as the Paxos value
+type Command struct {
+	ID        string // Unique per request, so identical requests are distinct values
+	Op        string
+	Path      string        `json:",omitempty"`
+	Data      string        `json:",omitempty"`
+	IfVersion int           `json:",omitempty"` // write, delete: only if the path is at this version, expire: only if the session wasn't renewed since, and only once its lease ran out by Time
+	IfAbsent  bool          `json:",omitempty"` // write: only if the path doesn't exist
+	Ops       []TxnOp       `json:",omitempty"` // txn, expirefiles
+	Batch     []Command     `json:",omitempty"` // batch
+	Session   string        `json:",omitempty"` // Session ops, lock, unlock, and writes creating ephemeral files
+	Group     int           `json:",omitempty"` // Writes with a session: shard group they go to, the session was checked in group 0. forgetsession: group that deleted the files.
+	Groups    []int         `json:",omitempty"` // closesession, expire: shard groups that may hold the session's files
+	Lock      string        `json:",omitempty"` // lock, unlock
+	TTL       time.Duration `json:",omitempty"` // session, and writes of files that expire
+	Rule      *auth.Rule    `json:",omitempty"` // setacl, rmacl
+	Shards    *shard.Map    `json:",omitempty"` // setshards, IfVersion is the map version it replaces
+	Fence     *Fence        `json:",omitempty"` // freezeshard, installshard, dropshard
+	Snapshot  *Snapshot     `json:",omitempty"` // installshard
+	Principal string        `json:",omitempty"` // Authenticated caller
+	Time      time.Time     // When the command was proposed, so every replica records the same time
+}
+
+// One operation of a transaction. All preconditions are checked against the
+// state before the transaction, then the operations are applied in order.
+type TxnOp struct {
+	Op        string // write, append, delete or check
+	Path      string
+	Data      string `json:",omitempty"`
+	IfVersion int    `json:",omitempty"`
+	IfAbsent  bool   `json:",omitempty"`
+}
+
+func NewCommand(op string) Command {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("generating command ID: %v", err))
+	}
+	return Command{ID: hex.EncodeToString(b), Op: op, Time: time.Now().UTC()}
+}
+
+func (c Command) Encode() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		// Commands only hold strings
+		panic(fmt.Sprintf("encoding command: %v", err))
+	}
+	return string(data)
+}
+
+func DecodeCommand(value string) (Command, error) {
+	var c Command
+	if err := json.Unmarshal([]byte(value), &c); err != nil {
+		return c, fmt.Errorf("decoding command: %v", err)
+	}
+	return c, nil
+}
+
+// Validate and normalize a client supplied path
+func CleanPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("path must be absolute, e.g. /dir/file")
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		return "", fmt.Errorf("path must name a file")
+	}
+	return p, nil
+}
+
+// Key of commands that may touch anything, they interfere with every command
+const AllKeys = "*"
+
+// What the command reads or writes. Commands without a key in common commute,
+// so only commands sharing one need to be applied in the same order
+// everywhere.
+func (c Command) Keys() []string {
+	var keys []string
+	switch c.Op {
+	case OpWrite, OpDelete, OpAppend:
+		keys = append(keys, c.Path)
+	case OpTxn, OpExpireFiles:
+		for _, op := range c.Ops {
+			keys = append(keys, op.Path)
+		}
+	case OpOpenSession:
+		return []string{"session:" + c.ID}
+	case OpKeepAlive:
+		return []string{"session:" + c.Session}
+	case OpCloseSession, OpExpireSession, OpEndSession:
+		// Releases locks and deletes ephemeral files only known when applied
+		return []string{AllKeys}
+	case OpForgetSession:
+		return []string{"session:" + c.Session}
+	case OpLock, OpUnlock:
+		keys = append(keys, "lock:"+c.Lock)
+	case OpSetACL, OpRemoveACL:
+		return []string{"acl"}
+	case OpBatch:
+		for _, cmd := range c.Batch {
+			keys = append(keys, cmd.Keys()...)
+		}
+		if slices.Contains(keys, AllKeys) {
+			return []string{AllKeys}
+		}
+	default:
+		return []string{AllKeys}
+	}
+	if c.Session != "" {
+		keys = append(keys, "session:"+c.Session)
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Client session, kept alive by renewing its lease. Locks held by a session
+// are released when it closes or expires.
+type Session struct {
+	ID      string
+	Owner   string
+	TTL     time.Duration
+	Expires time.Time // Proposal time of the last renewal plus TTL
+	Version int       // Log index of the last renewal
+}
+
+// Named lock held by a session
+type Lock struct {
+	Name    string
+	Session string
+	Owner   string
+	Token   int // Fencing token, the log index of the acquisition
+}
+
+func (s *Store) applySession(index int, cmd Command, res *Result) {
+	switch cmd.Op {
+	case OpOpenSession:
+		s.state.Sessions[cmd.ID] = &Session{ID: cmd.ID, Owner: cmd.Principal, TTL: cmd.TTL, Expires: cmd.Time.Add(cmd.TTL), Version: index}
+		res.Version = index
+		return
+	case OpEndSession:
+		// Later writes with the session are refused
+		s.state.Ended[cmd.Session] = nil
+		s.deleteSessionFiles(index, cmd, cmd.Session)
+		res.Version = index
+		return
+	case OpForgetSession:
+		groups := slices.DeleteFunc(s.state.Ended[cmd.Session], func(id int) bool { return id == cmd.Group })
+		if len(groups) == 0 {
+			delete(s.state.Ended, cmd.Session)
+		} else {
+			s.state.Ended[cmd.Session] = groups
+		}
+		return
+	}
+
+	session, ok := s.state.Sessions[cmd.Session]
+	if !ok {
+		res.Error = fmt.Sprintf("session %s does not exist or expired", cmd.Session)
+		return
+	}
+	switch cmd.Op {
+	case OpKeepAlive:
+		if session.Owner != cmd.Principal {
+			res.Error = fmt.Sprintf("session %s belongs to %s", session.ID, session.Owner)
+			return
+		}
+		session.Expires = cmd.Time.Add(session.TTL)
+		session.Version = index
+		res.Version = session.Version
+	case OpCloseSession:
+		if session.Owner != cmd.Principal {
+			res.Error = fmt.Sprintf("session %s belongs to %s", session.ID, session.Owner)
+			return
+		}
+		s.endSession(index, cmd, session.ID)
+	case OpExpireSession:
+		// Renewed after the node decided it expired, or a node with a clock
+		// ahead decided too early
+		if session.Version != cmd.IfVersion || session.Expires.After(cmd.Time) {
+			res.Version, res.Conflict = session.Version, true
+			return
+		}
+		s.endSession(index, cmd, session.ID)
+	}
+}
+
+// Drop a session, release its locks and delete its ephemeral files. Shard
+// groups that may hold some are remembered until each deleted them.
+func (s *Store) endSession(index int, cmd Command, id string) {
+	delete(s.state.Sessions, id)
+	for name, lock := range s.state.Locks {
+		if lock.Session == id {
+			delete(s.state.Locks, name)
+		}
+	}
+	if len(cmd.Groups) > 0 {
+		s.state.Ended[id] = slices.Clone(cmd.Groups)
+	}
+	s.deleteSessionFiles(index, cmd, id)
+}
+
+func (s *Store) deleteSessionFiles(index int, cmd Command, id string) {
+	var ephemeral []string
+	for path, file := range s.state.Files {
+		if file.Session == id {
+			ephemeral = append(ephemeral, path)
+		}
+	}
+	// Same event order on every replica
+	sort.Strings(ephemeral)
+	for _, path := range ephemeral {
+		delete(s.state.Files, path)
+		s.addRevision(path, Revision{Version: index, Time: cmd.Time, Author: cmd.Principal, Deleted: true})
+		s.addEvent(Event{Version: index, Path: path, Op: OpDelete, Author: cmd.Principal})
+	}
+}
+
+func (s *Store) applyLock(index int, cmd Command, res *Result) {
+	session, ok := s.state.Sessions[cmd.Session]
+	if !ok {
+		res.Error = fmt.Sprintf("session %s does not exist or expired", cmd.Session)
+		return
+	}
+	if session.Owner != cmd.Principal {
+		res.Error = fmt.Sprintf("session %s belongs to %s", session.ID, session.Owner)
+		return
+	}
+	lock, held := s.state.Locks[cmd.Lock]
+	switch cmd.Op {
+	case OpLock:
+		if held && lock.Session != session.ID {
+			res.Conflict, res.Holder, res.Version = true, lock.Owner, lock.Token
+			return
+		}
+		if !held {
+			lock = &Lock{Name: cmd.Lock, Session: session.ID, Owner: session.Owner, Token: index}
+			s.state.Locks[cmd.Lock] = lock
+		}
+		res.Version = lock.Token
+	case OpUnlock:
+		if !held || lock.Session != session.ID {
+			res.Error = fmt.Sprintf("lock %s is not held by session %s", cmd.Lock, session.ID)
+			return
+		}
+		delete(s.state.Locks, cmd.Lock)
+	}
+}
+
+// Sessions whose lease ran out before now
+func (s *Store) ExpiredSessions(now time.Time) []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var expired []Session
+	for _, session := range s.state.Sessions {
+		if session.Expires.Before(now) {
+			expired = append(expired, *session)
+		}
+	}
+	return expired
+}
+
+// Sessions whose files shard groups may still hold, with those groups
+func (s *Store) EndedSessions() map[string][]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ended := make(map[string][]int, len(s.state.Ended))
+	for id, groups := range s.state.Ended {
+		if len(groups) > 0 {
+			ended[id] = slices.Clone(groups)
+		}
+	}
+	return ended
+}
+
+func (s *Store) Session(id string) (Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.state.Sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// Held locks sorted by name
+func (s *Store) Locks() []Lock {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	locks := make([]Lock, 0, len(s.state.Locks))
+	for _, lock := range s.state.Locks {
+		locks = append(locks, *lock)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
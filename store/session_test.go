@@ -0,0 +1,100 @@
+package store
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+// Apply a command in the next slot and return its result
+func applyCommand(t *testing.T, s *Store, cmd Command) Result {
+	t.Helper()
+	results, _ := s.Apply(s.Applied(), cmd.Encode())
+	if len(results) != 1 {
+		t.Fatalf("applying %s: got %d results", cmd.Op, len(results))
+	}
+	return results[0]
+}
+
+// A session ending in group 0 is remembered until every shard group deleted
+// its files, and a shard group refuses writes with it afterwards
+func TestEndedSessionInShardGroups(t *testing.T) {
+	meta, files := New("", Retention{}), New("", Retention{})
+	open := NewCommand(OpOpenSession)
+	open.TTL, open.Principal = time.Minute, "alice"
+	applyCommand(t, meta, open)
+
+	write := NewCommand(OpWrite)
+	write.Path, write.Data, write.Session, write.Group, write.Principal = "/members/a", "x", open.ID, 1, "alice"
+	if res := applyCommand(t, files, write); res.Error != "" {
+		t.Fatalf("write in the shard group: %s", res.Error)
+	}
+	persistent := NewCommand(OpWrite)
+	persistent.Path, persistent.Data = "/config", "y"
+	applyCommand(t, files, persistent)
+
+	end := NewCommand(OpCloseSession)
+	end.Session, end.Groups, end.Principal = open.ID, []int{1, 2}, "alice"
+	applyCommand(t, meta, end)
+	if got := meta.EndedSessions(); !maps.EqualFunc(got, map[string][]int{open.ID: {1, 2}}, func(a, b []int) bool { return len(a) == len(b) }) {
+		t.Fatalf("ended sessions %v, want %s in groups 1 and 2", got, open.ID)
+	}
+
+	delete := NewCommand(OpEndSession)
+	delete.Session = open.ID
+	applyCommand(t, files, delete)
+	if _, ok := files.Read("/members/a"); ok {
+		t.Errorf("ephemeral file survived its session")
+	}
+	if _, ok := files.Read("/config"); !ok {
+		t.Errorf("persistent file was deleted")
+	}
+	events, _, _, err := files.Events("/members", 0)
+	if err != nil || len(events) != 2 || events[1].Op != OpDelete {
+		t.Errorf("events %v, error %v, want the write and a delete", events, err)
+	}
+	write.ID = NewCommand(OpWrite).ID
+	if res := applyCommand(t, files, write); res.Error == "" {
+		t.Errorf("write with an ended session was applied")
+	}
+
+	for _, g := range []int{1, 2} {
+		forget := NewCommand(OpForgetSession)
+		forget.Session, forget.Group = open.ID, g
+		applyCommand(t, meta, forget)
+	}
+	if got := meta.EndedSessions(); len(got) != 0 {
+		t.Errorf("ended sessions %v after every group deleted the files", got)
+	}
+}
+
+// An expiry only applies once the lease ran out by the time it was proposed,
+// and if the session wasn't renewed since
+func TestExpireSession(t *testing.T) {
+	s := New("", Retention{})
+	open := NewCommand(OpOpenSession)
+	open.TTL, open.Principal = time.Minute, "alice"
+	opened := applyCommand(t, s, open).Version
+
+	expire := NewCommand(OpExpireSession)
+	expire.Session, expire.IfVersion, expire.Time = open.ID, opened, open.Time.Add(30*time.Second)
+	if res := applyCommand(t, s, expire); !res.Conflict {
+		t.Errorf("expiry before the lease ran out: got %+v, want a conflict", res)
+	}
+
+	renew := NewCommand(OpKeepAlive)
+	renew.Session, renew.Principal, renew.Time = open.ID, "alice", open.Time.Add(50*time.Second)
+	renewed := applyCommand(t, s, renew).Version
+	expire.ID, expire.Time = NewCommand(OpExpireSession).ID, open.Time.Add(90*time.Second)
+	if res := applyCommand(t, s, expire); !res.Conflict || res.Version != renewed {
+		t.Errorf("expiry of a renewed session: got %+v, want a conflict at version %d", res, renewed)
+	}
+
+	expire.ID, expire.IfVersion, expire.Time = NewCommand(OpExpireSession).ID, renewed, open.Time.Add(2*time.Minute)
+	if res := applyCommand(t, s, expire); res.Conflict || res.Error != "" {
+		t.Errorf("expiry after the lease ran out: %+v", res)
+	}
+	if _, ok := s.Session(open.ID); ok {
+		t.Errorf("session survived its expiry")
+	}
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/derekjtong/mini-cloud/shard"
+)
+
+func (s *Store) applyShard(index int, cmd Command, res *Result) {
+	switch cmd.Op {
+	case OpSetShards:
+		// Replaces the map it was computed from, or nothing. Version 1 is
+		// the initial map, which isn't stored.
+		current := 1
+		if s.state.Shards != nil {
+			current = s.state.Shards.Version
+		}
+		if cmd.IfVersion != current {
+			res.Version, res.Conflict = current, true
+			return
+		}
+		m := cmd.Shards.Clone()
+		s.state.Shards = &m
+		res.Version = m.Version
+	case OpFreezeShard:
+		s.removeFences(cmd.Fence.Range)
+		s.state.Fences = append(s.state.Fences, *cmd.Fence)
+		res.Version = index
+	case OpInstallShard:
+		// The shard may be coming back, or the install may be retried
+		s.removeFences(cmd.Fence.Range)
+		s.install(index, cmd)
+		res.Version = index
+	case OpDropShard:
+		for path := range s.state.Files {
+			if cmd.Fence.Range.Contains(shard.Key(cmd.Fence.By, path)) {
+				delete(s.state.Files, path)
+			}
+		}
+		for path := range s.state.History {
+			if cmd.Fence.Range.Contains(shard.Key(cmd.Fence.By, path)) {
+				delete(s.state.History, path)
+			}
+		}
+		res.Version = index
+	}
+}
+
+// Install the files and history of a moved shard. Versions are log indexes
+// of the group they were written in, so the revisions are renumbered after
+// the install's index, path by path and each file's in order, keeping this
+// group's versions in its own log order. A watch sees every installed file
+// as written.
+func (s *Store) install(index int, cmd Command) {
+	paths := make([]string, 0, len(cmd.Snapshot.History))
+	for path := range cmd.Snapshot.History {
+		paths = append(paths, path)
+	}
+	for path := range cmd.Snapshot.Files {
+		if _, ok := cmd.Snapshot.History[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	// Same versions on every replica
+	sort.Strings(paths)
+	for _, path := range paths {
+		var history []Revision
+		versions := make(map[int]int)
+		for _, revision := range cmd.Snapshot.History[path] {
+			s.index++
+			versions[revision.Version] = s.index
+			revision.Version = s.index
+			history = append(history, revision)
+		}
+		s.state.History[path] = history
+
+		file, ok := cmd.Snapshot.Files[path]
+		if !ok {
+			continue
+		}
+		// This group already deleted the files of sessions that ended
+		if _, ended := s.state.Ended[file.Session]; ended && file.Session != "" {
+			s.index++
+			s.addRevision(path, Revision{Version: s.index, Time: cmd.Time, Author: cmd.Principal, Deleted: true})
+			continue
+		}
+		f := *file
+		if f.Version, ok = versions[file.Version]; !ok {
+			s.index++
+			f.Version = s.index
+			s.addRevision(path, Revision{Version: f.Version, Data: f.Data, Time: cmd.Time, Author: cmd.Principal})
+		}
+		s.state.Files[path] = &f
+		s.addEvent(Event{Version: f.Version, Path: path, Op: OpWrite, Author: cmd.Principal})
+	}
+}
+
+// Fence covering a path, nil if the group takes writes for it
+func (s *Store) fence(path string) *Fence {
+	for i, fence := range s.state.Fences {
+		if fence.Range.Contains(shard.Key(fence.By, path)) {
+			return &s.state.Fences[i]
+		}
+	}
+	return nil
+}
+
+// Take r out of the fences, a shard split after it moved away may come
+// back in parts
+func (s *Store) removeFences(r shard.Range) {
+	var fences []Fence
+	for _, fence := range s.state.Fences {
+		for _, part := range fence.Range.Minus(r) {
+			fences = append(fences, Fence{By: fence.By, Range: part, Group: fence.Group})
+		}
+	}
+	s.state.Fences = fences
+}
+
+// Files and history of the shard keys in r
+func (s *Store) Export(by string, r shard.Range) Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := Snapshot{Files: make(map[string]*File), History: make(map[string][]Revision)}
+	for path, file := range s.state.Files {
+		if r.Contains(shard.Key(by, path)) {
+			f := *file
+			snapshot.Files[path] = &f
+		}
+	}
+	for path, history := range s.state.History {
+		if r.Contains(shard.Key(by, path)) {
+			snapshot.History[path] = append([]Revision(nil), history...)
+		}
+	}
+	return snapshot
+}
+
+// Shard map group 0 replicates, false until it first changes
+func (s *Store) Shards() (shard.Map, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state.Shards == nil {
+		return shard.Map{}, false
+	}
+	return s.state.Shards.Clone(), true
+}
+
+// Shards this group stopped taking writes for
+func (s *Store) Fences() []Fence {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Fence(nil), s.state.Fences...)
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/derekjtong/mini-cloud/shard"
+)
+
+// Moving a range: the old group refuses writes once it's fenced, the new one
+// serves the files with their history at versions of its own log, later
+// writes get higher versions and its watches see the moved files
+func TestMoveShard(t *testing.T) {
+	from, to := New("", Retention{}), New("", Retention{})
+	write := func(s *Store, path string, data string) Result {
+		t.Helper()
+		cmd := NewCommand(OpWrite)
+		cmd.Path, cmd.Data = path, data
+		return applyCommand(t, s, cmd)
+	}
+	write(from, "/a/1", "v1")
+	write(from, "/a/1", "v2")
+	write(from, "/a/2", "x")
+	write(from, "/b", "stays")
+	write(to, "/z", "own")
+
+	// Range sharding keys are paths
+	fence := Fence{By: shard.ByRange, Range: shard.Range{Start: "/a", End: "/b"}, Group: 2}
+	freeze := NewCommand(OpFreezeShard)
+	freeze.Fence = &fence
+	applyCommand(t, from, freeze)
+	if res := write(from, "/a/1", "late"); !shard.IsWrongShard(errors.New(res.Error)) {
+		t.Errorf("write across the fence: got %+v, want a wrong shard error", res)
+	}
+	if res := write(from, "/b", "ok"); res.Error != "" {
+		t.Errorf("write outside the fence: %s", res.Error)
+	}
+
+	snapshot := from.Export(fence.By, fence.Range)
+	if len(snapshot.Files) != 2 {
+		t.Fatalf("exported %d files, want 2", len(snapshot.Files))
+	}
+	_, position, _, _ := to.Events("/", 0)
+	install := NewCommand(OpInstallShard)
+	install.Fence, install.Snapshot = &fence, &snapshot
+	installed := applyCommand(t, to, install).Version
+
+	file, ok := to.Read("/a/1")
+	if !ok || file.Data != "v2" || file.Version <= installed {
+		t.Fatalf("moved file is %+v, want v2 at a version after the install at %d", file, installed)
+	}
+	history := to.History("/a/1")
+	if len(history) != 2 || history[0].Data != "v1" || history[0].Version >= history[1].Version || history[1].Version != file.Version {
+		t.Errorf("moved history %+v", history)
+	}
+	events, _, _, err := to.Events("/a", position)
+	if err != nil || len(events) != 2 {
+		t.Errorf("watch saw %v, error %v, want both moved files", events, err)
+	}
+
+	res := write(to, "/a/1", "v3")
+	if res.Error != "" || res.Version <= file.Version {
+		t.Errorf("write after the move: %+v, want a version above %d", res, file.Version)
+	}
+	if res := write(to, "/z", "own 2"); res.Version <= file.Version {
+		t.Errorf("write to a file of the new group got version %d, below moved version %d", res.Version, file.Version)
+	}
+
+	drop := NewCommand(OpDropShard)
+	drop.Fence = &fence
+	applyCommand(t, from, drop)
+	if _, ok := from.Read("/a/2"); ok {
+		t.Errorf("old group kept a moved file")
+	}
+	if file, ok := from.Read("/b"); !ok || file.Data != "ok" {
+		t.Errorf("old group lost a file outside the range: %+v", file)
+	}
+}
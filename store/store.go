@@ -0,0 +1,432 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/auth"
+	"github.com/derekjtong/mini-cloud/shard"
+)
+
+type File struct {
+	Data    string
+	Version int        // Log index (index) of the last write
+	Session string     `json:",omitempty"` // Ephemeral files are deleted when this session ends
+	Expires *time.Time `json:",omitempty"` // Set by writes with a TTL, deleted by the leader afterwards
+}
+
+// A committed write or delete of a file
+type Revision struct {
+	Version int
+	Data    string `json:",omitempty"`
+	Time    time.Time
+	Author  string
+	Deleted bool `json:",omitempty"`
+}
+
+// How much history to keep per file. The latest revision is always kept.
+type Retention struct {
+	MaxVersions int           // 0 keeps every version
+	MaxAge      time.Duration // Relative to the newest revision, 0 keeps every version
+}
+
+// Number of recent command IDs remembered to skip retried commands chosen twice
+const dedupWindow = 1024
+
+// Replicated state, built by applying chosen commands in log order
+type State struct {
+	Files    map[string]*File
+	History  map[string][]Revision // Oldest first, including deletes
+	ACLs     []auth.Rule
+	Sessions map[string]*Session
+	Locks    map[string]*Lock
+	Ended    map[string][]int `json:",omitempty"` // Sessions ended with files in shard groups: in group 0 the groups yet to delete them, in a shard group none once it did
+	Shards   *shard.Map       `json:",omitempty"` // Group 0 once the map changed, see shard.Initial
+	Fences   []Fence          `json:",omitempty"` // Shards this group no longer takes writes for
+	Recent   []string         // IDs of the last dedupWindow commands, oldest first
+}
+
+// Shard keys a group stopped taking writes for, because the shard is
+// moving or moved to Group
+type Fence struct {
+	By    string
+	Range shard.Range
+	Group int
+}
+
+// Files and history of a shard, handed from one group to another
+type Snapshot struct {
+	Files   map[string]*File
+	History map[string][]Revision
+}
+
+type Store struct {
+	mu        sync.RWMutex
+	state     State
+	recent    map[string]Result // Results of the commands in state.Recent
+	events    []Event           // Recent changes, oldest first
+	compacted int               // Position of the newest change dropped from events
+	changed   chan struct{}     // Closed and replaced after every entry
+	applied   int               // Number of log entries applied
+	index     int               // Log index of the last applied command, batches hold several
+	keyed     map[string]int    // Last version by command key, nil when versions are log indexes
+	seq       int               // Commands applied with key versions, numbers changes for watches
+	path      string            // Snapshot file, rewritten after every entry
+	retention Retention
+}
+
+func New(path string, retention Retention) *Store {
+	return &Store{
+		state: State{
+			Files:    make(map[string]*File),
+			History:  make(map[string][]Revision),
+			Sessions: make(map[string]*Session),
+			Locks:    make(map[string]*Lock),
+			Ended:    make(map[string][]int),
+		},
+		recent:    make(map[string]Result),
+		changed:   make(chan struct{}),
+		path:      path,
+		retention: retention,
+	}
+}
+
+// Number versions by key instead of by log index, for engines that only
+// order commands with a key in common. Each command gets a version one above
+// the last one of any of its keys, which is the same on every replica since
+// those commands were applied in the same order. Versions still grow per
+// file, lock and session, but across files they no longer follow the order
+// changes were applied in, and watches resume from a position of their own,
+// see watchPosition. Call before anything is applied.
+func (s *Store) UseKeyVersions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyed = make(map[string]int)
+}
+
+// Outcome of applying a command
+type Result struct {
+	ID           string // Command ID
+	Version      int    // Version of the path afterwards, or its current version on conflict
+	Conflict     bool   // IfVersion or IfAbsent didn't hold, nothing changed
+	ConflictPath string // Path whose precondition failed
+	Holder       string // lock: session holding the lock on conflict
+	Error        string // Command was rejected when applied, e.g. its session expired
+}
+
+// Apply the chosen value of the next slot and return the result of each
+// command in it. Values that aren't commands are skipped so the log keeps
+// moving.
+func (s *Store) Apply(slot int, value string) ([]Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slot != s.applied {
+		return nil, fmt.Errorf("applying slot %d out of order, expected %d", slot, s.applied)
+	}
+	s.applied++
+	defer s.notify()
+
+	cmd, err := DecodeCommand(value)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []Command{cmd}
+	if cmd.Op == OpBatch {
+		cmds = cmd.Batch
+	}
+	results := make([]Result, 0, len(cmds))
+	var errs []error
+	for _, cmd := range cmds {
+		res := s.apply(cmd)
+		if res.Error != "" {
+			errs = append(errs, fmt.Errorf("command %s: %s", cmd.ID, res.Error))
+		}
+		results = append(results, res)
+	}
+	if err := s.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return results, errors.Join(errs...)
+}
+
+// Apply one command at the next version
+func (s *Store) apply(cmd Command) Result {
+	if res, ok := s.recent[cmd.ID]; ok {
+		// A retry of a command that was already chosen
+		return res
+	}
+	index := s.nextVersion(cmd)
+	s.seq++
+	res := Result{ID: cmd.ID}
+	defer s.remember(&res)
+	switch cmd.Op {
+	case OpWrite, OpDelete, OpAppend, OpTxn:
+		s.applyOps(index, cmd, &res)
+	case OpExpireFiles:
+		s.expireFiles(index, cmd)
+	case OpOpenSession, OpKeepAlive, OpCloseSession, OpExpireSession, OpEndSession, OpForgetSession:
+		s.applySession(index, cmd, &res)
+	case OpLock, OpUnlock:
+		s.applyLock(index, cmd, &res)
+	case OpSetACL:
+		s.removeRule(*cmd.Rule)
+		s.state.ACLs = append(s.state.ACLs, *cmd.Rule)
+	case OpRemoveACL:
+		s.removeRule(*cmd.Rule)
+	case OpSetShards, OpFreezeShard, OpInstallShard, OpDropShard:
+		s.applyShard(index, cmd, &res)
+	default:
+		res.Error = fmt.Sprintf("unknown operation %q", cmd.Op)
+	}
+	return res
+}
+
+// Version of the next command: the next log index, or with key versions one
+// above the last version of its keys
+func (s *Store) nextVersion(cmd Command) int {
+	if s.keyed == nil {
+		s.index++
+		return s.index
+	}
+	keys := cmd.Keys()
+	version := s.keyed[AllKeys]
+	for _, key := range keys {
+		if key == AllKeys {
+			version = s.index
+			break
+		}
+		version = max(version, s.keyed[key])
+	}
+	version++
+	for _, key := range keys {
+		s.keyed[key] = version
+	}
+	s.index = max(s.index, version)
+	return version
+}
+
+// Apply the file operations of a command if all their preconditions hold
+func (s *Store) applyOps(index int, cmd Command, res *Result) {
+	ops := cmd.Ops
+	if cmd.Op != OpTxn {
+		ops = []TxnOp{{Op: cmd.Op, Path: cmd.Path, Data: cmd.Data, IfVersion: cmd.IfVersion, IfAbsent: cmd.IfAbsent}}
+	}
+
+	for _, op := range ops {
+		if fence := s.fence(op.Path); fence != nil {
+			res.Error = shard.Moving(op.Path, fence.Group).Error()
+			return
+		}
+	}
+
+	if cmd.Session != "" {
+		// A shard group only knows the sessions that ended
+		session, ok := s.state.Sessions[cmd.Session]
+		_, ended := s.state.Ended[cmd.Session]
+		if cmd.Group != 0 && ended || cmd.Group == 0 && (!ok || session.Owner != cmd.Principal) {
+			res.Error = fmt.Sprintf("session %s does not exist or expired", cmd.Session)
+			return
+		}
+	}
+
+	// Check every precondition before changing anything
+	for _, op := range ops {
+		version := s.version(op.Path)
+		if op.IfAbsent && version != 0 || op.IfVersion != 0 && op.IfVersion != version {
+			res.Version, res.Conflict, res.ConflictPath = version, true, op.Path
+			return
+		}
+	}
+
+	for _, op := range ops {
+		revision := Revision{Version: index, Time: cmd.Time, Author: cmd.Principal}
+		switch op.Op {
+		case OpCheck:
+			continue
+		case OpDelete:
+			if s.version(op.Path) == 0 {
+				continue
+			}
+			revision.Deleted = true
+			delete(s.state.Files, op.Path)
+			s.addEvent(Event{Version: index, Path: op.Path, Op: OpDelete, Author: cmd.Principal})
+		default:
+			res.Version = revision.Version
+			revision.Data = op.Data
+			owner := cmd.Session
+			var expires *time.Time
+			if cmd.TTL > 0 {
+				t := cmd.Time.Add(cmd.TTL)
+				expires = &t
+			}
+			if file, ok := s.state.Files[op.Path]; ok {
+				if op.Op == OpAppend {
+					revision.Data = file.Data + op.Data
+					// Appends keep the expiry unless they set one
+					if expires == nil {
+						expires = file.Expires
+					}
+				}
+				// Files stay ephemeral or persistent until deleted
+				owner = file.Session
+			}
+			s.state.Files[op.Path] = &File{Data: revision.Data, Version: revision.Version, Session: owner, Expires: expires}
+			s.addEvent(Event{Version: index, Path: op.Path, Op: op.Op, Author: cmd.Principal})
+		}
+		s.addRevision(op.Path, revision)
+	}
+}
+
+// Delete expired files that weren't rewritten since the leader saw them
+func (s *Store) expireFiles(index int, cmd Command) {
+	for _, op := range cmd.Ops {
+		file, ok := s.state.Files[op.Path]
+		if !ok || file.Version != op.IfVersion || file.Expires == nil || file.Expires.After(cmd.Time) || s.fence(op.Path) != nil {
+			continue
+		}
+		delete(s.state.Files, op.Path)
+		s.addRevision(op.Path, Revision{Version: index, Time: cmd.Time, Author: cmd.Principal, Deleted: true})
+		s.addEvent(Event{Version: index, Path: op.Path, Op: OpDelete, Author: cmd.Principal})
+	}
+}
+
+// Files whose TTL ran out before now, as delete operations conditional on
+// their current version
+func (s *Store) ExpiredFiles(now time.Time, limit int) []TxnOp {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var expired []TxnOp
+	for path, file := range s.state.Files {
+		if file.Expires != nil && file.Expires.Before(now) {
+			expired = append(expired, TxnOp{Op: OpDelete, Path: path, IfVersion: file.Version})
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Path < expired[j].Path })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+	return expired
+}
+
+// Record a revision and drop the ones retention no longer covers
+func (s *Store) addRevision(path string, revision Revision) {
+	history := append(s.state.History[path], revision)
+	if limit := s.retention.MaxVersions; limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	if s.retention.MaxAge > 0 {
+		cutoff := revision.Time.Add(-s.retention.MaxAge)
+		for len(history) > 1 && history[0].Time.Before(cutoff) {
+			history = history[1:]
+		}
+	}
+	s.state.History[path] = append([]Revision(nil), history...)
+}
+
+// Current version of a path, 0 if it doesn't exist
+func (s *Store) version(path string) int {
+	if file, ok := s.state.Files[path]; ok {
+		return file.Version
+	}
+	return 0
+}
+
+// Remember the result of a command so a second copy of it is skipped
+func (s *Store) remember(res *Result) {
+	if len(s.state.Recent) == dedupWindow {
+		delete(s.recent, s.state.Recent[0])
+		s.state.Recent = s.state.Recent[1:]
+	}
+	s.state.Recent = append(s.state.Recent, res.ID)
+	s.recent[res.ID] = *res
+}
+
+// Drop the rule for the same prefix and principal
+func (s *Store) removeRule(rule auth.Rule) {
+	rules := s.state.ACLs[:0]
+	for _, r := range s.state.ACLs {
+		if r.Prefix != rule.Prefix || r.Principal != rule.Principal {
+			rules = append(rules, r)
+		}
+	}
+	s.state.ACLs = rules
+}
+
+func (s *Store) Read(path string) (File, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.state.Files[path]
+	if !ok {
+		return File{}, false
+	}
+	return *file, true
+}
+
+// Retained revision of a path at a version
+func (s *Store) ReadVersion(path string, version int) (Revision, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, revision := range s.state.History[path] {
+		if revision.Version == version {
+			return revision, true
+		}
+	}
+	return Revision{}, false
+}
+
+// Retained revisions of a path, oldest first
+func (s *Store) History(path string) []Revision {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Revision(nil), s.state.History[path]...)
+}
+
+func (s *Store) ACLs() []auth.Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rules := append([]auth.Rule{}, s.state.ACLs...)
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Prefix != rules[j].Prefix {
+			return rules[i].Prefix < rules[j].Prefix
+		}
+		return rules[i].Principal < rules[j].Principal
+	})
+	return rules
+}
+
+// Number of log entries applied
+func (s *Store) Applied() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.applied
+}
+
+func (s *Store) FileCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.state.Files)
+}
+
+// Write the state to the snapshot file
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666) // Overwrite
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Applied int
+		Index   int
+		State
+	}{s.applied, s.index, s.state})
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// Write data to a path, with a session if one is given
+func writeFile(t *testing.T, s *Store, path string, data string, session string) Result {
+	t.Helper()
+	cmd := NewCommand(OpWrite)
+	cmd.Path, cmd.Data, cmd.Session, cmd.Principal = path, data, session, "alice"
+	return applyCommand(t, s, cmd)
+}
+
+// Files stay ephemeral or persistent until deleted, whatever session later
+// writes name
+func TestWriteKeepsOwner(t *testing.T) {
+	s := New("", Retention{})
+	sessions := make([]string, 2)
+	for i := range sessions {
+		open := NewCommand(OpOpenSession)
+		open.TTL, open.Principal = time.Minute, "alice"
+		applyCommand(t, s, open)
+		sessions[i] = open.ID
+	}
+	writeFile(t, s, "/persistent", "a", "")
+	writeFile(t, s, "/ephemeral", "a", sessions[0])
+
+	for _, path := range []string{"/persistent", "/ephemeral"} {
+		if res := writeFile(t, s, path, "b", sessions[1]); res.Error != "" || res.Conflict {
+			t.Fatalf("session write to %s: %+v", path, res)
+		}
+	}
+	if file, _ := s.Read("/persistent"); file.Session != "" || file.Data != "b" {
+		t.Errorf("persistent file became %+v", file)
+	}
+	if file, _ := s.Read("/ephemeral"); file.Session != sessions[0] || file.Data != "b" {
+		t.Errorf("ephemeral file became %+v, want it still owned by %s", file, sessions[0])
+	}
+
+	end := NewCommand(OpCloseSession)
+	end.Session, end.Principal = sessions[1], "alice"
+	applyCommand(t, s, end)
+	for _, path := range []string{"/persistent", "/ephemeral"} {
+		if _, ok := s.Read(path); !ok {
+			t.Errorf("%s was deleted with a session that didn't own it", path)
+		}
+	}
+
+	del := NewCommand(OpDelete)
+	del.Path = "/persistent"
+	applyCommand(t, s, del)
+	if res := writeFile(t, s, "/persistent", "c", sessions[0]); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	if file, _ := s.Read("/persistent"); file.Session != sessions[0] {
+		t.Errorf("file written by a session after a delete is %+v, want it ephemeral", file)
+	}
+}
+
+// Writes and deletes only apply at the version they expect, or if the file
+// doesn't exist yet
+func TestPreconditions(t *testing.T) {
+	s := New("", Retention{})
+	apply := func(op string, ifVersion int, ifAbsent bool) Result {
+		t.Helper()
+		cmd := NewCommand(op)
+		cmd.Path, cmd.Data, cmd.IfVersion, cmd.IfAbsent = "/f", "x", ifVersion, ifAbsent
+		return applyCommand(t, s, cmd)
+	}
+	created := apply(OpWrite, 0, true)
+	if created.Conflict || created.Version == 0 {
+		t.Fatalf("creating an absent file: %+v", created)
+	}
+	if res := apply(OpWrite, 0, true); !res.Conflict || res.Version != created.Version || res.ConflictPath != "/f" {
+		t.Errorf("creating an existing file: %+v, want a conflict at version %d", res, created.Version)
+	}
+	swapped := apply(OpWrite, created.Version, false)
+	if swapped.Conflict || swapped.Version <= created.Version {
+		t.Errorf("compare-and-swap at the current version: %+v", swapped)
+	}
+	if res := apply(OpWrite, created.Version, false); !res.Conflict || res.Version != swapped.Version {
+		t.Errorf("compare-and-swap at an old version: %+v, want a conflict at version %d", res, swapped.Version)
+	}
+	if res := apply(OpDelete, created.Version, false); !res.Conflict {
+		t.Errorf("delete at an old version: %+v", res)
+	}
+	if res := apply(OpDelete, swapped.Version, false); res.Conflict {
+		t.Errorf("delete at the current version: %+v", res)
+	}
+	if _, ok := s.Read("/f"); ok {
+		t.Errorf("file survived its delete")
+	}
+}
+
+// A transaction checks every precondition against the state before it and
+// applies all of its operations at one version, or none
+func TestTxnPreconditions(t *testing.T) {
+	s := New("", Retention{})
+	a := writeFile(t, s, "/a", "1", "").Version
+
+	txn := NewCommand(OpTxn)
+	txn.Ops = []TxnOp{
+		{Op: OpWrite, Path: "/b", Data: "1"},
+		{Op: OpCheck, Path: "/a", IfVersion: a + 100},
+	}
+	if res := applyCommand(t, s, txn); !res.Conflict || res.ConflictPath != "/a" || res.Version != a {
+		t.Errorf("failed check: %+v, want a conflict on /a at version %d", res, a)
+	}
+	if _, ok := s.Read("/b"); ok {
+		t.Errorf("transaction with a failed check wrote /b")
+	}
+
+	txn = NewCommand(OpTxn)
+	txn.Ops = []TxnOp{
+		{Op: OpWrite, Path: "/b", Data: "1", IfAbsent: true},
+		// Checked before the write above applies
+		{Op: OpCheck, Path: "/b", IfAbsent: true},
+		{Op: OpAppend, Path: "/a", Data: "2", IfVersion: a},
+		{Op: OpDelete, Path: "/missing"},
+	}
+	res := applyCommand(t, s, txn)
+	if res.Conflict || res.Error != "" {
+		t.Fatalf("transaction: %+v", res)
+	}
+	fileA, _ := s.Read("/a")
+	fileB, _ := s.Read("/b")
+	if fileA.Data != "12" || fileA.Version != fileB.Version || fileB.Version != res.Version {
+		t.Errorf("after the transaction /a is %+v and /b %+v, want both at version %d", fileA, fileB, res.Version)
+	}
+}
+
+// A command chosen twice, as retries can be, applies once, as long as its
+// ID is among the last dedupWindow commands
+func TestDedupWindow(t *testing.T) {
+	s := New("", Retention{})
+	appendCmd := NewCommand(OpAppend)
+	appendCmd.Path, appendCmd.Data = "/log", "x"
+	first := applyCommand(t, s, appendCmd)
+	if again := applyCommand(t, s, appendCmd); again != first {
+		t.Errorf("second copy returned %+v, want the first result %+v", again, first)
+	}
+	if file, _ := s.Read("/log"); file.Data != "x" {
+		t.Errorf("file is %q after a duplicate append", file.Data)
+	}
+
+	for i := 0; i < dedupWindow; i++ {
+		writeFile(t, s, "/other", "x", "")
+	}
+	applyCommand(t, s, appendCmd)
+	if file, _ := s.Read("/log"); file.Data != "xx" {
+		t.Errorf("file is %q, want a copy older than the window applied again", file.Data)
+	}
+}
+
+// Expired files are only deleted at the version the leader saw, once their
+// TTL ran out by the time of the expiry
+func TestExpireFiles(t *testing.T) {
+	s := New("", Retention{})
+	write := NewCommand(OpWrite)
+	write.Path, write.Data, write.TTL = "/tmp", "x", time.Minute
+	version := applyCommand(t, s, write).Version
+	expiry := write.Time.Add(time.Minute)
+
+	if expired := s.ExpiredFiles(expiry.Add(-time.Second), 10); len(expired) != 0 {
+		t.Errorf("expired before the TTL ran out: %v", expired)
+	}
+	expired := s.ExpiredFiles(expiry.Add(time.Second), 10)
+	if len(expired) != 1 || expired[0].Path != "/tmp" || expired[0].IfVersion != version {
+		t.Fatalf("expired %v, want /tmp at version %d", expired, version)
+	}
+
+	expire := func(at time.Time, ops []TxnOp) {
+		cmd := NewCommand(OpExpireFiles)
+		cmd.Ops, cmd.Time = ops, at
+		applyCommand(t, s, cmd)
+	}
+	expire(expiry.Add(-time.Second), expired)
+	expire(expiry.Add(time.Second), []TxnOp{{Op: OpDelete, Path: "/tmp", IfVersion: version + 1}})
+	if _, ok := s.Read("/tmp"); !ok {
+		t.Fatalf("deleted early or at another version")
+	}
+	expire(expiry.Add(time.Second), expired)
+	if _, ok := s.Read("/tmp"); ok {
+		t.Errorf("expired file survived")
+	}
+}
+
+// A lock's fencing token is the version it was taken at: the same while the
+// session holds it, higher for the next holder
+func TestLockFencingTokens(t *testing.T) {
+	s := New("", Retention{})
+	sessions := make([]string, 2)
+	for i, owner := range []string{"alice", "bob"} {
+		open := NewCommand(OpOpenSession)
+		open.TTL, open.Principal = time.Minute, owner
+		applyCommand(t, s, open)
+		sessions[i] = open.ID
+	}
+	lock := func(op string, session int) Result {
+		t.Helper()
+		cmd := NewCommand(op)
+		cmd.Lock, cmd.Session, cmd.Principal = "leader", sessions[session], []string{"alice", "bob"}[session]
+		return applyCommand(t, s, cmd)
+	}
+
+	taken := lock(OpLock, 0)
+	if taken.Conflict || taken.Version == 0 {
+		t.Fatalf("lock: %+v", taken)
+	}
+	if again := lock(OpLock, 0); again.Version != taken.Version {
+		t.Errorf("holder locking again got token %d, want %d", again.Version, taken.Version)
+	}
+	if res := lock(OpLock, 1); !res.Conflict || res.Holder != "alice" || res.Version != taken.Version {
+		t.Errorf("lock held by another session: %+v", res)
+	}
+	if res := lock(OpUnlock, 1); res.Error == "" {
+		t.Errorf("unlocked by a session not holding it")
+	}
+	lock(OpUnlock, 0)
+	if next := lock(OpLock, 1); next.Conflict || next.Version <= taken.Version {
+		t.Errorf("next holder got %+v, want a token above %d", next, taken.Version)
+	}
+
+	end := NewCommand(OpCloseSession)
+	end.Session, end.Principal = sessions[1], "bob"
+	applyCommand(t, s, end)
+	if locks := s.Locks(); len(locks) != 0 {
+		t.Errorf("locks %v held after the session closed", locks)
+	}
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Committed change to a file
+type Event struct {
+	Version int // Log index of the change, or its file's version with key versions
+	Seq     int // Position in this node's changes, what watches resume from, see Store.watchPosition
+	Path    string
+	Op      string // write, append or delete
+	Author  string
+}
+
+// A watch asked for changes older than the retained events
+var ErrCompacted = fmt.Errorf("changes before that position are no longer retained, read the current state and watch from its position")
+
+// Number of recent changes kept for watches to resume from
+const eventWindow = 4096
+
+// Where the changes applied so far end in the order watches see them, mu must
+// be held. That's the log index while versions follow the log, the same on
+// every node. Key versions of different files aren't ordered, so then it's a
+// count of the commands this node applied, which only its own watches can
+// resume from.
+func (s *Store) watchPosition() int {
+	if s.keyed == nil {
+		return s.index
+	}
+	return s.seq
+}
+
+// Record a change, mu must be held
+func (s *Store) addEvent(event Event) {
+	event.Seq = s.watchPosition()
+	s.events = append(s.events, event)
+	if len(s.events) > eventWindow {
+		// Drop whole changes, the events of a transaction share its position
+		s.compacted = s.events[len(s.events)-eventWindow-1].Seq
+		kept := len(s.events) - eventWindow
+		for kept < len(s.events) && s.events[kept].Seq <= s.compacted {
+			kept++
+		}
+		s.events = append([]Event(nil), s.events[kept:]...)
+	}
+}
+
+// Wake up watchers after an entry is applied, mu must be held
+func (s *Store) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Changes to a file or anything below a directory after position from, 0
+// for all retained changes, and a channel closed when the next entry is
+// applied. Also returns the position to resume from.
+func (s *Store) Events(prefix string, from int) ([]Event, int, <-chan struct{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if from != 0 && from < s.compacted {
+		return nil, 0, nil, ErrCompacted
+	}
+	var events []Event
+	for _, event := range s.events {
+		if event.Seq > from && Under(event.Path, prefix) {
+			events = append(events, event)
+		}
+	}
+	return events, max(from, s.watchPosition()), s.changed, nil
+}
+
+// Whether path is prefix or below it, "/" covers everything
+func Under(path string, prefix string) bool {
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Events are dropped a whole change at a time, so a watch never sees part of
+// a transaction, and resuming from the position of the last dropped change
+// still works
+func TestEventsCompactedWithinTxn(t *testing.T) {
+	s := New("", Retention{})
+	writeFile(t, s, "/first", "x", "")
+	txn := NewCommand(OpTxn)
+	txn.Ops = []TxnOp{{Op: OpWrite, Path: "/t/1"}, {Op: OpWrite, Path: "/t/2"}, {Op: OpWrite, Path: "/t/3"}}
+	position := applyCommand(t, s, txn).Version
+	// One past the window cuts between the transaction's second and third
+	// event
+	for i := 0; i < eventWindow-1; i++ {
+		writeFile(t, s, fmt.Sprintf("/later/%d", i), "x", "")
+	}
+	if s.compacted != position {
+		t.Fatalf("compacted up to %d, want the transaction at %d", s.compacted, position)
+	}
+
+	events, _, _, err := s.Events("/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event.Seq <= position {
+			t.Fatalf("retained %+v of a dropped transaction", event)
+		}
+	}
+	if len(events) != eventWindow-1 {
+		t.Errorf("got %d retained events, want %d", len(events), eventWindow-1)
+	}
+	if events, _, _, err := s.Events("/", position); err != nil || len(events) != eventWindow-1 {
+		t.Errorf("resuming after the dropped transaction: %d events, error %v", len(events), err)
+	}
+	if _, _, _, err := s.Events("/", position-1); !errors.Is(err, ErrCompacted) {
+		t.Errorf("resuming before the dropped transaction: got %v, want ErrCompacted", err)
+	}
+}
+
+// A watch resumes after the last position it saw, filtered by prefix
+func TestEventsResume(t *testing.T) {
+	s := New("", Retention{})
+	first := writeFile(t, s, "/dir/a", "1", "").Version
+	writeFile(t, s, "/other", "1", "")
+	writeFile(t, s, "/dir/b", "1", "")
+	events, next, _, err := s.Events("/dir", first)
+	if err != nil || len(events) != 1 || events[0].Path != "/dir/b" {
+		t.Fatalf("events after %d: %+v, error %v", first, events, err)
+	}
+	del := NewCommand(OpDelete)
+	del.Path = "/dir/a"
+	applyCommand(t, s, del)
+	events, _, _, _ = s.Events("/dir", next)
+	if len(events) != 1 || events[0].Op != OpDelete {
+		t.Errorf("events after %d: %+v, want the delete", next, events)
+	}
+}
@@ -0,0 +1,268 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// Appends one OTLP/JSON export request per line to a local file
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating trace directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening trace file: %v", err)
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(service string, spans []*Span) error {
+	data, err := json.Marshal(toOTLP(service, spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(data, '\n'))
+	return err
+}
+
+// Spans an OTLP exporter holds for the collector, how many it posts at once
+// and how long a partial batch waits
+const (
+	otlpQueueSize     = 4096
+	otlpBatchSize     = 512
+	otlpFlushInterval = time.Second
+)
+
+// Posts spans to an OTLP/HTTP collector, e.g. http://localhost:4318/v1/traces.
+// Export only queues a span: a background goroutine posts them in batches,
+// so a slow or missing collector never holds up a request. Spans are dropped
+// while the queue is full.
+type OTLPExporter struct {
+	url     string
+	client  *http.Client
+	queue   chan queuedSpan
+	dropped atomic.Int64 // Since the last batch was posted
+	logger  *slog.Logger
+}
+
+type queuedSpan struct {
+	service string
+	span    *Span
+}
+
+func NewOTLPExporter(url string, logger *slog.Logger) *OTLPExporter {
+	e := &OTLPExporter{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan queuedSpan, otlpQueueSize),
+		logger: logger,
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	for _, s := range spans {
+		select {
+		case e.queue <- queuedSpan{service, s}:
+		default:
+			e.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Post queued spans once a batch is full or the flush interval passes
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []queuedSpan
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if dropped := e.dropped.Swap(0); dropped > 0 {
+			e.logger.Warn("trace export queue full, spans dropped", "dropped", dropped)
+		}
+		if len(batch) > 0 {
+			if err := e.post(batch); err != nil {
+				e.logger.Warn("error exporting spans", "spans", len(batch), "error", err)
+			}
+			batch = nil
+		}
+	}
+}
+
+// One export request per service, each in a resource of its own
+func (e *OTLPExporter) post(batch []queuedSpan) error {
+	var request otlpRequest
+	var services []string
+	spans := make(map[string][]*Span)
+	for _, s := range batch {
+		if _, ok := spans[s.service]; !ok {
+			services = append(services, s.service)
+		}
+		spans[s.service] = append(spans[s.service], s.span)
+	}
+	for _, service := range services {
+		request.ResourceSpans = append(request.ResourceSpans, toOTLP(service, spans[service]).ResourceSpans...)
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON encoding (ExportTraceServiceRequest)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 = OK, 2 = ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func toOTLP(service string, spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		status := otlpStatus{Code: 1}
+		if s.Failed {
+			status = otlpStatus{Code: 2, Message: s.Message}
+		}
+		var links []otlpLink
+		for _, link := range s.Links {
+			links = append(links, otlpLink{TraceID: link.TraceID, SpanID: link.SpanID})
+		}
+		out = append(out, otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        toKeyValues(s.Attributes),
+			Links:             links,
+			Status:            status,
+		})
+		s.mu.Unlock()
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: toKeyValues(map[string]any{"service.name": service})},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "mini-cloud"}, Spans: out}},
+		}},
+	}
+}
+
+func toKeyValues(attrs map[string]any) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, k := range keys {
+		var v otlpValue
+		switch val := attrs[k].(type) {
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &val
+		case string:
+			v.StringValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+	return kvs
+}
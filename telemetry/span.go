@@ -0,0 +1,105 @@
+package telemetry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Identifies a span within a trace, propagated in RPC requests
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Kind of span, numbered as in OpenTelemetry
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]any
+	Failed       bool
+	Message      string
+	Links        []SpanContext // Related spans of other traces
+
+	mu     sync.Mutex
+	tracer *Tracer
+	ended  bool
+}
+
+// Create a random 16 byte trace ID
+func NewTraceID() string {
+	return randomHex(16)
+}
+
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(fmt.Sprintf("generating random ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Relate the span to a span of another trace, e.g. a batch to its commands
+func (s *Span) AddLink(other SpanContext) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Links = append(s.Links, other)
+}
+
+// Mark span as failed
+func (s *Span) Fail(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Failed = true
+	s.Message = message
+}
+
+// Mark span as failed if err is not nil
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.Fail(err.Error())
+	}
+}
+
+// Finish span and hand it to the exporter
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	s.tracer.export(s)
+}
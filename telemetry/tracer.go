@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+// Trace exporters for utils.TraceExporter
+const (
+	ExporterNone = ""
+	ExporterFile = "file"
+	ExporterOTLP = "otlp"
+)
+
+type Tracer struct {
+	service  string
+	exporter Exporter
+	logger   *slog.Logger
+}
+
+func NewTracer(service string, exporter Exporter, logger *slog.Logger) *Tracer {
+	return &Tracer{
+		service:  service,
+		exporter: exporter,
+		logger:   logger,
+	}
+}
+
+// Create a tracer for a node using the configured exporter
+func NewNodeTracer(nodeID int, logger *slog.Logger) (*Tracer, error) {
+	service := fmt.Sprintf("mini-cloud-node-%d", nodeID)
+	var exporter Exporter
+	switch utils.TraceExporter {
+	case ExporterNone:
+	case ExporterFile:
+		path := filepath.Join(utils.TraceDir, fmt.Sprintf("node_%d.jsonl", nodeID))
+		fileExporter, err := NewFileExporter(path)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	case ExporterOTLP:
+		exporter = NewOTLPExporter(utils.TraceCollectorURL, logger)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", utils.TraceExporter)
+	}
+	return NewTracer(service, exporter, logger), nil
+}
+
+// Start a span. A parent without a trace ID starts a new trace.
+func (t *Tracer) Start(parent SpanContext, name string, kind SpanKind) *Span {
+	traceID := parent.TraceID
+	if traceID == "" {
+		traceID = NewTraceID()
+	}
+	return &Span{
+		TraceID:      traceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: parent.SpanID,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+		Attributes:   make(map[string]any),
+		tracer:       t,
+	}
+}
+
+func (t *Tracer) export(s *Span) {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	if err := t.exporter.Export(t.service, []*Span{s}); err != nil {
+		t.logger.Warn("error exporting span", "trace_id", s.TraceID, "span", s.Name, "error", err)
+	}
+}
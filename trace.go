@@ -0,0 +1,105 @@
+// trace.go
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/derekjtong/mini-cloud/paxos"
+	"github.com/derekjtong/mini-cloud/visualize"
+)
+
+// Trace subcommands: go run main.go trace <command> ...
+func runTraceCommand(args []string) {
+	if len(args) == 0 {
+		printTraceUsage()
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "replay":
+		if len(args) < 2 {
+			fmt.Println("Usage: go run main.go trace replay <file>...")
+			os.Exit(1)
+		}
+		os.Exit(replayTrace(args[1:]))
+	case "render":
+		os.Exit(renderTrace(args[1:]))
+	default:
+		printTraceUsage()
+		os.Exit(1)
+	}
+}
+
+func printTraceUsage() {
+	fmt.Println("Usage: go run main.go trace <command>")
+	fmt.Println("  replay <file>... - re-execute recorded Paxos messages and report divergences")
+	fmt.Println("  render [-format mermaid|plantuml|html] [-o file] <file>... - draw recorded rounds as a sequence diagram or HTML timeline")
+}
+
+// Replay message trace files, returns the exit code
+func replayTrace(files []string) int {
+	messages, err := paxos.ReadMessages(files...)
+	if err != nil {
+		fmt.Printf("Error reading trace: %v\n", err)
+		return 1
+	}
+
+	report := paxos.Replay(messages)
+	fmt.Printf("Replayed %d messages: %d acceptor steps, %d proposals\n", len(messages), report.AcceptorSteps, report.Proposals)
+	if len(report.Divergences) == 0 {
+		fmt.Println("No divergences")
+		return 0
+	}
+
+	fmt.Printf("%d divergences:\n", len(report.Divergences))
+	for _, d := range report.Divergences {
+		node := fmt.Sprintf("node %d", d.Node)
+		if d.Group != 0 {
+			node += fmt.Sprintf(" group %d", d.Group)
+		}
+		fmt.Printf("  %s %s (seq %d): %s\n", node, d.Role, d.Seq, d.Message)
+	}
+	return 2
+}
+
+// Render message trace files, returns the exit code
+func renderTrace(args []string) int {
+	flags := flag.NewFlagSet("trace render", flag.ContinueOnError)
+	format := flags.String("format", visualize.FormatMermaid, "output format: mermaid, plantuml or html")
+	output := flags.String("o", "", "output file (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Usage: go run main.go trace render [-format mermaid|plantuml|html] [-o file] <file>...")
+		return 1
+	}
+
+	messages, err := paxos.ReadMessages(flags.Args()...)
+	if err != nil {
+		fmt.Printf("Error reading trace: %v\n", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Printf("Error creating output file: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := visualize.Render(w, *format, messages); err != nil {
+		fmt.Printf("Error rendering trace: %v\n", err)
+		return 1
+	}
+	if *output != "" {
+		fmt.Printf("Wrote %s\n", *output)
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+const devCertValidity = 365 * 24 * time.Hour
+
+// Generate a local development CA, a certificate for every configured node
+// and a client certificate under utils.TLSCertDir. Not for production use.
+func GenerateDevCerts() ([]string, error) {
+	if err := os.MkdirAll(utils.TLSCertDir, 0755); err != nil {
+		return nil, err
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "mini-cloud dev CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(devCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	var written []string
+	caFile := certPath(utils.TLSCAFile)
+	if err := writePEM(caFile, "CERTIFICATE", caDER, 0644); err != nil {
+		return nil, err
+	}
+	written = append(written, caFile)
+
+	for nodeID := 1; nodeID <= utils.NodeCount; nodeID++ {
+		files, err := issueCert(caCert, caKey, NodeIdentity(nodeID),
+			certPath(fmt.Sprintf(utils.TLSNodeCertFile, nodeID)), certPath(fmt.Sprintf(utils.TLSNodeKeyFile, nodeID)),
+			[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth})
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, files...)
+	}
+
+	files, err := issueCert(caCert, caKey, "client", certPath(utils.TLSClientCertFile), certPath(utils.TLSClientKeyFile),
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	if err != nil {
+		return nil, err
+	}
+	return append(written, files...), nil
+}
+
+func issueCert(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, name string, certFile string, keyFile string, usages []x509.ExtKeyUsage) ([]string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(devCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usages,
+	}
+	if ip := net.ParseIP(utils.IPAddress); ip != nil && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, err
+	}
+	return []string{certFile, keyFile}, nil
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+}
+
+func newSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(fmt.Sprintf("generating serial number: %v", err))
+	}
+	return serial
+}
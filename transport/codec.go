@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+)
+
+// Request naming the node that sent it, e.g. a proposer's ID
+type Sender interface {
+	SenderID() int
+}
+
+// Serve connections from other nodes, like server.Accept but with
+// ServePeer
+func ServePeers(server *rpc.Server, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go ServePeer(server, conn)
+	}
+}
+
+// Serve a connection from another node. Requests that claim to come from a
+// node other than the one the connection authenticated as are answered with
+// an error. Without a node certificate requests are served as they are and
+// peers rely on the cluster token.
+func ServePeer(server *rpc.Server, conn net.Conn) {
+	peerID := PeerID(conn)
+	if peerID == 0 {
+		server.ServeConn(conn)
+		return
+	}
+	buf := bufio.NewWriter(conn)
+	server.ServeCodec(&peerCodec{
+		conn:   conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		buf:    buf,
+		peerID: peerID,
+	})
+}
+
+// Gob codec as used by net/rpc, checking the sender of each request
+type peerCodec struct {
+	conn   io.Closer
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	buf    *bufio.Writer
+	peerID int
+	closed bool
+}
+
+func (c *peerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *peerCodec) ReadRequestBody(body any) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if sender, ok := body.(Sender); ok && sender.SenderID() != c.peerID {
+		return fmt.Errorf("request claims to come from node %d, connection belongs to node %d", sender.SenderID(), c.peerID)
+	}
+	return nil
+}
+
+func (c *peerCodec) WriteResponse(r *rpc.Response, body any) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.buf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.buf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *peerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+const handshakeTimeout = 5 * time.Second
+
+// Certificate identity of a node, e.g. "node-1"
+func NodeIdentity(nodeID int) string {
+	return fmt.Sprintf("node-%d", nodeID)
+}
+
+// Listen for RPC connections. With TLS enabled, nodes present their node
+// certificate, and client certificates claiming to be a node must name a
+// configured node.
+func Listen(addr string, nodeID int) (net.Listener, error) {
+	if !utils.TLSEnabled {
+		return net.Listen("tcp", addr)
+	}
+	cert, err := loadNodeCert(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || !IsNodeCert(state.PeerCertificates[0]) {
+				// Client, with or without certificate
+				return nil
+			}
+			_, err := nodeOf(state.PeerCertificates[0])
+			return err
+		},
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// Listen for connections from other nodes only. With TLS enabled, a
+// certificate naming a configured node is required.
+func ListenPeer(addr string, nodeID int) (net.Listener, error) {
+	listener, err := Listen(addr, nodeID)
+	if err != nil || !utils.TLSEnabled {
+		return listener, err
+	}
+	return &peerListener{listener}, nil
+}
+
+type peerListener struct {
+	net.Listener
+}
+
+// Drop connections that don't present a node certificate
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if IsNodeConn(conn) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// Whether a connection is authenticated with a node certificate. Runs the
+// TLS handshake, so call it off the accept loop for untrusted listeners.
+func IsNodeConn(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	// Certificates were verified against the CA and node list in the handshake
+	return len(certs) > 0 && IsNodeCert(certs[0])
+}
+
+// Node a connection is authenticated as, or 0 for connections without a node
+// certificate. Call it once the handshake is done.
+func PeerID(conn net.Conn) int {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return 0
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 || !IsNodeCert(certs[0]) {
+		return 0
+	}
+	nodeID, _ := nodeOf(certs[0])
+	return nodeID
+}
+
+// Dial another node, authenticating with this node's certificate. With TLS
+// the server must present peerID's certificate, or any configured node's if
+// peerID is 0.
+func DialPeer(addr string, nodeID int, peerID int) (*rpc.Client, error) {
+	if !utils.TLSEnabled {
+		return rpc.Dial("tcp", addr)
+	}
+	cert, err := loadNodeCert(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return dialTLS(addr, []tls.Certificate{cert}, peerID)
+}
+
+// Dial a node as a client, presenting the client certificate if configured
+func DialClient(addr string) (*rpc.Client, error) {
+	if !utils.TLSEnabled {
+		return rpc.Dial("tcp", addr)
+	}
+	var certs []tls.Certificate
+	certFile := certPath(utils.TLSClientCertFile)
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, certPath(utils.TLSClientKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	return dialTLS(addr, certs, 0)
+}
+
+func dialTLS(addr string, certs []tls.Certificate, peerID int) (*rpc.Client, error) {
+	pool, err := loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+		// Nodes listen on dynamic ports, so instead of checking the host name
+		// the server must prove it is one of the configured nodes
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			if err != nil {
+				return err
+			}
+			nodeID, err := nodeOf(state.PeerCertificates[0])
+			if err == nil && peerID != 0 && nodeID != peerID {
+				err = fmt.Errorf("certificate of node %d presented, expected node %d", nodeID, peerID)
+			}
+			return err
+		},
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Whether a certificate claims a node identity
+func IsNodeCert(cert *x509.Certificate) bool {
+	return strings.HasPrefix(cert.Subject.CommonName, "node-")
+}
+
+// Configured node a certificate belongs to. The common name takes precedence
+// over DNS names, so a certificate stands for a single node.
+func nodeOf(cert *x509.Certificate) (int, error) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		for nodeID := 1; nodeID <= utils.NodeCount; nodeID++ {
+			if name == NodeIdentity(nodeID) {
+				return nodeID, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("certificate %q does not belong to a configured node", cert.Subject.CommonName)
+}
+
+func certPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(utils.TLSCertDir, name)
+}
+
+func loadNodeCert(nodeID int) (tls.Certificate, error) {
+	certFile := certPath(fmt.Sprintf(utils.TLSNodeCertFile, nodeID))
+	keyFile := certPath(fmt.Sprintf(utils.TLSNodeKeyFile, nodeID))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, fmt.Errorf("loading certificate for node %d: %v", nodeID, err)
+	}
+	return cert, nil
+}
+
+func loadCAPool() (*x509.CertPool, error) {
+	data, err := os.ReadFile(certPath(utils.TLSCAFile))
+	if err != nil {
+		return nil, fmt.Errorf("loading CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", certPath(utils.TLSCAFile))
+	}
+	return pool, nil
+}
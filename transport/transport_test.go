@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/derekjtong/mini-cloud/utils"
+)
+
+type HelloRequest struct {
+	From int
+}
+
+func (req HelloRequest) SenderID() int { return req.From }
+
+type Echo struct{}
+
+func (Echo) Hello(req *HelloRequest, res *int) error {
+	*res = req.From
+	return nil
+}
+
+// Dev certificates for three nodes in a temporary directory, with TLS
+// enabled until the test ends
+func withCerts(t *testing.T) string {
+	t.Helper()
+	enabled, dir, count := utils.TLSEnabled, utils.TLSCertDir, utils.NodeCount
+	t.Cleanup(func() { utils.TLSEnabled, utils.TLSCertDir, utils.NodeCount = enabled, dir, count })
+	utils.TLSEnabled, utils.NodeCount = true, 3
+	return generateCerts(t)
+}
+
+func generateCerts(t *testing.T) string {
+	t.Helper()
+	utils.TLSCertDir = t.TempDir()
+	if _, err := GenerateDevCerts(); err != nil {
+		t.Fatal(err)
+	}
+	return utils.TLSCertDir
+}
+
+// Peer listener of a node serving Echo
+func startPeer(t *testing.T, nodeID int) string {
+	t.Helper()
+	listener, err := ListenPeer("127.0.0.1:0", nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	if err := server.Register(Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	go ServePeers(server, listener)
+	return listener.Addr().String()
+}
+
+func hello(client *rpc.Client, from int) error {
+	var res int
+	return client.Call("Echo.Hello", &HelloRequest{From: from}, &res)
+}
+
+// Nodes reach each other as themselves, and only the node they dialed
+func TestDialPeer(t *testing.T) {
+	withCerts(t)
+	addr := startPeer(t, 1)
+
+	client, err := DialPeer(addr, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := hello(client, 2); err != nil {
+		t.Errorf("request from node 2 failed: %v", err)
+	}
+
+	if client, err := DialPeer(addr, 2, 3); err == nil {
+		client.Close()
+		t.Errorf("dialing node 3 accepted node 1's certificate")
+	}
+}
+
+// A node can't send requests claiming to come from another node, and the
+// connection keeps working for its own
+func TestSenderMismatch(t *testing.T) {
+	withCerts(t)
+	addr := startPeer(t, 1)
+	client, err := DialPeer(addr, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := hello(client, 3); err == nil || !strings.Contains(err.Error(), "node 3") {
+		t.Errorf("request claiming node 3 answered %v", err)
+	}
+	if err := hello(client, 2); err != nil {
+		t.Errorf("request from node 2 failed after a rejected one: %v", err)
+	}
+}
+
+// Clients and nodes that aren't configured can't reach the peer listener
+func TestPeerListenerRejects(t *testing.T) {
+	withCerts(t)
+	addr := startPeer(t, 1)
+
+	client, err := DialClient(addr)
+	if err == nil {
+		err = hello(client, 2)
+		client.Close()
+	}
+	if err == nil {
+		t.Errorf("client certificate reached the peer listener")
+	}
+
+	utils.NodeCount = 2
+	client, err = DialPeer(addr, 3, 0)
+	if err == nil {
+		err = hello(client, 3)
+		client.Close()
+	}
+	if err == nil {
+		t.Errorf("certificate of unconfigured node 3 reached the peer listener")
+	}
+}
+
+// Certificates issued by another CA are rejected by servers and clients
+func TestOtherCA(t *testing.T) {
+	trusted := withCerts(t)
+	addr := startPeer(t, 1)
+	other := generateCerts(t)
+	otherAddr := startPeer(t, 1)
+
+	// Node 2 of the other CA, trusting the server's CA
+	mixed := t.TempDir()
+	for _, file := range []string{utils.TLSCAFile, fmt.Sprintf(utils.TLSNodeCertFile, 2), fmt.Sprintf(utils.TLSNodeKeyFile, 2)} {
+		from := other
+		if file == utils.TLSCAFile {
+			from = trusted
+		}
+		data, err := os.ReadFile(filepath.Join(from, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(mixed, file), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	utils.TLSCertDir = mixed
+	client, err := DialPeer(addr, 2, 1)
+	if err == nil {
+		err = hello(client, 2)
+		client.Close()
+	}
+	if err == nil {
+		t.Errorf("server accepted a certificate of another CA")
+	}
+
+	utils.TLSCertDir = trusted
+	if client, err := DialPeer(otherAddr, 2, 1); err == nil {
+		client.Close()
+		t.Errorf("client accepted a server certificate of another CA")
+	}
+}
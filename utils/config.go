@@ -1,8 +1,126 @@
 package utils
 
+import "time"
+
 // Project configs
 
 var IPAddress = "127.0.0.1"
 var NodeCount = 3
+
+// Membership: role by node ID, nodes not listed are voters.
+//   - voter: votes in Paxos, stores files and may lead
+//   - witness: votes in Paxos but stores no files and serves no clients
+//   - learner: learns committed commands and serves stale reads without
+//     voting, so it doesn't count towards quorum sizes
+//
+// Witnesses and learners need the paxos engine.
+var NodeRoles = map[int]string{}
 var ClearNodeDataOnStart = true
 var MinimalStartUpLogging = true
+
+// Logging
+var LogLevel = "info"           // debug, info, warn, error
+var LogFormat = "text"          // text, json, color (ANSI protocol trace for debugging)
+var LogDir = "./node_data/logs" // Per-node log files, empty to disable
+var LogToStdout = true
+
+// File history, identical on every node so replicas keep the same versions
+var HistoryMaxVersions = 10       // Per file, 0 keeps every version
+var HistoryMaxAge = 0 * time.Hour // Older revisions are dropped on the next write, 0 keeps every version
+
+// Leader, the lowest numbered node answering heartbeats, proposes expiry of
+// sessions and files
+var HeartbeatInterval = 500 * time.Millisecond
+var LeaderTimeout = 2 * time.Second // Nodes not heard from for this long are considered down
+var ExpirySweepInterval = time.Second
+
+// Sessions and locks
+var SessionDefaultTTL = 15 * time.Second
+var SessionMinTTL = 5 * time.Second // Keepalives, sent every third of the TTL, retry a lost Paxos round for 1.5s at most
+var SessionMaxTTL = 5 * time.Minute
+
+// Quorum system used by proposers:
+//   - majority: Phase1Quorum and Phase2Quorum acceptors (Flexible Paxos)
+//   - weighted: Phase1Quorum and Phase2Quorum votes, QuorumWeights per node ID
+//   - grid: QuorumGroups are rows, phase 2 needs a full row, phase 1 a node of every row
+//   - hierarchical: a majority of QuorumGroups, each with a majority of its nodes
+var QuorumSystem = "majority"
+
+// 0 for majorities. If only one is set the other is the smallest size that
+// intersects it; together they must exceed NodeCount, or the total votes.
+var Phase1Quorum = 0 // Promises a proposer needs, paid when leadership changes
+var Phase2Quorum = 0 // Accepts a proposer needs, paid on every write
+
+// Fast Paxos: the node receiving a write sends it straight to the acceptors
+// in a fast round, falling back to a classic round when writes collide.
+// Needs the majority quorum system.
+var FastPaxos = false
+
+var QuorumWeights = map[int]int{} // Votes by node ID, 1 for nodes not listed
+var QuorumGroups = [][]int{}      // Node IDs by failure domain, each node in one group
+
+// Consensus engine: paxos orders every command in one log, raft does the same
+// with an elected leader, and epaxos (Egalitarian Paxos) has no leader and
+// only orders commands that touch the same path, session or lock, so any node
+// commits the others in one round trip. With epaxos versions count per path
+// instead of following one log, and watches follow the watched node's apply
+// order and resume only on that node, see node.WatchRequest. Quorum,
+// batching and Fast Paxos settings only apply to paxos.
+var ConsensusEngine = "paxos"
+
+// Raft engine: ConsensusEngine = "raft" elects a leader that replicates one
+// log to followers, which forward commands to it
+var RaftHeartbeatInterval = 100 * time.Millisecond
+var RaftElectionTimeout = 500 * time.Millisecond // Followers not hearing from a leader campaign after this, randomized up to twice it
+
+// Sharding: with ShardGroups set, files are split into shards and each
+// shard is served by the Paxos group of one entry, listing its node IDs.
+// Groups are numbered from 1. Every node also runs group 0, which holds the
+// shard map, sessions, locks and ACLs. Needs the paxos engine. Sessions and
+// locks work as without sharding, but ephemeral files don't: a session ends
+// in group 0, which can't delete files of the shard groups, so writes tied to
+// a session are refused.
+var ShardGroups = [][]int{}
+var ShardBy = "hash"         // hash: by a hash of the path, range: by the path itself
+var ShardSplits = []string{} // range: paths the initial shards after the first start at, e.g. {"/m"}
+
+// Batching and pipelining of client commands on the leader
+var BatchSize = 64                     // Most commands per log entry, 1 disables batching and forwarding to the leader
+var BatchLinger = 2 * time.Millisecond // How long a batch waits to fill up
+var PipelineDepth = 4                  // Slots proposed in parallel
+
+// Tracing
+var TraceExporter = "file"                                // "" (disabled), file, otlp
+var TraceDir = "./node_data/traces"                       // Per-node OTLP/JSON span files for the file exporter
+var TraceCollectorURL = "http://localhost:4318/v1/traces" // OTLP/HTTP endpoint for the otlp exporter
+
+// Paxos message recording, replay with 'go run main.go trace replay <file>...'
+var MessageTraceDir = "./node_data/messages" // Per-node append-only message logs, empty to disable
+
+// TLS, generate local dev certificates with 'go run main.go certs'
+var TLSEnabled = false
+var TLSCertDir = "./certs"
+var TLSCAFile = "ca.pem"                // Relative to TLSCertDir
+var TLSNodeCertFile = "node-%d.pem"     // Per node ID, also used as client certificate between nodes
+var TLSNodeKeyFile = "node-%d-key.pem"  // Per node ID
+var TLSClientCertFile = "client.pem"    // Optional certificate presented by the CLI
+var TLSClientKeyFile = "client-key.pem" // Optional
+
+// Authentication, the CLI sends a token set with 'login <token>' or MINI_CLOUD_TOKEN
+var AuthEnabled = false
+var ClusterToken = "dev-cluster-token" // Presented by nodes to each other and by the server launcher
+var AuthTokens = map[string]User{
+	"dev-admin-token":  {Name: "admin", Role: "admin"},
+	"dev-writer-token": {Name: "writer", Role: "writer"},
+	"dev-reader-token": {Name: "reader", Role: "reader"},
+}
+
+type User struct {
+	Name string
+	Role string // admin, writer or reader
+}
+
+// RPC services. Each node serves Client (files), Peer (Paxos) and Admin
+// (cluster controls, ACLs). When separate, each gets its own port so the
+// admin and peer ports can be firewalled.
+var SeparateServiceListeners = false
@@ -0,0 +1,146 @@
+package visualize
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/derekjtong/mini-cloud/paxos"
+)
+
+// Output formats
+const (
+	FormatMermaid  = "mermaid"
+	FormatPlantUML = "plantuml"
+	FormatHTML     = "html"
+)
+
+// Render recorded messages in the given format
+func Render(w io.Writer, format string, messages []paxos.Message) error {
+	rounds, nodes := BuildRounds(messages)
+	switch format {
+	case FormatMermaid:
+		return renderMermaid(w, rounds, nodes)
+	case FormatPlantUML:
+		return renderPlantUML(w, rounds, nodes)
+	case FormatHTML:
+		return renderHTML(w, rounds, nodes)
+	default:
+		return fmt.Errorf("unknown format %q (mermaid, plantuml, html)", format)
+	}
+}
+
+// Keep labels on one line and away from diagram syntax
+func diagramText(s string) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	s = strings.ReplaceAll(s, ";", ",")
+	s = strings.ReplaceAll(s, "#", "")
+	return s
+}
+
+func renderMermaid(w io.Writer, rounds []*Round, nodes []int) error {
+	var b strings.Builder
+	b.WriteString("sequenceDiagram\n")
+	for _, id := range nodes {
+		fmt.Fprintf(&b, "    participant N%d as Node %d\n", id, id)
+	}
+	for _, r := range rounds {
+		fmt.Fprintf(&b, "    Note over N%d: %s, client value %s\n", r.Proposer, r.Position(), diagramText(fmt.Sprintf("%q", r.ClientValue)))
+		for _, e := range r.Events {
+			arrow := "->>"
+			switch e.Kind {
+			case KindReply:
+				arrow = "-->>"
+			case KindReject:
+				arrow = "--x"
+			}
+			fmt.Fprintf(&b, "    N%d%sN%d: %s\n", e.From, arrow, e.To, diagramText(e.Label))
+		}
+		fmt.Fprintf(&b, "    Note over N%d: %s\n", r.Proposer, diagramText(r.Outcome()))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func renderPlantUML(w io.Writer, rounds []*Round, nodes []int) error {
+	var b strings.Builder
+	b.WriteString("@startuml\n")
+	for _, id := range nodes {
+		fmt.Fprintf(&b, "participant \"Node %d\" as N%d\n", id, id)
+	}
+	for _, r := range rounds {
+		fmt.Fprintf(&b, "== Node %d %s ==\n", r.Proposer, r.Position())
+		fmt.Fprintf(&b, "note over N%d : client value %s\n", r.Proposer, diagramText(fmt.Sprintf("%q", r.ClientValue)))
+		for _, e := range r.Events {
+			arrow := "->"
+			switch e.Kind {
+			case KindReply:
+				arrow = "-[#green]->"
+			case KindReject:
+				arrow = "-[#red]->x"
+			}
+			fmt.Fprintf(&b, "N%d %s N%d : %s\n", e.From, arrow, e.To, diagramText(e.Label))
+		}
+		fmt.Fprintf(&b, "note over N%d : %s\n", r.Proposer, diagramText(r.Outcome()))
+	}
+	b.WriteString("@enduml\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var htmlTemplate = template.Must(template.New("timeline").Funcs(template.FuncMap{
+	"cell": func(e Event, node int) string {
+		switch node {
+		case e.From:
+			return "from"
+		case e.To:
+			return "to"
+		}
+		return ""
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mini-cloud Paxos timeline</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; font-size: 13px; }
+th { background: #f4f4f4; }
+td.time { color: #888; white-space: nowrap; }
+tr.request td.from { background: #e8f0fe; }
+tr.reply td.from { background: #e6f4ea; }
+tr.reject td.from { background: #fce8e6; }
+td.to { color: #888; }
+h2 { margin-bottom: 0.2em; }
+p.outcome { margin-top: 0; }
+.ok { color: #188038; }
+.failed { color: #d93025; }
+</style>
+</head>
+<body>
+<h1>Paxos timeline</h1>
+<p>{{len .Rounds}} rounds across {{len .Nodes}} nodes</p>
+{{range .Rounds}}
+<h2>Node {{.Proposer}}, {{.Position}}</h2>
+<p class="outcome">Client value <code>{{printf "%q" .ClientValue}}</code>,
+{{.Promises}} promises, {{.Accepts}} accepts, {{.Rejections}} rejections:
+<span class="{{if .Error}}failed{{else}}ok{{end}}">{{.Outcome}}</span></p>
+<table>
+<tr><th>Time</th>{{range $.Nodes}}<th>Node {{.}}</th>{{end}}</tr>
+{{range $e := .Events}}<tr class="{{$e.Kind}}"><td class="time">{{$e.Time.Format "15:04:05.000000"}}</td>
+{{- range $.Nodes}}{{$c := cell $e .}}<td class="{{$c}}">{{if eq $c "from"}}{{$e.Label}}{{else if eq $c "to"}}&larr; N{{$e.From}}{{end}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+func renderHTML(w io.Writer, rounds []*Round, nodes []int) error {
+	return htmlTemplate.Execute(w, struct {
+		Rounds []*Round
+		Nodes  []int
+	}{rounds, nodes})
+}
@@ -0,0 +1,163 @@
+package visualize
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/derekjtong/mini-cloud/paxos"
+)
+
+// Event kinds
+const (
+	KindRequest = "request" // Prepare or accept
+	KindReply   = "reply"   // Promise or accepted
+	KindReject  = "reject"  // NACK
+)
+
+// One arrow between two nodes
+type Event struct {
+	Time  time.Time
+	Kind  string
+	From  int
+	To    int
+	Label string
+}
+
+// All messages of one proposer's ballot for a slot
+type Round struct {
+	Group       int // Consensus group, 0 for the one every node is in
+	Proposer    int
+	Slot        int
+	Ballot      int
+	Start       time.Time
+	ClientValue string
+	Chosen      string // Value accepted by a majority, if any
+	Error       string
+	Promises    int
+	Accepts     int
+	Rejections  int
+	Events      []Event
+}
+
+// Group recorded messages into rounds, ordered by start time
+func BuildRounds(messages []paxos.Message) ([]*Round, []int) {
+	sorted := append([]paxos.Message{}, messages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].Time.Before(sorted[j].Time)
+		}
+		if sorted[i].Recorder != sorted[j].Recorder {
+			return sorted[i].Recorder < sorted[j].Recorder
+		}
+		return sorted[i].Seq < sorted[j].Seq
+	})
+
+	// Acceptor addresses are only known from the acceptors' own records
+	nodeByAddr := make(map[string]int)
+	nodes := make(map[int]bool)
+	for _, m := range sorted {
+		if isAnswer(m) {
+			nodeByAddr[m.Addr] = m.From
+		}
+		nodes[m.Recorder] = true
+	}
+
+	type roundKey struct{ group, proposer, slot, ballot int }
+	rounds := make(map[roundKey]*Round)
+	var order []*Round
+	round := func(m paxos.Message, proposer int) *Round {
+		key := roundKey{m.Group, proposer, m.Slot, m.Ballot}
+		if r, ok := rounds[key]; ok {
+			return r
+		}
+		r := &Round{Group: m.Group, Proposer: proposer, Slot: m.Slot, Ballot: m.Ballot, Start: m.Time}
+		rounds[key] = r
+		order = append(order, r)
+		return r
+	}
+
+	for _, m := range sorted {
+		switch m.Type {
+		case paxos.MsgPropose:
+			round(m, m.From).ClientValue = m.Value
+		case paxos.MsgResult:
+			r := round(m, m.From)
+			r.Error = m.Error
+			if m.Error == "" || m.Error == paxos.ErrNotClientValue.Error() {
+				r.Chosen = m.Value
+			}
+		case paxos.MsgPrepare, paxos.MsgAccept:
+			to, ok := nodeByAddr[m.Addr]
+			if !ok {
+				// Acceptor never answered, label with its address
+				to = -1
+			}
+			label := fmt.Sprintf("prepare(%d)", m.Ballot)
+			if m.Type == paxos.MsgAccept {
+				label = fmt.Sprintf("accept(%d, %q)", m.Ballot, m.Value)
+			}
+			if to == -1 {
+				label += " to " + m.Addr
+				to = m.From
+			}
+			r := round(m, m.From)
+			r.Events = append(r.Events, Event{Time: m.Time, Kind: KindRequest, From: m.From, To: to, Label: label})
+		case paxos.MsgPromise:
+			r := round(m, m.To)
+			r.Promises++
+			label := fmt.Sprintf("promise(%d)", m.Ballot)
+			if m.AcceptedBallot >= 0 && m.AcceptedValue != "" {
+				label = fmt.Sprintf("promise(%d, accepted %d %q)", m.Ballot, m.AcceptedBallot, m.AcceptedValue)
+			}
+			r.Events = append(r.Events, Event{Time: m.Time, Kind: KindReply, From: m.From, To: m.To, Label: label})
+		case paxos.MsgAccepted:
+			r := round(m, m.To)
+			r.Accepts++
+			r.Events = append(r.Events, Event{Time: m.Time, Kind: KindReply, From: m.From, To: m.To, Label: fmt.Sprintf("accepted(%d)", m.Ballot)})
+		case paxos.MsgNack:
+			r := round(m, m.To)
+			r.Rejections++
+			label := fmt.Sprintf("nack %s(%d): %s", m.Phase, m.Ballot, m.Reason)
+			r.Events = append(r.Events, Event{Time: m.Time, Kind: KindReject, From: m.From, To: m.To, Label: label})
+		}
+	}
+
+	nodeIDs := make([]int, 0, len(nodes))
+	for id := range nodes {
+		nodeIDs = append(nodeIDs, id)
+	}
+	sort.Ints(nodeIDs)
+	return order, nodeIDs
+}
+
+func isAnswer(m paxos.Message) bool {
+	switch m.Type {
+	case paxos.MsgPromise, paxos.MsgAccepted, paxos.MsgNack:
+		return m.From == m.Recorder
+	}
+	return false
+}
+
+// Slot and ballot of the round, and its group if it isn't group 0
+func (r *Round) Position() string {
+	position := fmt.Sprintf("slot %d ballot %d", r.Slot, r.Ballot)
+	if r.Group != 0 {
+		position = fmt.Sprintf("group %d %s", r.Group, position)
+	}
+	return position
+}
+
+// Short description of a round's outcome
+func (r *Round) Outcome() string {
+	switch {
+	case r.Error == "" && r.Chosen != "":
+		return fmt.Sprintf("chosen %q", r.Chosen)
+	case r.Chosen != "":
+		return fmt.Sprintf("chosen %q (not client value)", r.Chosen)
+	case r.Error != "":
+		return "failed: " + r.Error
+	default:
+		return "no result recorded"
+	}
+}
@@ -0,0 +1,60 @@
+// watch.go
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/rpc"
+	"strconv"
+	"strings"
+
+	"github.com/derekjtong/mini-cloud/node"
+)
+
+// watch <path> [fromVersion], printing changes until Enter is pressed
+func runWatchCommand(scanner *bufio.Scanner, client *rpc.Client, token string, argument string) {
+	fields := strings.Fields(argument)
+	if len(fields) == 0 || len(fields) > 2 {
+		fmt.Println("Usage: watch <path> [fromVersion]")
+		return
+	}
+	req := node.WatchRequest{Path: fields[0], Token: token}
+	if len(fields) == 2 {
+		v, err := strconv.Atoi(fields[1])
+		if err != nil || v < 0 {
+			fmt.Println("Usage: watch <path> [fromVersion]")
+			return
+		}
+		req.FromVersion = v
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var res node.WatchResponse
+			call := client.Go("Client.Watch", &req, &res, nil)
+			select {
+			case <-stop:
+				return
+			case <-call.Done:
+			}
+			if call.Error != nil {
+				fmt.Printf("Watch failure: %v, press Enter to return\n", call.Error)
+				return
+			}
+			for _, event := range res.Events {
+				fmt.Printf("  v%d  %s  %s  %s\n", event.Version, event.Op, event.Path, event.Author)
+			}
+			req.FromVersion = res.Version
+		}
+	}()
+
+	fmt.Printf("Watching %s from version %d, press Enter to stop\n", req.Path, req.FromVersion)
+	scanner.Scan()
+	close(stop)
+	<-done
+	fmt.Printf("Stopped at version %d, resume with 'watch %s %d'\n", req.FromVersion, req.Path, req.FromVersion)
+}